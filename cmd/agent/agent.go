@@ -31,7 +31,7 @@ func init() {
 
 	// Here you will define your flags and configuration settings.
 
-	AgentCmd.PersistentFlags().String("token", "", "The agent token for the agent to communicate with the hub")
+	AgentCmd.PersistentFlags().String("token", "", "The agent token for the agent to communicate with the hub, including the signing key if any")
 	AgentCmd.PersistentFlags().String("hub", "", "The hub address")
 	AgentCmd.PersistentFlags().Int("agentID", 0, "Override the agent ID")
 	viper.BindPFlags(AgentCmd.PersistentFlags())
@@ -16,7 +16,15 @@ limitations under the License.
 package agent
 
 import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+	"time"
+
 	"github.com/hoveychen/slime/pkg/agent"
+	"github.com/hoveychen/slime/pkg/hwinfo"
+	"github.com/hoveychen/slime/pkg/tlsutil"
+	"github.com/hoveychen/slime/pkg/tracing"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -29,10 +37,6 @@ var runCmd = &cobra.Command{
 	Short: "Run a agent server.",
 	Long:  `An agent server is a server that can be used to proxy the traffic to the upstream server.`,
 	Run: func(cmd *cobra.Command, args []string) {
-		token := viper.GetString("token")
-		if token == "" {
-			logrus.Fatal("No token is provided")
-		}
 		hub := viper.GetString("hub")
 		if hub == "" {
 			logrus.Fatal("No hub address is provided")
@@ -49,16 +53,81 @@ var runCmd = &cobra.Command{
 		if !viper.GetBool("reportHardware") {
 			opts = append(opts, agent.WithReportHardware(false))
 		}
+		opts = append(opts, agent.WithReportInterval(viper.GetDuration("reportInterval")))
+		hwPolicy, err := hwinfo.ParseReportPolicy(viper.GetString("hardwarePolicy"))
+		if err != nil {
+			logrus.WithError(err).Fatal("Invalid hardware policy")
+		}
+		opts = append(opts, agent.WithHardwarePolicy(hwPolicy))
 		agentID := viper.GetInt("agentID")
 		if agentID != 0 {
 			opts = append(opts, agent.WithAgentID(agentID))
 		}
 
+		if pathPrefix := viper.GetString("pathPrefix"); pathPrefix != "" {
+			if !strings.HasPrefix(pathPrefix, "/") {
+				logrus.Fatal("The path prefix must start with /")
+			}
+			opts = append(opts, agent.WithPathPrefix(pathPrefix))
+		}
+		rewrite, err := newRewriteRules()
+		if err != nil {
+			logrus.WithError(err).Fatal("Invalid rewrite rules")
+		}
+		opts = append(opts, agent.WithRewriteRules(rewrite))
+
+		if endpoint := viper.GetString("otlpEndpoint"); endpoint != "" {
+			tracer := tracing.NewTracer("slime-agent", endpoint)
+			go tracer.Run(cmd.Context())
+			opts = append(opts, agent.WithTracer(tracer))
+		}
+
+		hubTransport, upstreamTransport, err := newTransportConfigs()
+		if err != nil {
+			logrus.WithError(err).Fatal("Invalid transport configuration")
+		}
+		opts = append(opts, agent.WithHubTransport(hubTransport), agent.WithUpstreamTransport(upstreamTransport))
+
+		if tlsConfig, err := newHubTLSConfig(viper.GetString("clientCert"), viper.GetString("clientKey"), viper.GetString("hubCA")); err != nil {
+			logrus.WithError(err).Fatal("Failed to load TLS configuration")
+		} else if tlsConfig != nil {
+			opts = append(opts, agent.WithHubTLSConfig(tlsConfig))
+		}
+
+		token := viper.GetString("token")
+		if token == "" && viper.GetString("enrollCode") != "" {
+			token, err = agent.Enroll(cmd.Context(), hub, viper.GetString("enrollCode"), opts...)
+			if err != nil {
+				logrus.WithError(err).Fatal("Failed to enroll")
+			}
+		}
+		if token == "" {
+			logrus.Fatal("No token is provided")
+		}
+
 		grp, ctx := errgroup.WithContext(cmd.Context())
-		for _, upstream := range upstreams {
+		if mode := viper.GetString("upstreamMode"); mode == "pool" {
+			logrus.WithField("upstreams", upstreams).Info("Starting agent for the upstream pool")
+			agent, err := agent.NewAgentServerPool(hub, upstreams, token, opts...)
+			if err != nil {
+				logrus.WithError(err).Fatal("Invalid upstream pool")
+			}
+			if err := agent.Run(cmd.Context()); err != nil {
+				logrus.WithError(err).Error("Agent server terminated")
+			}
+			return
+		} else if mode != "separate" {
+			logrus.Fatalf("Invalid upstream mode %q", mode)
+		}
+		numWorker := viper.GetInt("numWorker")
+		if numWorker < 1 {
+			numWorker = 1
+		}
+		for i, upstream := range upstreams {
 			upstream := upstream
 			logrus.WithField("upstream", upstream).Info("Starting agent for upstream")
-			agent, err := agent.NewAgentServer(hub, upstream, token, opts...)
+			// Each agent server takes its own range of agent IDs.
+			agent, err := agent.NewAgentServer(hub, upstream, token, append(opts[:len(opts):len(opts)], agent.WithAgentIDOffset(i*numWorker))...)
 			if err != nil {
 				panic(err)
 			}
@@ -74,12 +143,134 @@ var runCmd = &cobra.Command{
 	},
 }
 
+// newRewriteRules merges the rewrite rules in the config file with the ones by the flags.
+func newRewriteRules() (*agent.RewriteRules, error) {
+	rules := &agent.RewriteRules{}
+	if err := viper.UnmarshalKey("rewrite", rules); err != nil {
+		return nil, err
+	}
+	for _, flag := range []struct {
+		name    string
+		headers *map[string]string
+	}{
+		{"setHeader", &rules.RequestHeaders.Set},
+		{"addHeader", &rules.RequestHeaders.Add},
+		{"setResponseHeader", &rules.ResponseHeaders.Set},
+		{"addResponseHeader", &rules.ResponseHeaders.Add},
+	} {
+		for _, header := range viper.GetStringSlice(flag.name) {
+			name, value, err := agent.ParseHeader(header)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", flag.name, err)
+			}
+			if *flag.headers == nil {
+				*flag.headers = make(map[string]string)
+			}
+			(*flag.headers)[name] = value
+		}
+	}
+	rules.RequestHeaders.Remove = append(rules.RequestHeaders.Remove, viper.GetStringSlice("removeHeader")...)
+	rules.ResponseHeaders.Remove = append(rules.ResponseHeaders.Remove, viper.GetStringSlice("removeResponseHeader")...)
+	if prefix := viper.GetString("stripPrefix"); prefix != "" {
+		rules.StripPrefix = prefix
+	}
+	if prefix := viper.GetString("addPrefix"); prefix != "" {
+		rules.AddPrefix = prefix
+	}
+	if err := rules.Validate(); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// newTransportConfigs returns the transport configurations to the hub and the upstreams.
+func newTransportConfigs() (*agent.TransportConfig, *agent.TransportConfig, error) {
+	hub := &agent.TransportConfig{
+		DialTimeout:     viper.GetDuration("hubDialTimeout"),
+		IdleConnTimeout: viper.GetDuration("hubIdleConnTimeout"),
+		Proxy:           viper.GetString("hubProxy"),
+		DisableHTTP2:    !viper.GetBool("hubHTTP2"),
+	}
+	upstream := &agent.TransportConfig{
+		DialTimeout:           viper.GetDuration("upstreamDialTimeout"),
+		ResponseHeaderTimeout: viper.GetDuration("upstreamResponseHeaderTimeout"),
+		IdleConnTimeout:       viper.GetDuration("upstreamIdleConnTimeout"),
+		MaxIdleConnsPerHost:   viper.GetInt("upstreamMaxIdleConns"),
+		InsecureSkipVerify:    viper.GetBool("upstreamInsecureSkipVerify"),
+		Proxy:                 viper.GetString("upstreamProxy"),
+		DisableHTTP2:          !viper.GetBool("upstreamHTTP2"),
+	}
+	if caFile := viper.GetString("upstreamCA"); caFile != "" {
+		pool, err := tlsutil.LoadCertPool(caFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		upstream.RootCAs = pool
+	}
+	for _, cfg := range []*agent.TransportConfig{hub, upstream} {
+		if err := cfg.Validate(); err != nil {
+			return nil, nil, err
+		}
+	}
+	return hub, upstream, nil
+}
+
+func newHubTLSConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+	if certFile == "" && keyFile == "" && caFile == "" {
+		return nil, nil
+	}
+	tlsConfig := &tls.Config{}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if caFile != "" {
+		pool, err := tlsutil.LoadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = pool
+	}
+	return tlsConfig, nil
+}
+
 func init() {
 	AgentCmd.AddCommand(runCmd)
 
 	// Here you will define your flags and configuration settings.
-	runCmd.PersistentFlags().StringSlice("upstream", nil, "The upstream address")
-	runCmd.PersistentFlags().Int("numWorker", 1, "The number of workers to handle the requests")
+	runCmd.PersistentFlags().StringSlice("upstream", nil, "The upstream address, optionally with the base path and query, e.g. http://localhost:8000/api")
+	runCmd.PersistentFlags().String("upstreamMode", "separate", "How to serve multiple upstreams: separate (an agent per upstream), or pool (one agent balancing the requests across the upstreams, failing over the failing ones)")
+	runCmd.PersistentFlags().String("enrollCode", "", "The one-time enrollment code to get the agent token, when no token is provided. The issued token is saved locally once approved by the hub admin")
+	runCmd.PersistentFlags().Int("numWorker", 1, "The number of workers to handle the requests, per upstream")
 	runCmd.PersistentFlags().Bool("reportHardware", true, "Report the hardware information to the hub")
+	runCmd.PersistentFlags().String("clientCert", "", "The TLS client certificate file to authenticate to the hub")
+	runCmd.PersistentFlags().String("clientKey", "", "The TLS client private key file to authenticate to the hub")
+	runCmd.PersistentFlags().String("hubCA", "", "The CA certificate file to verify the hub, instead of the system roots")
+	runCmd.PersistentFlags().String("hardwarePolicy", "hashed", "How identifying hardware information is reported: full (raw MAC addresses and GPU UUIDs), hashed (keyed hashes and a fingerprint) or coarse (no identifiers)")
+	runCmd.PersistentFlags().Duration("reportInterval", 30*time.Second, "How often to report the telemetry (e.g. load, GPU usage, in-flight requests) to the hub. 0 to disable")
+	runCmd.PersistentFlags().String("pathPrefix", "", "Only receive the requests under the path prefix from the hub, so that one hub can front several upstreams mounted under different prefixes. Strip it from the requests to the upstream with stripPrefix")
+	runCmd.PersistentFlags().StringArray("setHeader", nil, "Set the request header to the upstream, in the form of \"Name: value\", e.g. the upstream API key. Repeatable")
+	runCmd.PersistentFlags().StringArray("addHeader", nil, "Add the request header to the upstream, in the form of \"Name: value\". Repeatable")
+	runCmd.PersistentFlags().StringArray("removeHeader", nil, "Remove the request header to the upstream. Repeatable")
+	runCmd.PersistentFlags().StringArray("setResponseHeader", nil, "Set the response header from the upstream, in the form of \"Name: value\". Repeatable")
+	runCmd.PersistentFlags().StringArray("addResponseHeader", nil, "Add the response header from the upstream, in the form of \"Name: value\". Repeatable")
+	runCmd.PersistentFlags().StringArray("removeResponseHeader", nil, "Remove the response header from the upstream. Repeatable")
+	runCmd.PersistentFlags().String("stripPrefix", "", "Strip the prefix from the request path to the upstream. The requests out of the prefix are not rewritten")
+	runCmd.PersistentFlags().String("addPrefix", "", "Add the prefix to the request path to the upstream, in place of the stripped prefix")
+	runCmd.PersistentFlags().Duration("hubDialTimeout", 0, "The timeout to connect to the hub. 0 for the default")
+	runCmd.PersistentFlags().Duration("hubIdleConnTimeout", 0, "How long the idle connections to the hub are kept. 0 for the default")
+	runCmd.PersistentFlags().String("hubProxy", "", "The proxy URL to the hub, or direct for no proxy. Follows HTTP_PROXY, HTTPS_PROXY and NO_PROXY when empty")
+	runCmd.PersistentFlags().Bool("hubHTTP2", true, "Allow HTTP/2 to the hub over HTTPS")
+	runCmd.PersistentFlags().Duration("upstreamDialTimeout", 0, "The timeout to connect to the upstream. 0 for the default")
+	runCmd.PersistentFlags().Duration("upstreamResponseHeaderTimeout", 0, "The timeout to wait for the response headers of the upstream. 0 for no timeout")
+	runCmd.PersistentFlags().Duration("upstreamIdleConnTimeout", 0, "How long the idle connections to the upstream are kept. 0 for the default")
+	runCmd.PersistentFlags().Int("upstreamMaxIdleConns", 0, "The max idle connections kept per upstream. 0 for the default")
+	runCmd.PersistentFlags().String("upstreamCA", "", "The CA certificate file to verify the upstream, instead of the system roots")
+	runCmd.PersistentFlags().Bool("upstreamInsecureSkipVerify", false, "Skip verifying the TLS certificate of the upstream, e.g. for the lab upstreams. Insecure")
+	runCmd.PersistentFlags().String("upstreamProxy", "", "The proxy URL to the upstream, or direct for no proxy. Follows HTTP_PROXY, HTTPS_PROXY and NO_PROXY when empty")
+	runCmd.PersistentFlags().Bool("upstreamHTTP2", true, "Allow HTTP/2 to the upstream over HTTPS")
 	viper.BindPFlags(runCmd.PersistentFlags())
 }
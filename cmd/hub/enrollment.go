@@ -0,0 +1,183 @@
+/*
+Copyright © 2023 Harry C <hoveychen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package hub
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/hoveychen/slime/pkg/hub"
+	"github.com/hoveychen/slime/pkg/token"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// enrollmentCmd represents the enrollment command
+var enrollmentCmd = &cobra.Command{
+	Use:   "enrollment [command] [options]",
+	Short: "Manage the self-service enrollment of the agents",
+	Long: `An agent started with a one-time enrollment code waits for the approval of the hub admin,
+and receives its agent token automatically once approved.
+
+The enrollments are kept in the memory of the hub only. After the hub restarts, the waiting agents
+show up as pending again and have to be approved again, and an unexpired code can be used once more.`,
+	PersistentPreRun: bindRunningFlags,
+}
+
+var enrollmentCodeCmd = &cobra.Command{
+	Use:   "code --secret <secret>",
+	Short: "Generate a one-time enrollment code for an agent",
+	Run: func(cmd *cobra.Command, args []string) {
+		secret := viper.GetString("secret")
+		if secret == "" {
+			logrus.Fatal("The secret is required")
+		}
+
+		code := token.AgentToken{
+			Id:         rand.Int63(),
+			Name:       viper.GetString("name"),
+			ScopePaths: viper.GetStringSlice("scopePaths"),
+			Scopes:     viper.GetStringSlice("scopes"),
+			Enrollment: true,
+			TokenAge:   int64(viper.GetDuration("tokenAge").Seconds()),
+		}
+		if age := viper.GetDuration("age"); age > 0 {
+			code.ExpireAt = time.Now().Add(age).Unix()
+		}
+		code.MaxAgentIds = viper.GetInt32("maxAgentIDs")
+		code.MaxConnections = viper.GetInt32("maxConnections")
+
+		tokenMgr := token.NewTokenManager([]byte(secret))
+		data, err := tokenMgr.Encrypt(&code)
+		if err != nil {
+			logrus.WithError(err).Fatal("Failed to encrypt the enrollment code")
+		}
+		fmt.Println(data)
+	},
+}
+
+var enrollmentListCmd = &cobra.Command{
+	Use:   "list --hub <hub_address> --adminPassword <password>",
+	Short: "List the enrollments of the agents",
+	Run: func(cmd *cobra.Command, args []string) {
+		var enrollments []*hub.Enrollment
+		if err := adminRequest("GET", hub.PathAdminEnrollments, nil, &enrollments); err != nil {
+			logrus.WithError(err).Fatal("Failed to list the enrollments")
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "CODE ID\tNAME\tREMOTE\tSTATUS\tCREATED AT")
+		for _, e := range enrollments {
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\n", e.CodeID, e.Name, e.Remote, e.Status, e.CreatedAt.Format(time.RFC3339))
+		}
+		w.Flush()
+	},
+}
+
+var enrollmentApproveCmd = &cobra.Command{
+	Use:   "approve <code ID> --hub <hub_address> --adminPassword <password>",
+	Short: "Approve the enrollment, and issue the agent token to the agent",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		decideEnrollment(hub.PathAdminApprove, args[0])
+	},
+}
+
+var enrollmentRejectCmd = &cobra.Command{
+	Use:   "reject <code ID> --hub <hub_address> --adminPassword <password>",
+	Short: "Reject the enrollment",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		decideEnrollment(hub.PathAdminReject, args[0])
+	},
+}
+
+func decideEnrollment(apiPath, codeID string) {
+	id, err := strconv.ParseInt(codeID, 10, 64)
+	if err != nil {
+		logrus.WithError(err).Fatal("Invalid code ID")
+	}
+	var e hub.Enrollment
+	if err := adminRequest("POST", apiPath, &hub.EnrollmentDecision{CodeID: id}, &e); err != nil {
+		logrus.WithError(err).Fatal("Failed to decide the enrollment")
+	}
+	fmt.Printf("%d\t%s\t%s\n", e.CodeID, e.Name, e.Status)
+}
+
+// adminRequest calls the admin API of the hub, and decodes the JSON response into out.
+func adminRequest(method, apiPath string, in, out interface{}) error {
+	hubAddr := viper.GetString("hub")
+	if hubAddr == "" {
+		return errors.New("no hub address is provided")
+	}
+	if !strings.Contains(hubAddr, "://") {
+		hubAddr = "http://" + hubAddr
+	}
+
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, strings.TrimSuffix(hubAddr, "/")+apiPath, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("slime-admin-password", viper.GetString("adminPassword"))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("%s: %s", resp.Status, msg)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func init() {
+	HubCmd.AddCommand(enrollmentCmd)
+	enrollmentCmd.AddCommand(enrollmentCodeCmd, enrollmentListCmd, enrollmentApproveCmd, enrollmentRejectCmd)
+
+	enrollmentCodeCmd.Flags().String("name", "", "The agent name. When empty, the name reported by the agent is used")
+	enrollmentCodeCmd.Flags().Duration("age", 24*time.Hour, "How long the enrollment code is valid. 0 for no expiry")
+	enrollmentCodeCmd.Flags().Duration("tokenAge", 0, "When specified, the issued agent token will be expired after the specified age. format like '1h2m3s'")
+	enrollmentCodeCmd.Flags().StringSlice("scopePaths", []string{}, "When specified, the agent accepts only the scoped paths")
+	enrollmentCodeCmd.Flags().StringSlice("scopes", []string{}, "When the application specified a scope to invoke, only the agent with the scopes can be accepted.")
+	enrollmentCodeCmd.Flags().Int32("maxAgentIDs", 0, "When specified, limits the number of distinct agent IDs connected with the issued token at the same time")
+	enrollmentCodeCmd.Flags().Int32("maxConnections", 0, "When specified, limits the number of connections with the issued token at the same time")
+
+	for _, cmd := range []*cobra.Command{enrollmentListCmd, enrollmentApproveCmd, enrollmentRejectCmd} {
+		cmd.Flags().String("hub", "", "The hub address")
+		cmd.Flags().String("adminPassword", "", "The admin password of the hub")
+	}
+}
@@ -27,6 +27,13 @@ var HubCmd = &cobra.Command{
 	Long:  `A hub server accepts http requests, and forwards the requests to the agents.`,
 }
 
+// bindRunningFlags binds the flags of the running command to viper, as a PersistentPreRun. Viper keys the flags by
+// their names only, so the subcommands sharing the flag names, e.g. "hub", bind theirs once chosen to run, instead of
+// in init where the last one bound would win.
+func bindRunningFlags(cmd *cobra.Command, args []string) {
+	viper.BindPFlags(cmd.Flags())
+}
+
 func init() {
 	// Here you will define your flags and configuration settings.
 	HubCmd.PersistentFlags().String("secret", "", "The secret key for the hub communicate with the agent")
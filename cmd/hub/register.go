@@ -21,6 +21,7 @@ import (
 	"time"
 
 	petname "github.com/dustinkirkland/golang-petname"
+	"github.com/hoveychen/slime/pkg/tlsutil"
 	"github.com/hoveychen/slime/pkg/token"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
@@ -53,9 +54,36 @@ var registerCmd = &cobra.Command{
 			ScopePaths: scopePaths,
 			Scopes:     scopes,
 		}
+		agentToken.IssuedAt = time.Now().Unix()
 		if age > 0 {
 			agentToken.ExpireAt = time.Now().Add(age).Unix()
 		}
+		if renewUntil := viper.GetDuration("renewUntil"); renewUntil > 0 {
+			if age == 0 {
+				logrus.Fatal("The age is required to renew the token")
+			}
+			agentToken.RenewUntil = time.Now().Add(renewUntil).Unix()
+		}
+		for _, agentID := range viper.GetIntSlice("agentIDs") {
+			agentToken.AgentIds = append(agentToken.AgentIds, int64(agentID))
+		}
+		agentToken.MaxAgentIds = viper.GetInt32("maxAgentIDs")
+		agentToken.MaxConnections = viper.GetInt32("maxConnections")
+		if bindCert := viper.GetString("bindCert"); bindCert != "" {
+			fingerprint, err := tlsutil.LoadCertFingerprint(bindCert)
+			if err != nil {
+				logrus.WithError(err).Fatal("Failed to load the certificate to bind")
+			}
+			agentToken.CertFingerprint = fingerprint
+		}
+
+		if viper.GetBool("signed") {
+			signingKey, err := token.NewSigningKey()
+			if err != nil {
+				logrus.WithError(err).Fatal("Failed to generate the signing key")
+			}
+			agentToken.SigningKey = signingKey
+		}
 
 		tokenMgr := token.NewTokenManager([]byte(secret))
 		data, err := tokenMgr.Encrypt(&agentToken)
@@ -64,7 +92,14 @@ var registerCmd = &cobra.Command{
 			return
 		}
 
-		fmt.Println(string(data))
+		if ledger := viper.GetString("ledger"); ledger != "" {
+			if err := token.AppendLedger(ledger, &agentToken); err != nil {
+				logrus.WithError(err).Fatal("Failed to record the agent token in the ledger")
+			}
+		}
+
+		// The signing key is appended to the token, and never leaves the agent.
+		fmt.Println(token.JoinCredential(data, agentToken.SigningKey))
 	},
 }
 
@@ -73,7 +108,14 @@ func init() {
 
 	registerCmd.PersistentFlags().String("name", "", "The agent name")
 	registerCmd.PersistentFlags().Duration("age", 0, "When specified, the token will be expired after the specified age. format like '1h2m3s'")
+	registerCmd.PersistentFlags().Duration("renewUntil", 0, "When specified, the hub renews the token before it expires, until the specified max lifetime. format like '720h'")
 	registerCmd.PersistentFlags().StringSlice("scopePaths", []string{}, "When specified, the agent accepts only the scoped paths")
 	registerCmd.PersistentFlags().StringSlice("scopes", []string{}, "When the application specified a scope to invoke, only the agent with the scopes can be accepted.")
+	registerCmd.PersistentFlags().IntSlice("agentIDs", []int{}, "When specified, the agent can only connect with these agent IDs")
+	registerCmd.PersistentFlags().Int32("maxAgentIDs", 0, "When specified, limits the number of distinct agent IDs connected with the token at the same time")
+	registerCmd.PersistentFlags().Int32("maxConnections", 0, "When specified, limits the number of connections with the token at the same time")
+	registerCmd.PersistentFlags().Bool("signed", false, "When specified, the agent signs every request with a per-agent key, so that a sniffed request can't be replayed")
+	registerCmd.PersistentFlags().String("bindCert", "", "When specified, the token is bound to the TLS client certificate file, and is only accepted with the certificate. Requires the hub to serve TLS itself, see the tlsCert flag of 'slime hub run'")
+	registerCmd.PersistentFlags().String("ledger", "", "When specified, the issued token is recorded in the ledger file, to be listed by 'slime hub token list'")
 	viper.BindPFlags(registerCmd.PersistentFlags())
 }
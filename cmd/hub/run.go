@@ -16,10 +16,17 @@ limitations under the License.
 package hub
 
 import (
+	"crypto/tls"
 	"fmt"
+	"net"
 	"net/http"
+	"os"
+	"strconv"
+	"time"
 
 	"github.com/hoveychen/slime/pkg/hub"
+	"github.com/hoveychen/slime/pkg/tlsutil"
+	"github.com/hoveychen/slime/pkg/tracing"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -43,28 +50,203 @@ var runCmd = &cobra.Command{
 		if concurrent := viper.GetInt("concurrent"); concurrent > 0 {
 			opts = append(opts, hub.WithConcurrent(concurrent))
 		}
+		var scopeTimeouts map[string]time.Duration
+		if err := viper.UnmarshalKey("scopeTimeouts", &scopeTimeouts); err != nil {
+			logrus.WithError(err).Fatal("Invalid scope timeouts")
+		}
+		opts = append(opts,
+			hub.WithTimeout(viper.GetDuration("timeout")),
+			hub.WithScopeTimeouts(scopeTimeouts),
+			hub.WithMaxTimeout(viper.GetDuration("maxTimeout")),
+			hub.WithJSONErrors(viper.GetBool("jsonErrors")))
+		if queueTimeout := viper.GetDuration("queueTimeout"); queueTimeout > 0 {
+			opts = append(opts, hub.WithQueueTimeout(queueTimeout))
+		}
+		if maxQueue := viper.GetInt("maxQueue"); maxQueue > 0 {
+			opts = append(opts, hub.WithMaxQueue(maxQueue))
+		}
 		if appPassword := viper.GetString("appPassword"); appPassword != "" {
 			opts = append(opts, hub.WithAppPassword(appPassword))
 		}
+		if adminPassword := viper.GetString("adminPassword"); adminPassword != "" {
+			opts = append(opts, hub.WithAdminPassword(adminPassword))
+		}
+		if replayWindow := viper.GetDuration("replayWindow"); replayWindow > 0 {
+			opts = append(opts, hub.WithReplayWindow(replayWindow))
+		}
+		if renewWindow := viper.GetDuration("renewWindow"); renewWindow > 0 {
+			opts = append(opts, hub.WithRenewWindow(renewWindow))
+		}
+		if sessionTTL := viper.GetDuration("sessionTTL"); sessionTTL > 0 {
+			opts = append(opts, hub.WithSessionTTL(sessionTTL))
+		}
+		if accessLog := viper.GetString("accessLog"); accessLog != "" {
+			format, err := hub.ParseAccessLogFormat(viper.GetString("accessLogFormat"))
+			if err != nil {
+				logrus.WithError(err).Fatal("Invalid access log format")
+			}
+			w := os.Stdout
+			if accessLog != "-" {
+				w, err = os.OpenFile(accessLog, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+				if err != nil {
+					logrus.WithError(err).Fatal("Failed to open the access log")
+				}
+				defer w.Close()
+			}
+			opts = append(opts, hub.WithAccessLog(w, format))
+		}
+		forwardedHeaders, err := hub.ParseForwardedHeadersMode(viper.GetString("forwardedHeaders"))
+		if err != nil {
+			logrus.WithError(err).Fatal("Invalid forwarded headers mode")
+		}
+		opts = append(opts, hub.WithStripHeaders(viper.GetBool("stripHeaders")), hub.WithForwardedHeaders(forwardedHeaders))
+		if endpoint := viper.GetString("otlpEndpoint"); endpoint != "" {
+			tracer := tracing.NewTracer("slime-hub", endpoint)
+			go tracer.Run(cmd.Context())
+			opts = append(opts, hub.WithTracer(tracer))
+		}
+		var rateLimits []hub.RateLimit
+		if err := viper.UnmarshalKey("rateLimits", &rateLimits); err != nil {
+			logrus.WithError(err).Fatal("Invalid rate limits")
+		}
+		for _, limit := range rateLimits {
+			if err := limit.Validate(); err != nil {
+				logrus.WithError(err).Fatal("Invalid rate limits")
+			}
+		}
+		if len(rateLimits) > 0 {
+			opts = append(opts, hub.WithRateLimits(rateLimits...))
+		}
+		tlsCert := viper.GetString("tlsCert")
+		tlsKey := viper.GetString("tlsKey")
+		if (viper.GetBool("requireClientCert") || viper.GetString("clientCA") != "") && (tlsCert == "" || tlsKey == "") {
+			logrus.Fatal("tlsCert and tlsKey are required to verify the client certificates")
+		}
+		if viper.GetBool("requireClientCert") {
+			if viper.GetString("clientCA") == "" {
+				logrus.Fatal("clientCA is required to verify the client certificates")
+			}
+			opts = append(opts, hub.WithRequireClientCert(true))
+		}
 
 		hub := hub.NewHubServer(secret, opts...)
 
 		addr := fmt.Sprintf("%s:%d", host, port)
-		logrus.WithField("addr", addr).Info("Starting hub server")
-		err := http.ListenAndServe(addr, hub)
+		server := &http.Server{Addr: addr, Handler: hub}
+		socketMode, err := strconv.ParseUint(viper.GetString("unixMode"), 8, 32)
+		if err != nil {
+			logrus.WithError(err).Fatal("Invalid unix socket mode")
+		}
+		listener, err := listen(addr, viper.GetString("unix"), os.FileMode(socketMode))
 		if err != nil {
+			logrus.WithError(err).Fatal("Failed to listen")
+		}
+		defer listener.Close()
+
+		if tlsCert == "" && tlsKey == "" {
+			logrus.WithField("addr", listener.Addr()).Info("Starting hub server")
+			if err := server.Serve(listener); err != nil {
+				logrus.WithError(err).Error("Hub server terminated")
+			}
+			return
+		}
+
+		reloader, err := tlsutil.NewCertReloader(tlsCert, tlsKey)
+		if err != nil {
+			logrus.WithError(err).Fatal("Failed to load TLS certificate")
+		}
+		go reloader.Watch(cmd.Context(), certReloadInterval)
+
+		tlsConfig, err := newTLSConfig(reloader, viper.GetString("clientCA"))
+		if err != nil {
+			logrus.WithError(err).Fatal("Failed to load TLS configuration")
+		}
+		server.TLSConfig = tlsConfig
+		if !viper.GetBool("http2") {
+			// The server negotiates "h2" with the clients on its own, unless its upgrade handlers are emptied.
+			server.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+		}
+		logrus.WithFields(logrus.Fields{
+			"addr":  listener.Addr(),
+			"http2": viper.GetBool("http2"),
+		}).Info("Starting hub server with TLS")
+		if err := server.ServeTLS(listener, "", ""); err != nil {
 			logrus.WithError(err).Error("Hub server terminated")
 		}
 	},
 }
 
+// listen listens on the unix domain socket with the mode if given, otherwise on the TCP address.
+func listen(addr, socket string, mode os.FileMode) (net.Listener, error) {
+	if socket == "" {
+		return net.Listen("tcp", addr)
+	}
+	// Remove the socket left by the previous run.
+	if fi, err := os.Stat(socket); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(socket); err != nil {
+			return nil, err
+		}
+	}
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		return nil, err
+	}
+	// The socket is created following the umask, which may leave it open to everyone.
+	if err := os.Chmod(socket, mode); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// certReloadInterval is how often the TLS certificate files are checked for changes.
+const certReloadInterval = 10 * time.Second
+
+func newTLSConfig(reloader *tlsutil.CertReloader, clientCAFile string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		GetCertificate: reloader.GetCertificate,
+		// Ask for the client certificate, so that the tokens bound to a certificate can be verified.
+		// The applications are not required to present any.
+		ClientAuth: tls.RequestClientCert,
+	}
+	if clientCAFile != "" {
+		pool, err := tlsutil.LoadCertPool(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return tlsConfig, nil
+}
+
 func init() {
 	HubCmd.AddCommand(runCmd)
 
 	// Here you will define your flags and configuration settings.
 	runCmd.PersistentFlags().String("appPassword", "", "The password for the application to connect to the hub")
+	runCmd.PersistentFlags().String("adminPassword", "", "The password of the admin API and the dashboard, e.g. to approve the agent enrollments. The admin API is disabled when empty")
 	runCmd.PersistentFlags().Int("port", 8080, "Port to listen on")
 	runCmd.PersistentFlags().String("host", "0.0.0.0", "Host to listen on")
 	runCmd.PersistentFlags().Int("concurrent", 0, "The number of concurrent requests from the applications")
+	runCmd.PersistentFlags().Duration("timeout", 0, "The default timeout of the application requests, answered with 504 when exceeded. Overridden by the scopeTimeouts in the config file. 0 for no timeout")
+	runCmd.PersistentFlags().Duration("maxTimeout", 0, "The max timeout the applications can request with the Slime-Timeout header. 0 to only allow shortening the timeout")
+	runCmd.PersistentFlags().Bool("jsonErrors", false, "Reply the errors made by slime, e.g. no available agent, with a JSON body carrying the error code, instead of a plain text one")
+	runCmd.PersistentFlags().Duration("queueTimeout", 0, "How long a request waits for a concurrent slot before rejected with 503. 0 to wait until the application cancels")
+	runCmd.PersistentFlags().Int("maxQueue", 0, "The number of requests waiting for a concurrent slot. The others are rejected with 503 right away. 0 for no limit")
+	runCmd.PersistentFlags().String("accessLog", "", "The file to write an access log entry per application request to. '-' for stdout. Disabled when empty")
+	runCmd.PersistentFlags().String("accessLogFormat", "json", "The access log format: json, or clf (Common Log Format followed by the slime fields)")
+	runCmd.PersistentFlags().String("unix", "", "Listen on the unix domain socket instead of the host and port")
+	runCmd.PersistentFlags().String("unixMode", "0660", "The file mode of the unix domain socket, in octal")
+	runCmd.PersistentFlags().Bool("stripHeaders", true, "Strip the hop-by-hop headers and the slime control headers, e.g. the app password, from the forwarded requests and responses")
+	runCmd.PersistentFlags().String("forwardedHeaders", "append", "How to set the X-Forwarded-For/Proto/Host headers: append (to the ones set by the proxies in front of the hub), replace (discard the ones given by the clients), or off")
+	runCmd.PersistentFlags().Duration("replayWindow", 5*time.Minute, "How far the timestamps of the signed agent requests may drift. Replayed requests are rejected within the window")
+	runCmd.PersistentFlags().Duration("renewWindow", 0, "How long before the expiry the renewable agent tokens are renewed. 0 for the last third of their lifetime")
+	runCmd.PersistentFlags().Duration("sessionTTL", 0, "Issue short-lived session credentials valid for the duration on join, instead of accepting the agent token on every request. 0 to disable")
+	runCmd.PersistentFlags().String("tlsCert", "", "The TLS certificate file to serve HTTPS. Reloaded automatically when changed on disk")
+	runCmd.PersistentFlags().String("tlsKey", "", "The TLS private key file to serve HTTPS. Reloaded automatically when changed on disk")
+	runCmd.PersistentFlags().Bool("http2", false, "Enable HTTP/2 when serving HTTPS")
+	runCmd.PersistentFlags().String("clientCA", "", "The CA certificate file to verify the agents' client certificates")
+	runCmd.PersistentFlags().Bool("requireClientCert", false, "Require the agents to present a client certificate verified by the client CA")
 	viper.BindPFlags(runCmd.PersistentFlags())
 }
@@ -0,0 +1,53 @@
+/*
+Copyright © 2023 Harry C <hoveychen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package hub
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/hoveychen/slime/pkg/hub"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// sessionCmd represents the session command
+var sessionCmd = &cobra.Command{
+	Use:              "session [command] [options]",
+	Short:            "Manage the session credentials issued to the agents",
+	Long:             `With --sessionTTL, the hub exchanges the agent tokens for short-lived session credentials on join.`,
+	PersistentPreRun: bindRunningFlags,
+}
+
+var sessionRevokeCmd = &cobra.Command{
+	Use:   "revoke --hub <hub_address> --adminPassword <password>",
+	Short: "Revoke all the issued sessions, so that the agents have to join again with their agent tokens",
+	Run: func(cmd *cobra.Command, args []string) {
+		var revocation hub.SessionRevocation
+		if err := adminRequest("POST", hub.PathAdminRevoke, nil, &revocation); err != nil {
+			logrus.WithError(err).Fatal("Failed to revoke the sessions")
+		}
+		fmt.Printf("Sessions revoked at %s\n", revocation.RevokedAt.Format(time.RFC3339))
+	},
+}
+
+func init() {
+	HubCmd.AddCommand(sessionCmd)
+	sessionCmd.AddCommand(sessionRevokeCmd)
+
+	sessionRevokeCmd.Flags().String("hub", "", "The hub address")
+	sessionRevokeCmd.Flags().String("adminPassword", "", "The admin password of the hub")
+}
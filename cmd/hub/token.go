@@ -0,0 +1,103 @@
+/*
+Copyright © 2023 Harry C <hoveychen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package hub
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/hoveychen/slime/pkg/token"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// tokenCmd represents the token command
+var tokenCmd = &cobra.Command{
+	Use:   "token [command] [options]",
+	Short: "Inspect the issued agent tokens",
+	PersistentPreRun: bindRunningFlags,
+}
+
+var tokenInspectCmd = &cobra.Command{
+	Use:   "inspect <token> --secret <secret>",
+	Short: "Decrypt the agent token, and print its fields as JSON",
+	Long:  `The token may include the signing key, which is never printed.`,
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		secret := viper.GetString("secret")
+		if secret == "" {
+			logrus.Fatal("The secret is required")
+		}
+		encryptedToken, _, err := token.SplitCredential(strings.TrimSpace(args[0]))
+		if err != nil {
+			logrus.WithError(err).Fatal("Invalid token")
+		}
+		tok, err := token.NewTokenManager([]byte(secret)).Decrypt(encryptedToken)
+		if err != nil {
+			logrus.WithError(err).Fatal("Failed to decrypt the token. Is the secret right?")
+		}
+
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(token.Describe(tok))
+	},
+}
+
+var tokenListCmd = &cobra.Command{
+	Use:   "list --ledger <ledger file>",
+	Short: "List the agent tokens recorded in the ledger by register",
+	Run: func(cmd *cobra.Command, args []string) {
+		ledger := viper.GetString("ledger")
+		if ledger == "" {
+			logrus.Fatal("The ledger is required")
+		}
+		infos, err := token.ReadLedger(ledger)
+		if err != nil {
+			logrus.WithError(err).Fatal("Failed to read the ledger")
+		}
+
+		now := time.Now()
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tNAME\tSCOPES\tSCOPE PATHS\tISSUED AT\tEXPIRE AT\tSTATUS")
+		for _, info := range infos {
+			issuedAt, expireAt, status := "-", "never", "active"
+			if info.IssuedAt != nil {
+				issuedAt = info.IssuedAt.Format(time.RFC3339)
+			}
+			if info.ExpireAt != nil {
+				expireAt = info.ExpireAt.Format(time.RFC3339)
+			}
+			if info.Expired(now) {
+				status = "expired"
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\t%s\n", info.ID, info.Name,
+				strings.Join(info.Scopes, ","), strings.Join(info.ScopePaths, ","), issuedAt, expireAt, status)
+		}
+		w.Flush()
+	},
+}
+
+func init() {
+	HubCmd.AddCommand(tokenCmd)
+	tokenCmd.AddCommand(tokenInspectCmd, tokenListCmd)
+
+	tokenListCmd.Flags().String("ledger", "", "The ledger file written by register")
+}
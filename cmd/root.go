@@ -76,6 +76,9 @@ func init() {
 	// will be global for your application.
 
 	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.slime.yaml)")
+	// Shared by the hub and the agent, so it's bound once here.
+	rootCmd.PersistentFlags().String("otlpEndpoint", "", "The OTLP/HTTP endpoint of an OpenTelemetry collector to export the request spans to, e.g. http://localhost:4318. Disabled when empty")
+	viper.BindPFlag("otlpEndpoint", rootCmd.PersistentFlags().Lookup("otlpEndpoint"))
 
 	// Cobra also supports local flags, which will only run
 	// when this action is called directly.
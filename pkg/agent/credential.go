@@ -0,0 +1,100 @@
+/*
+Copyright © 2023 Harry C <hoveychen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/hoveychen/slime/pkg/token"
+	"github.com/sirupsen/logrus"
+)
+
+var agentTokenFile = "agentToken.txt"
+
+// savedCredential is the credential saved next to the agent ID, e.g. the token issued on enrollment or renewed by the hub.
+type savedCredential struct {
+	// Origin is the credential the agent was configured with, e.g. the token or the enrollment code.
+	Origin string
+	// Current is the credential to use instead.
+	Current string
+}
+
+// loadCredential returns the saved credential, or nil if there is none.
+func loadCredential() (*savedCredential, error) {
+	data, err := os.ReadFile(agentTokenFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read agent token from file: %v", err)
+	}
+	var saved savedCredential
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return nil, fmt.Errorf("invalid agent token in file: %v", err)
+	}
+	return &saved, nil
+}
+
+func saveCredential(origin, current string) error {
+	data, err := json.Marshal(&savedCredential{Origin: origin, Current: current})
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(agentTokenFile, data, 0600); err != nil {
+		return fmt.Errorf("failed to write agent token to file: %v", err)
+	}
+	return nil
+}
+
+// resolveCredential returns the credential to use in place of the configured one, and the origin to save the
+// renewed credentials with. The saved credential is only used if it derives from the configured one.
+func resolveCredential(credential string) (string, string) {
+	saved, err := loadCredential()
+	if err != nil {
+		logrus.WithError(err).Warn("Ignored the saved agent token")
+		return credential, credential
+	}
+	if saved != nil && (saved.Origin == credential || saved.Current == credential) {
+		return saved.Current, saved.Origin
+	}
+	return credential, credential
+}
+
+func (as *AgentServer) getToken() string {
+	as.tokenLock.Lock()
+	defer as.tokenLock.Unlock()
+	return as.token
+}
+
+// renewToken switches to the token renewed by the hub, and saves it for the later runs.
+func (as *AgentServer) renewToken(renewed string) {
+	as.tokenLock.Lock()
+	defer as.tokenLock.Unlock()
+	if as.token == renewed {
+		return
+	}
+	as.token = renewed
+	logrus.Info("Agent token renewed")
+
+	if as.credentialOrigin == "" {
+		return
+	}
+	if err := saveCredential(as.credentialOrigin, token.JoinCredential(renewed, as.signingKey)); err != nil {
+		logrus.WithError(err).Error("Failed to save the renewed agent token")
+	}
+}
@@ -0,0 +1,81 @@
+/*
+Copyright © 2023 Harry C <hoveychen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package agent
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+
+	"github.com/hoveychen/slime/pkg/hub"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolveCredential(t *testing.T) {
+	oldTokenFile := agentTokenFile
+	agentTokenFile = filepath.Join(t.TempDir(), "agentToken.txt")
+	defer func() { agentTokenFile = oldTokenFile }()
+
+	// Test case 1: nothing saved
+	credential, origin := resolveCredential("original")
+	assert.Equal(t, "original", credential)
+	assert.Equal(t, "original", origin)
+
+	// Test case 2: the renewed token supersedes the original one
+	assert.NoError(t, saveCredential("original", "renewed"))
+	credential, origin = resolveCredential("original")
+	assert.Equal(t, "renewed", credential)
+	assert.Equal(t, "original", origin)
+	credential, origin = resolveCredential("renewed")
+	assert.Equal(t, "renewed", credential)
+	assert.Equal(t, "original", origin)
+
+	// Test case 3: another token is configured
+	credential, origin = resolveCredential("another")
+	assert.Equal(t, "another", credential)
+	assert.Equal(t, "another", origin)
+}
+
+func TestRenewToken(t *testing.T) {
+	oldTokenFile := agentTokenFile
+	agentTokenFile = filepath.Join(t.TempDir(), "agentToken.txt")
+	defer func() { agentTokenFile = oldTokenFile }()
+
+	var gotTokens []string
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotTokens = append(gotTokens, r.Header.Get("slime-agent-token"))
+		w.Header().Set("slime-renewed-token", "renewed")
+	}))
+	defer mockServer.Close()
+
+	as := &AgentServer{token: "original", signingKey: []byte("key"), credentialOrigin: "original.KEY"}
+	as.hubURL, _ = url.Parse(mockServer.URL)
+
+	assert.NoError(t, as.joinHub(context.Background(), 123))
+	_, err := as.postHubJSON(context.Background(), 123, hub.PathReport, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"original", "renewed"}, gotTokens)
+
+	// The renewed token is saved with the signing key.
+	saved, err := loadCredential()
+	if assert.NoError(t, err) && assert.NotNil(t, saved) {
+		assert.Equal(t, "original.KEY", saved.Origin)
+		assert.Equal(t, "renewed.NNSXS", saved.Current)
+	}
+}
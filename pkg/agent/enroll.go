@@ -0,0 +1,201 @@
+/*
+Copyright © 2023 Harry C <hoveychen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package agent
+
+import (
+	"bytes"
+	"context"
+	cryptorand "crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/hoveychen/slime/pkg/hub"
+	"github.com/hoveychen/slime/pkg/hwinfo"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	ErrEnrollmentRejected = errors.New("enrollment rejected by the hub admin")
+
+	enrollmentIDFile   = "enrollmentID.txt"
+	enrollPollInterval = 10 * time.Second
+	// The failing polls are retried with a backoff, doubled on every consecutive failure.
+	maxEnrollBackoff = 5 * time.Minute
+)
+
+// enrollStatusError is an unexpected status replied by the hub to the enrollment.
+type enrollStatusError struct {
+	statusCode int
+	status     string
+}
+
+func (e *enrollStatusError) Error() string {
+	return e.status
+}
+
+// isTransientEnrollError tells whether the enrollment can be retried, e.g. the hub restarting or a network blip.
+// The client errors, e.g. an invalid or used enrollment code, are permanent.
+func isTransientEnrollError(err error) bool {
+	var statusErr *enrollStatusError
+	if !errors.As(err, &statusErr) {
+		return true
+	}
+	switch statusErr.statusCode {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests:
+		return true
+	}
+	return statusErr.statusCode >= 500
+}
+
+// Enroll exchanges the one-time enrollment code for an agent token, waiting until the hub admin approves it.
+// The issued token is saved locally, and returned right away on the later runs with the same code.
+// The transient errors are retried with a backoff, until the enrollment is rejected or the context is done.
+func Enroll(ctx context.Context, hubAddr, code string, opts ...AgentServerOption) (string, error) {
+	saved, err := loadCredential()
+	if err != nil {
+		return "", err
+	}
+	if saved != nil && saved.Origin == code {
+		return saved.Current, nil
+	}
+
+	hubURL, err := parseAddr(hubAddr)
+	if err != nil {
+		return "", err
+	}
+	as := &AgentServer{
+		hubURL:   hubURL,
+		reportHW: true,
+		hwPolicy: hwinfo.ReportHashed,
+	}
+	for _, opt := range opts {
+		opt(as)
+	}
+	as.collectHWInfo()
+
+	// The enrollment ID survives restarts, so that the agent can keep polling its enrollment.
+	enrollmentID, err := getOrCreateEnrollmentID()
+	if err != nil {
+		return "", err
+	}
+	name, _ := os.Hostname()
+	enrollReq := &hub.EnrollRequest{
+		ID:           enrollmentID,
+		Name:         name,
+		HardwareInfo: as.hwInfo,
+	}
+
+	waiting := false
+	backoffDuration := enrollPollInterval
+	for {
+		resp, err := as.postEnrollRequest(ctx, code, enrollReq)
+		if err != nil {
+			if ctx.Err() != nil {
+				return "", ctx.Err()
+			}
+			if !isTransientEnrollError(err) {
+				return "", err
+			}
+			logrus.WithError(err).Warnf("Enrolling... Retry in %s", backoffDuration)
+			select {
+			case <-ctx.Done():
+				return "", ctx.Err()
+			case <-time.After(backoffDuration):
+			}
+			backoffDuration *= 2
+			if backoffDuration > maxEnrollBackoff {
+				backoffDuration = maxEnrollBackoff
+			}
+			continue
+		}
+		backoffDuration = enrollPollInterval
+
+		switch resp.Status {
+		case hub.EnrollmentApproved:
+			if err := saveCredential(code, resp.Token); err != nil {
+				return "", err
+			}
+			os.Remove(enrollmentIDFile)
+			logrus.Info("Enrollment approved")
+			return resp.Token, nil
+		case hub.EnrollmentRejected:
+			os.Remove(enrollmentIDFile)
+			return "", ErrEnrollmentRejected
+		}
+
+		if !waiting {
+			logrus.WithField("name", name).Info("Waiting for the hub admin to approve the enrollment...")
+			waiting = true
+		}
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(enrollPollInterval):
+		}
+	}
+}
+
+func (as *AgentServer) postEnrollRequest(ctx context.Context, code string, enrollReq *hub.EnrollRequest) (*hub.EnrollResponse, error) {
+	body, err := json.Marshal(enrollReq)
+	if err != nil {
+		return nil, err
+	}
+	u := *as.hubURL
+	u.Path = path.Join(u.Path, hub.PathEnroll)
+	req, err := http.NewRequestWithContext(ctx, "POST", u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("slime-enrollment-code", code)
+	resp, err := as.hubHTTPClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusAccepted, http.StatusForbidden:
+	default:
+		return nil, &enrollStatusError{statusCode: resp.StatusCode, status: resp.Status}
+	}
+	var enrollResp hub.EnrollResponse
+	if err := json.NewDecoder(resp.Body).Decode(&enrollResp); err != nil {
+		return nil, err
+	}
+	return &enrollResp, nil
+}
+
+func getOrCreateEnrollmentID() (string, error) {
+	if data, err := os.ReadFile(enrollmentIDFile); err == nil {
+		return strings.TrimSpace(string(data)), nil
+	}
+	id := make([]byte, 16)
+	if _, err := cryptorand.Read(id); err != nil {
+		return "", err
+	}
+	enrollmentID := hex.EncodeToString(id)
+	if err := os.WriteFile(enrollmentIDFile, []byte(enrollmentID), 0600); err != nil {
+		return "", fmt.Errorf("failed to write enrollment ID to file: %v", err)
+	}
+	return enrollmentID, nil
+}
@@ -0,0 +1,146 @@
+/*
+Copyright © 2023 Harry C <hoveychen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package agent
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hoveychen/slime/pkg/hub"
+	"github.com/hoveychen/slime/pkg/token"
+	"github.com/stretchr/testify/assert"
+)
+
+func setupEnrollFiles(t *testing.T) {
+	dir := t.TempDir()
+	oldTokenFile, oldIDFile, oldInterval := agentTokenFile, enrollmentIDFile, enrollPollInterval
+	agentTokenFile = filepath.Join(dir, "agentToken.txt")
+	enrollmentIDFile = filepath.Join(dir, "enrollmentID.txt")
+	enrollPollInterval = 10 * time.Millisecond
+	t.Cleanup(func() {
+		agentTokenFile, enrollmentIDFile, enrollPollInterval = oldTokenFile, oldIDFile, oldInterval
+	})
+}
+
+func TestEnroll(t *testing.T) {
+	setupEnrollFiles(t)
+	hs := hub.NewHubServer("test-secret")
+	mockServer := httptest.NewServer(hs)
+	defer mockServer.Close()
+
+	tokenMgr := token.NewTokenManager([]byte("test-secret"))
+	code, _ := tokenMgr.Encrypt(&token.AgentToken{Id: 1, Scopes: []string{"llm"}, Enrollment: true})
+
+	go func() {
+		// Approve once the agent shows up.
+		for len(hs.Enrollments()) == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		hs.ApproveEnrollment(1)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	agentToken, err := Enroll(ctx, mockServer.URL, code, WithReportHardware(false))
+	assert.NoError(t, err)
+	tok, err := tokenMgr.Decrypt(agentToken)
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"llm"}, tok.Scopes)
+	}
+
+	// The token is saved, and the enrollment ID is cleaned up.
+	saved, err := loadCredential()
+	if assert.NoError(t, err) && assert.NotNil(t, saved) {
+		assert.Equal(t, code, saved.Origin)
+		assert.Equal(t, agentToken, saved.Current)
+	}
+	_, err = os.Stat(enrollmentIDFile)
+	assert.True(t, os.IsNotExist(err))
+
+	// The saved token is reused without the hub.
+	reused, err := Enroll(ctx, "localhost:1", code)
+	assert.NoError(t, err)
+	assert.Equal(t, agentToken, reused)
+}
+
+func TestEnrollRejected(t *testing.T) {
+	setupEnrollFiles(t)
+	hs := hub.NewHubServer("test-secret")
+	mockServer := httptest.NewServer(hs)
+	defer mockServer.Close()
+
+	tokenMgr := token.NewTokenManager([]byte("test-secret"))
+	code, _ := tokenMgr.Encrypt(&token.AgentToken{Id: 1, Enrollment: true})
+
+	go func() {
+		for len(hs.Enrollments()) == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		hs.RejectEnrollment(1)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := Enroll(ctx, mockServer.URL, code, WithReportHardware(false))
+	assert.ErrorIs(t, err, ErrEnrollmentRejected)
+}
+
+func TestEnrollRetriesTransientErrors(t *testing.T) {
+	setupEnrollFiles(t)
+	hs := hub.NewHubServer("test-secret")
+	var failures atomic.Int32
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The hub is restarting for the first polls.
+		if failures.Add(1) <= 3 {
+			http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		hs.ServeHTTP(w, r)
+	}))
+	defer mockServer.Close()
+
+	tokenMgr := token.NewTokenManager([]byte("test-secret"))
+	code, _ := tokenMgr.Encrypt(&token.AgentToken{Id: 1, Enrollment: true})
+
+	go func() {
+		for len(hs.Enrollments()) == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		hs.ApproveEnrollment(1)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	agentToken, err := Enroll(ctx, mockServer.URL, code, WithReportHardware(false))
+	assert.NoError(t, err)
+	assert.NotEmpty(t, agentToken)
+	assert.Greater(t, failures.Load(), int32(3))
+}
+
+func TestEnrollInvalidCode(t *testing.T) {
+	setupEnrollFiles(t)
+	mockServer := httptest.NewServer(hub.NewHubServer("test-secret"))
+	defer mockServer.Close()
+
+	_, err := Enroll(context.Background(), mockServer.URL, "invalid", WithReportHardware(false))
+	assert.Error(t, err)
+}
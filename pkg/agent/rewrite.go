@@ -0,0 +1,134 @@
+/*
+Copyright © 2023 Harry C <hoveychen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/hoveychen/slime/pkg/hub"
+)
+
+// HeaderRules rewrites the headers. The headers are removed first, then set, then added.
+type HeaderRules struct {
+	Set    map[string]string
+	Add    map[string]string
+	Remove []string
+}
+
+func (hr *HeaderRules) apply(h http.Header) {
+	for _, name := range hr.Remove {
+		h.Del(name)
+	}
+	for name, value := range hr.Set {
+		h.Set(name, value)
+	}
+	for name, value := range hr.Add {
+		h.Add(name, value)
+	}
+}
+
+// RewriteRules are the rewrites of the requests to the upstream and their responses, applied on the agent,
+// e.g. to inject the upstream API key which never leaves the agent machine.
+type RewriteRules struct {
+	RequestHeaders  HeaderRules
+	ResponseHeaders HeaderRules
+	// StripPrefix is stripped from the request path, and replaced with the AddPrefix.
+	// The requests out of the StripPrefix are not rewritten.
+	StripPrefix string
+	AddPrefix   string
+}
+
+// Validate checks the rules are well-formed.
+func (rr *RewriteRules) Validate() error {
+	for _, prefix := range []string{rr.StripPrefix, rr.AddPrefix} {
+		if prefix != "" && !strings.HasPrefix(prefix, "/") {
+			return fmt.Errorf("path prefix %q must start with /", prefix)
+		}
+	}
+	return nil
+}
+
+// rewritePath returns the rewritten escaped path, and whether it's rewritten.
+func (rr *RewriteRules) rewritePath(escapedPath string) (string, bool) {
+	if rr.StripPrefix == "" && rr.AddPrefix == "" {
+		return escapedPath, false
+	}
+	if rr.StripPrefix != "" {
+		rest, ok := hub.TrimPathPrefix(escapedPath, escapePath(rr.StripPrefix))
+		if !ok {
+			return escapedPath, false
+		}
+		escapedPath = rest
+	}
+	return joinPath(escapePath(rr.AddPrefix), escapedPath), true
+}
+
+func (rr *RewriteRules) applyRequest(r *http.Request) {
+	rr.RequestHeaders.apply(r.Header)
+	// The escaped path is rewritten, so that an escaped "/" in the request path is kept.
+	if escaped, ok := rr.rewritePath(r.URL.EscapedPath()); ok {
+		if path, err := url.PathUnescape(escaped); err == nil {
+			r.URL.Path = path
+			r.URL.RawPath = escaped
+		}
+	}
+}
+
+// escapePath escapes the path as in the URLs.
+func escapePath(path string) string {
+	return (&url.URL{Path: path}).EscapedPath()
+}
+
+func (rr *RewriteRules) applyResponse(resp *http.Response) {
+	rr.ResponseHeaders.apply(resp.Header)
+}
+
+// joinPath joins the base path and the request path with a single slash, keeping the trailing slash of the
+// request path.
+func joinPath(base, path string) string {
+	base = strings.TrimSuffix(base, "/")
+	if path == "" {
+		if base == "" {
+			return "/"
+		}
+		return base
+	}
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return base + path
+}
+
+// WithRewriteRules rewrites the requests to the upstream and their responses.
+func WithRewriteRules(rules *RewriteRules) AgentServerOption {
+	return func(as *AgentServer) {
+		as.rewrite = rules
+	}
+}
+
+// ParseHeader parses the header in the form of "Name: value".
+func ParseHeader(s string) (string, string, error) {
+	name, value, found := strings.Cut(s, ":")
+	name = strings.TrimSpace(name)
+	if !found || name == "" {
+		return "", "", errors.New("invalid header, expect \"Name: value\"")
+	}
+	return name, strings.TrimSpace(value), nil
+}
@@ -0,0 +1,134 @@
+/*
+Copyright © 2023 Harry C <hoveychen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package agent
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRewriteRulesRequest(t *testing.T) {
+	upstreamURL := &url.URL{Scheme: "http", Host: "localhost:8081"}
+	as := &AgentServer{
+		rewrite: &RewriteRules{
+			RequestHeaders: HeaderRules{
+				Set:    map[string]string{"authorization": "Bearer upstream-key"},
+				Add:    map[string]string{"X-Agent": "slime"},
+				Remove: []string{"Cookie"},
+			},
+			StripPrefix: "/openai/",
+			AddPrefix:   "/v1",
+		},
+	}
+
+	req := httptest.NewRequest("POST", "http://hub/openai/chat/completions?stream=true", nil)
+	req.Header.Set("Authorization", "Bearer app-key")
+	req.Header.Set("Cookie", "session=1")
+	req.Header.Set("X-Agent", "app")
+	as.rewriteUpstreamRequest(req)
+	as.targetUpstream(req, upstreamURL)
+
+	assert.Equal(t, "http://localhost:8081/v1/chat/completions?stream=true", req.URL.String())
+	assert.Equal(t, "Bearer upstream-key", req.Header.Get("Authorization"))
+	assert.Empty(t, req.Header.Get("Cookie"))
+	assert.Equal(t, []string{"app", "slime"}, req.Header.Values("X-Agent"))
+
+	// Out of the prefix, the path is left as is.
+	req = httptest.NewRequest("POST", "http://hub/openaix/chat", nil)
+	as.rewriteUpstreamRequest(req)
+	assert.Equal(t, "/openaix/chat", req.URL.Path)
+
+	// The escaped "/" in the path is kept.
+	req = httptest.NewRequest("GET", "http://hub/openai/files/a%2Fb", nil)
+	as.rewriteUpstreamRequest(req)
+	as.targetUpstream(req, upstreamURL)
+	assert.Equal(t, "http://localhost:8081/v1/files/a%2Fb", req.URL.String())
+	assert.Equal(t, "/v1/files/a/b", req.URL.Path)
+
+	// The upstream receives the rewritten request.
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.RequestURI() + " " + r.Header.Get("Authorization")))
+	}))
+	defer upstream.Close()
+	u, _ := url.Parse(upstream.URL)
+	as.upstreams = newUpstreamPool(newUpstream(u, "", nil))
+	req = httptest.NewRequest("POST", "http://hub/openai/chat/completions", nil)
+	as.rewriteUpstreamRequest(req)
+	resp, err := as.invokeUpstream(context.Background(), req, logrus.NewEntry(logrus.StandardLogger()))
+	if assert.NoError(t, err) {
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		assert.Equal(t, "/v1/chat/completions Bearer upstream-key", string(body))
+	}
+}
+
+func TestRewriteRulesResponse(t *testing.T) {
+	rules := &RewriteRules{
+		ResponseHeaders: HeaderRules{
+			Set:    map[string]string{"Cache-Control": "no-store"},
+			Remove: []string{"Server"},
+		},
+	}
+	resp := &http.Response{Header: http.Header{"Server": {"uvicorn"}, "Cache-Control": {"max-age=60"}}}
+	rules.applyResponse(resp)
+	assert.Equal(t, http.Header{"Cache-Control": {"no-store"}}, resp.Header)
+}
+
+func TestRewritePath(t *testing.T) {
+	tests := []struct {
+		rules RewriteRules
+		path  string
+		want  string
+	}{
+		{RewriteRules{}, "/chat", "/chat"},
+		{RewriteRules{StripPrefix: "/api"}, "/api/chat", "/chat"},
+		{RewriteRules{StripPrefix: "/api"}, "/api", "/"},
+		{RewriteRules{StripPrefix: "/api"}, "/apis/chat", "/apis/chat"},
+		{RewriteRules{StripPrefix: "/api/"}, "/api/chat/", "/chat/"},
+		{RewriteRules{AddPrefix: "/v1/"}, "/chat", "/v1/chat"},
+		{RewriteRules{StripPrefix: "/api", AddPrefix: "/v1"}, "/api", "/v1"},
+		{RewriteRules{StripPrefix: "/api", AddPrefix: "/v1"}, "/api/a%2Fb", "/v1/a%2Fb"},
+		{RewriteRules{StripPrefix: "/my api", AddPrefix: "/v 1"}, "/my%20api/chat", "/v%201/chat"},
+	}
+	for _, tt := range tests {
+		got, _ := tt.rules.rewritePath(tt.path)
+		assert.Equal(t, tt.want, got, "%+v %s", tt.rules, tt.path)
+	}
+}
+
+func TestRewriteRulesValidate(t *testing.T) {
+	assert.NoError(t, (&RewriteRules{StripPrefix: "/api", AddPrefix: "/v1"}).Validate())
+	assert.Error(t, (&RewriteRules{StripPrefix: "api"}).Validate())
+}
+
+func TestParseHeader(t *testing.T) {
+	name, value, err := ParseHeader("Authorization: Bearer sk-1:2")
+	assert.NoError(t, err)
+	assert.Equal(t, "Authorization", name)
+	assert.Equal(t, "Bearer sk-1:2", value)
+
+	_, _, err = ParseHeader("Authorization")
+	assert.Error(t, err)
+	_, _, err = ParseHeader(": value")
+	assert.Error(t, err)
+}
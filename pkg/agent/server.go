@@ -19,6 +19,9 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	cryptorand "crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -31,40 +34,108 @@ import (
 	"path"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/hoveychen/slime/pkg/hub"
 	"github.com/hoveychen/slime/pkg/hwinfo"
+	"github.com/hoveychen/slime/pkg/token"
+	"github.com/hoveychen/slime/pkg/tracing"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/sync/errgroup"
 )
 
-const defaultNumWorker = 1
+const (
+	defaultNumWorker      = 1
+	defaultReportInterval = 30 * time.Second
+)
+
+var (
+	gpuCollectTimeout       = 5 * time.Second
+	newFallbackGPUCollector = hwinfo.NewSysfsCollector
+)
 
 // Agent server is responsible for:
 // 1. Maintain connections to hub
 // 2. Forward hub's request to the right upstream
 type AgentServer struct {
-	numWorker   int
-	reportHW    bool
-	token       string
-	upstreamURL *url.URL
-	hubURL      *url.URL
-	hwInfo      *hwinfo.HWInfo
-	agentID     int
+	numWorker  int
+	reportHW   bool
+	hwPolicy   hwinfo.ReportPolicy
+	token      string
+	signingKey []byte
+	upstreams  *upstreamPool
+	hubURL     *url.URL
+	hubClient  *http.Client
+	// The transports are configured by the options, and each agent server has its own clients.
+	hubTLSConfig      *tls.Config
+	hubTransport      *TransportConfig
+	upstreamTransport *TransportConfig
+	hwInfo            *hwinfo.HWInfo
+	agentID           int
+	// agentIDOffset separates the agent IDs of the agent servers sharing the same agent ID.
+	agentIDOffset int
+
+	gpuCollector   hwinfo.GPUCollector
+	reportInterval time.Duration
+
+	workerStats []workerStat
+	// upstreamFailures counts the consecutive requests failed on every upstream.
+	upstreamFailures atomic.Int32
+
+	sessions    map[int]*session
+	sessionLock sync.Mutex
+
+	tracer  *tracing.Tracer
+	rewrite *RewriteRules
+
+	// pathPrefix is advertised to the hub, to only receive the requests under it.
+	pathPrefix string
+
+	// credentialOrigin is the configured credential, to save the renewed tokens with.
+	credentialOrigin string
+	tokenLock        sync.Mutex
+}
+
+type workerStat struct {
+	// inFlight counts the requests accepted from the hub and not yet submitted.
+	inFlight atomic.Int32
 }
 
 type AgentServerOption func(as *AgentServer)
 
-func NewAgentServer(hubAddr, upstreamAddr, token string, opts ...AgentServerOption) (*AgentServer, error) {
-	hubURL, err := parseAddr(hubAddr)
+func NewAgentServer(hubAddr, upstreamAddr, credential string, opts ...AgentServerOption) (*AgentServer, error) {
+	return NewAgentServerPool(hubAddr, []string{upstreamAddr}, credential, opts...)
+}
+
+// NewAgentServerPool creates an agent server balancing the requests across the upstreams, failing over the
+// failing ones. The workers are multiplied by the number of upstreams, to advertise the combined capacity.
+func NewAgentServerPool(hubAddr string, upstreamAddrs []string, credential string, opts ...AgentServerOption) (*AgentServer, error) {
+	if len(upstreamAddrs) == 0 {
+		return nil, errors.New("no upstream")
+	}
+	// A token renewed by the hub supersedes the configured one.
+	credential, credentialOrigin := resolveCredential(credential)
+	// The credential is either the token, or the token with the key to sign the requests.
+	encryptedToken, signingKey, err := token.SplitCredential(credential)
 	if err != nil {
 		return nil, err
 	}
-	upstreamURL, err := parseAddr(upstreamAddr)
+	hubURL, err := parseAddr(hubAddr)
 	if err != nil {
 		return nil, err
 	}
+	var upstreamURLs []*url.URL
+	var sockets []string
+	for _, addr := range upstreamAddrs {
+		upstreamURL, socket, err := parseUpstreamAddr(addr)
+		if err != nil {
+			return nil, err
+		}
+		upstreamURLs = append(upstreamURLs, upstreamURL)
+		sockets = append(sockets, socket)
+	}
 
 	defaultAgentID, err := getOrCreateAgentID()
 	if err != nil {
@@ -72,24 +143,74 @@ func NewAgentServer(hubAddr, upstreamAddr, token string, opts ...AgentServerOpti
 	}
 
 	as := &AgentServer{
-		token:       token,
-		numWorker:   defaultNumWorker,
-		hubURL:      hubURL,
-		upstreamURL: upstreamURL,
-		reportHW:    true,
-		agentID:     defaultAgentID,
+		token:      encryptedToken,
+		signingKey: signingKey,
+		numWorker:  defaultNumWorker,
+		hubURL:     hubURL,
+		reportHW:   true,
+		hwPolicy:   hwinfo.ReportHashed,
+		agentID:    defaultAgentID,
+
+		reportInterval:   defaultReportInterval,
+		credentialOrigin: credentialOrigin,
 	}
 	for _, opt := range opts {
 		opt(as)
 	}
-
-	if as.reportHW {
-		as.hwInfo = hwinfo.NewHWInfo()
+	if as.hubClient == nil {
+		as.hubClient = &http.Client{Transport: as.hubTransport.newTransport(nil)}
+	}
+	var upstreams []*upstream
+	for i, upstreamURL := range upstreamURLs {
+		upstreams = append(upstreams, newUpstream(upstreamURL, sockets[i], as.upstreamTransport))
 	}
+	as.upstreams = newUpstreamPool(upstreams...)
+	as.numWorker *= len(upstreams)
+	as.agentID += as.agentIDOffset
+
+	as.collectHWInfo()
 
 	return as, nil
 }
 
+func (as *AgentServer) collectHWInfo() {
+	if !as.reportHW {
+		return
+	}
+	as.hwInfo = hwinfo.NewHWInfo()
+	if as.gpuCollector == nil {
+		as.gpuCollector = hwinfo.NewGPUCollector()
+	}
+	if as.gpuCollector != nil {
+		if stats, err := as.collectGPUStats(context.Background()); err == nil {
+			as.hwInfo.GPUStats = stats
+		} else {
+			logrus.WithError(err).Warn("Failed to collect GPU stats")
+		}
+	}
+	as.hwInfo = as.hwInfo.Redact(as.hwPolicy)
+}
+
+// collectGPUStats collects the GPU stats within gpuCollectTimeout. If the collector hangs, e.g. nvidia-smi
+// stuck on a wedged driver, it falls back to the sysfs probe for good.
+func (as *AgentServer) collectGPUStats(ctx context.Context) ([]hwinfo.GPUStat, error) {
+	collectCtx, cancel := context.WithTimeout(ctx, gpuCollectTimeout)
+	defer cancel()
+	stats, err := as.gpuCollector.CollectGPUStats(collectCtx)
+	if err != nil && ctx.Err() == nil && errors.Is(collectCtx.Err(), context.DeadlineExceeded) {
+		fallback := newFallbackGPUCollector()
+		if fallback == nil {
+			return nil, err
+		}
+		logrus.WithError(err).Warn("Collecting GPU stats timed out, falling back to sysfs")
+		as.gpuCollector = fallback
+		fallbackCtx, fallbackCancel := context.WithTimeout(ctx, gpuCollectTimeout)
+		defer fallbackCancel()
+		return fallback.CollectGPUStats(fallbackCtx)
+	}
+	return stats, err
+}
+
 func WithNumWorker(num int) AgentServerOption {
 	return func(as *AgentServer) {
 		as.numWorker = num
@@ -108,6 +229,60 @@ func WithAgentID(agentID int) AgentServerOption {
 	}
 }
 
+// WithHubTLSConfig sets the TLS configuration to connect to the hub, e.g. the client certificate
+// for mutual TLS, or a custom CA to verify the hub.
+func WithHubTLSConfig(cfg *tls.Config) AgentServerOption {
+	return func(as *AgentServer) {
+		as.hubTLSConfig = cfg
+		as.hubClient = &http.Client{Transport: as.hubTransport.newTransport(cfg)}
+	}
+}
+
+// WithHardwarePolicy sets how much of the identifying hardware information is reported to the hub.
+func WithHardwarePolicy(policy hwinfo.ReportPolicy) AgentServerOption {
+	return func(as *AgentServer) {
+		as.hwPolicy = policy
+	}
+}
+
+// WithGPUCollector overrides the collector detected on the machine for the live GPU statistics.
+func WithGPUCollector(c hwinfo.GPUCollector) AgentServerOption {
+	return func(as *AgentServer) {
+		as.gpuCollector = c
+	}
+}
+
+// WithReportInterval sets how often the telemetry is re-reported to the hub.
+// Zero disables the periodic report.
+func WithReportInterval(interval time.Duration) AgentServerOption {
+	return func(as *AgentServer) {
+		as.reportInterval = interval
+	}
+}
+
+// WithAgentIDOffset offsets the agent IDs, to run several agent servers with the same agent ID.
+func WithAgentIDOffset(offset int) AgentServerOption {
+	return func(as *AgentServer) {
+		as.agentIDOffset = offset
+	}
+}
+
+// WithPathPrefix advertises the path prefix to the hub, to only receive the requests under it, so that one hub
+// can front several upstreams mounted under different prefixes. The prefix is stripped from the requests to the
+// upstream with the StripPrefix of the rewrite rules.
+func WithPathPrefix(prefix string) AgentServerOption {
+	return func(as *AgentServer) {
+		as.pathPrefix = prefix
+	}
+}
+
+// WithTracer emits the spans of calling the upstream and submitting the results to the hub.
+func WithTracer(t *tracing.Tracer) AgentServerOption {
+	return func(as *AgentServer) {
+		as.tracer = t
+	}
+}
+
 var agentIDFile = "agentID.txt"
 
 // getOrCreateAgentID returns the agent ID. If the agent ID was not generated, it will generate a new random one,
@@ -163,16 +338,25 @@ func parseAddr(addr string) (*url.URL, error) {
 		return nil, errors.New("invalid addr")
 	}
 	return &url.URL{
-		Scheme: u.Scheme,
-		Host:   u.Host,
-		User:   u.User,
-		Path:   u.Path,
+		Scheme:   u.Scheme,
+		Host:     u.Host,
+		User:     u.User,
+		Path:     u.Path,
+		RawPath:  u.RawPath,
+		RawQuery: u.RawQuery,
 	}, nil
 }
 
 func (as *AgentServer) Run(ctx context.Context) error {
 
+	as.workerStats = make([]workerStat, as.numWorker)
 	grp, ctx := errgroup.WithContext(ctx)
+	if as.reportInterval > 0 {
+		grp.Go(func() error {
+			as.runReporter(ctx)
+			return nil
+		})
+	}
 	for i := 0; i < as.numWorker; i++ {
 		workerNum := i
 		grp.Go(func() error {
@@ -192,50 +376,176 @@ func (as *AgentServer) newHubAPIRequest(ctx context.Context, agentID int, apiPat
 	u := *as.hubURL
 	u.Path = path.Join(u.Path, apiPath)
 	req, _ := http.NewRequestWithContext(ctx, "POST", u.String(), reader)
-	req.Header.Set("slime-agent-token", as.token)
+	agentToken := as.getToken()
+	if apiPath != hub.PathJoin {
+		if s := as.getSession(agentID); s != nil {
+			agentToken = s.token
+		}
+	}
+	req.Header.Set("slime-agent-token", agentToken)
 	req.Header.Set("slime-agent-id", strconv.Itoa(agentID))
 	return req
 }
 
-func (as *AgentServer) fixUpstreamRequest(r *http.Request) {
-	r.URL.Host = as.upstreamURL.Host
-	r.URL.Scheme = as.upstreamURL.Scheme
-	r.URL.User = as.upstreamURL.User
+func (as *AgentServer) hubHTTPClient() *http.Client {
+	if as.hubClient != nil {
+		return as.hubClient
+	}
+	return http.DefaultClient
+}
+
+// doHubRequest signs the request if the agent has a signing key, and sends it to the hub.
+func (as *AgentServer) doHubRequest(req *http.Request) (*http.Response, error) {
+	if len(as.signingKey) > 0 {
+		nonce := make([]byte, 16)
+		if _, err := cryptorand.Read(nonce); err != nil {
+			return nil, err
+		}
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		nonceHex := hex.EncodeToString(nonce)
+		req.Header.Set("slime-timestamp", timestamp)
+		req.Header.Set("slime-nonce", nonceHex)
+		req.Header.Set("slime-signature", token.Sign(as.signingKey, req.Method, hub.APIPath(req.URL.Path),
+			req.Header.Get("slime-agent-id"), req.Header.Get("slime-connection-id"), timestamp, nonceHex))
+	}
+	resp, err := as.hubHTTPClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if renewed := resp.Header.Get("slime-renewed-token"); renewed != "" {
+		as.renewToken(renewed)
+	}
+	return resp, nil
+}
+
+// rewriteUpstreamRequest applies the path prefix and the rewrite rules, regardless of the upstream.
+func (as *AgentServer) rewriteUpstreamRequest(r *http.Request) {
 	r.Host = ""
 	r.RequestURI = ""
+	if as.rewrite != nil {
+		as.rewrite.applyRequest(r)
+	}
+}
+
+// targetUpstream points the request to the upstream.
+func (as *AgentServer) targetUpstream(r *http.Request, upstreamURL *url.URL) {
+	r.URL.Host = upstreamURL.Host
+	r.URL.Scheme = upstreamURL.Scheme
+	r.URL.User = upstreamURL.User
+
+	// The upstream may be mounted under a base path, with the query parameters to every request.
+	// The escaped forms are joined, so that an escaped "/" in either of them is kept.
+	if base := upstreamURL.Path; base != "" && base != "/" {
+		escaped := joinPath(upstreamURL.EscapedPath(), r.URL.EscapedPath())
+		if path, err := url.PathUnescape(escaped); err == nil {
+			r.URL.Path = path
+			r.URL.RawPath = escaped
+		}
+	}
+	if query := upstreamURL.RawQuery; query != "" {
+		if r.URL.RawQuery == "" {
+			r.URL.RawQuery = query
+		} else {
+			r.URL.RawQuery = query + "&" + r.URL.RawQuery
+		}
+	}
 }
 
 func (as *AgentServer) joinHub(ctx context.Context, agentID int) error {
-	var body io.Reader
+	var hwInfo interface{}
 	if as.hwInfo != nil {
-		json, err := json.Marshal(as.hwInfo)
+		hwInfo = as.hwInfo
+	}
+	header, err := as.postHubJSON(ctx, agentID, hub.PathJoin, hwInfo)
+	if err != nil {
+		return err
+	}
+	as.setSession(agentID, header)
+
+	logrus.Infof("Joined hub: %s", as.hubURL)
+	return nil
+}
+
+func (as *AgentServer) postHubJSON(ctx context.Context, agentID int, apiPath string, v interface{}) (http.Header, error) {
+	var body io.Reader
+	if v != nil {
+		json, err := json.Marshal(v)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		body = bufio.NewReader(bytes.NewReader(json))
 	}
-	req := as.newHubAPIRequest(ctx, agentID, hub.PathJoin, body)
-	resp, err := http.DefaultClient.Do(req)
+	req := as.newHubAPIRequest(ctx, agentID, apiPath, body)
+	resp, err := as.doHubRequest(req)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return errors.New(resp.Status)
+		return nil, errors.New(resp.Status)
 	}
+	return resp.Header, nil
+}
 
-	logrus.Infof("Joined hub: %s", as.hubURL)
-	return nil
+// runReporter periodically reports the telemetry on behalf of all the workers.
+func (as *AgentServer) runReporter(ctx context.Context) {
+	ticker := time.NewTicker(as.reportInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		var base hwinfo.Telemetry
+		if as.hwInfo != nil {
+			base.CollectSystemStats()
+			if as.gpuCollector != nil {
+				stats, err := as.collectGPUStats(ctx)
+				if err != nil {
+					logrus.WithError(err).Warn("Failed to collect GPU stats")
+				}
+				base.GPUStats = hwinfo.RedactGPUStats(stats, as.hwPolicy)
+			}
+		}
+		base.UpstreamHealthy = as.upstreamFailures.Load() == 0
+		base.QueueDepth = as.upstreams.queueDepth()
+
+		for i := 0; i < as.numWorker; i++ {
+			telemetry := base
+			if i < len(as.workerStats) {
+				telemetry.InFlight = int(as.workerStats[i].inFlight.Load())
+			}
+			if _, err := as.postHubJSON(ctx, as.agentID+i, hub.PathReport, &telemetry); err != nil && ctx.Err() == nil {
+				logrus.WithError(err).WithField("worker", i).Warn("Failed to report telemetry")
+			}
+		}
+	}
 }
 
 func (as *AgentServer) runWorker(ctx context.Context, agentID int, workerNum int) error {
 	log := logrus.WithField("worker", workerNum)
+	stat := &as.workerStats[workerNum]
 	backoffDuration := time.Second
 	for ctx.Err() == nil {
 		var connectionID string
 		func() error {
+			if as.sessionNeedsRefresh(agentID) {
+				if err := as.joinHub(ctx, agentID); err != nil {
+					log.WithError(err).Warnf("Refreshing session... Retry in %s", backoffDuration)
+					time.Sleep(backoffDuration)
+					backoffDuration *= 2
+					return nil
+				}
+			}
+
 			acceptReq := as.newHubAPIRequest(ctx, agentID, hub.PathAccept, nil)
-			acceptResp, err := http.DefaultClient.Do(acceptReq)
+			if as.pathPrefix != "" {
+				acceptReq.Header.Set("slime-path-prefix", as.pathPrefix)
+			}
+			acceptResp, err := as.doHubRequest(acceptReq)
 			if err != nil && (errors.Is(err, io.ErrUnexpectedEOF) || strings.Contains(err.Error(), "unexpected EOF")) {
 				// The connection has been accepted by hub and got terminated waiting for a task.
 				// Retry immediately.
@@ -251,12 +561,19 @@ func (as *AgentServer) runWorker(ctx context.Context, agentID int, workerNum int
 				return nil
 			}
 			defer acceptResp.Body.Close()
-			backoffDuration = time.Second
 
 			if acceptResp.StatusCode != http.StatusOK {
-				log.WithField("status_code", acceptResp.StatusCode).Error(acceptResp.Status)
+				if acceptResp.StatusCode == http.StatusUnauthorized && as.invalidateSession(agentID) {
+					// The session has expired or been revoked. Join again right away to refresh it.
+					log.Info("Session expired")
+					return nil
+				}
+				log.WithField("status_code", acceptResp.StatusCode).Errorf("%s. Retry in %s", acceptResp.Status, backoffDuration)
+				time.Sleep(backoffDuration)
+				backoffDuration *= 2
 				return nil
 			}
+			backoffDuration = time.Second
 
 			connectionID = acceptResp.Header.Get("slime-connection-id")
 			if connectionID == "" {
@@ -270,7 +587,13 @@ func (as *AgentServer) runWorker(ctx context.Context, agentID int, workerNum int
 				return err
 			}
 
-			log = log.WithField("path", upReq.URL.Path)
+			reqLog := log.WithField("path", upReq.URL.Path)
+			if requestID := upReq.Header.Get("X-Request-Id"); requestID != "" {
+				reqLog = reqLog.WithField("request_id", requestID)
+			}
+			parent, _ := tracing.ParseTraceparent(upReq.Header.Get("traceparent"))
+			stat.inFlight.Add(1)
+			defer stat.inFlight.Add(-1)
 
 			pr, pw := io.Pipe()
 
@@ -284,36 +607,68 @@ func (as *AgentServer) runWorker(ctx context.Context, agentID int, workerNum int
 					return ctx.Err()
 				case <-recvHeader:
 				}
+				submitSpan := as.tracer.Start(parent, "agent.submit", tracing.SpanKindClient)
+				defer submitSpan.End()
 				submitReq := as.newHubAPIRequest(ctx, agentID, hub.PathSubmit, pr)
 				submitReq.Header.Set("slime-connection-id", connectionID)
-				submitResp, err := http.DefaultClient.Do(submitReq)
+				submitResp, err := as.doHubRequest(submitReq)
 				if err != nil {
-					log.WithError(err).Error("Submit result")
+					submitSpan.SetError(err)
+					reqLog.WithError(err).Error("Submit result")
 					return err
 				}
 				defer submitResp.Body.Close()
 				if submitResp.StatusCode != http.StatusOK {
-					log.WithField("status_code", submitResp.StatusCode).Errorf("Submit result: %s", submitResp.Status)
-					return errors.New(submitResp.Status)
+					err := errors.New(submitResp.Status)
+					submitSpan.SetError(err)
+					reqLog.WithField("status_code", submitResp.StatusCode).Errorf("Submit result: %s", submitResp.Status)
+					return err
 				}
-				log.Info("Result submitted")
+				reqLog.Info("Result submitted")
 				return nil
 			})
 
 			grp.Go(func() error {
 				defer pw.Close()
-				log.Info("Invoke upstream...")
+				reqLog.Info("Invoke upstream...")
 
-				as.fixUpstreamRequest(upReq)
-				upReq = upReq.WithContext(ctx)
-				upResp, err := http.DefaultClient.Do(upReq)
+				upstreamSpan := as.tracer.Start(parent, "agent.upstream", tracing.SpanKindClient)
+				defer upstreamSpan.End()
+				if sc := upstreamSpan.Context(); sc.IsValid() {
+					upReq.Header.Set("traceparent", sc.Traceparent())
+				}
+
+				upCtx := ctx
+				if deadline, ok := upstreamDeadline(upReq, time.Now()); ok {
+					var cancel context.CancelFunc
+					upCtx, cancel = context.WithDeadline(ctx, deadline)
+					defer cancel()
+				}
+				as.rewriteUpstreamRequest(upReq)
+				upResp, err := as.invokeUpstream(upCtx, upReq, reqLog)
 				if err != nil {
-					log.WithError(err).Error("Invoke upstream")
-					return err
+					upstreamSpan.SetError(err)
+					if ctx.Err() != nil {
+						return err
+					}
+					// The requests out of their deadline don't tell the health of the upstream.
+					if upCtx.Err() == nil {
+						as.upstreamFailures.Add(1)
+					}
+					reqLog.WithError(err).Error("Invoke upstream")
+					// Report the failure to the hub, rather than leaving the application waiting.
+					upResp = upstreamErrorResponse(upReq, err)
+				} else {
+					as.upstreamFailures.Store(0)
+					upstreamSpan.SetAttribute("http.status_code", upResp.StatusCode)
+					if as.rewrite != nil {
+						as.rewrite.applyResponse(upResp)
+					}
 				}
 				defer upResp.Body.Close()
 
-				log.WithFields(logrus.Fields{
+				reqLog.WithFields(logrus.Fields{
+					"upstream":       upResp.Request.URL.Host,
 					"status_code":    upResp.StatusCode,
 					"content_length": upResp.ContentLength,
 				}).Info("Upstream responsed")
@@ -324,15 +679,17 @@ func (as *AgentServer) runWorker(ctx context.Context, agentID int, workerNum int
 					return ctx.Err()
 				}
 
+				tunnelResponse(upResp)
 				if err := upResp.Write(pw); err != nil {
-					log.WithError(err).Error("Write upstream response")
+					upstreamSpan.SetError(err)
+					reqLog.WithError(err).Error("Write upstream response")
 					return err
 				}
 				return nil
 			})
 
 			if err := grp.Wait(); err != nil {
-				log.WithError(err).Error("Worker error")
+				reqLog.WithError(err).Error("Worker error")
 				return err
 			}
 			return nil
@@ -17,7 +17,10 @@ package agent
 
 import (
 	"context"
+	"crypto/tls"
+	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
@@ -25,7 +28,11 @@ import (
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/hoveychen/slime/pkg/hub"
+	"github.com/hoveychen/slime/pkg/hwinfo"
+	"github.com/hoveychen/slime/pkg/token"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -133,11 +140,10 @@ func TestNewHubAPIRequest(t *testing.T) {
 	}
 }
 
-func TestFixUpstreamRequest(t *testing.T) {
+func TestTargetUpstream(t *testing.T) {
 	// Create a new AgentServer with a mock upstream URL.
-	as := &AgentServer{
-		upstreamURL: &url.URL{Scheme: "http", Host: "localhost:8081", Path: "/api/v1"},
-	}
+	as := &AgentServer{}
+	upstreamURL := &url.URL{Scheme: "http", Host: "localhost:8081", Path: "/api/v1"}
 
 	// Create a new upstream request with a mock path and host.
 	path := "/test"
@@ -148,17 +154,18 @@ func TestFixUpstreamRequest(t *testing.T) {
 	}
 
 	// Fix the upstream request.
-	as.fixUpstreamRequest(req)
+	as.rewriteUpstreamRequest(req)
+	as.targetUpstream(req, upstreamURL)
 
 	// Check that the request URL has the expected scheme, host, and path.
-	if req.URL.Scheme != as.upstreamURL.Scheme {
-		t.Errorf("Expected scheme to be %s, but got %s", as.upstreamURL.Scheme, req.URL.Scheme)
+	if req.URL.Scheme != upstreamURL.Scheme {
+		t.Errorf("Expected scheme to be %s, but got %s", upstreamURL.Scheme, req.URL.Scheme)
 	}
-	if req.URL.Host != as.upstreamURL.Host {
-		t.Errorf("Expected host to be %s, but got %s", as.upstreamURL.Host, req.URL.Host)
+	if req.URL.Host != upstreamURL.Host {
+		t.Errorf("Expected host to be %s, but got %s", upstreamURL.Host, req.URL.Host)
 	}
-	if req.URL.Path != path {
-		t.Errorf("Expected path to be %s, but got %s", path, req.URL.Path)
+	if req.URL.Path != "/api/v1/test" {
+		t.Errorf("Expected path to be joined with the base path, but got %s", req.URL.Path)
 	}
 
 	// Check that the request host and request URI are empty.
@@ -170,6 +177,43 @@ func TestFixUpstreamRequest(t *testing.T) {
 	}
 }
 
+func TestTargetUpstreamBasePath(t *testing.T) {
+	tests := []struct {
+		upstream string
+		strip    string
+		target   string
+		want     string
+	}{
+		{"http://localhost:8000", "", "/v1/chat?stream=1", "http://localhost:8000/v1/chat?stream=1"},
+		{"http://localhost:8000/", "", "/v1/chat", "http://localhost:8000/v1/chat"},
+		{"http://localhost:8000/api", "", "/v1/chat", "http://localhost:8000/api/v1/chat"},
+		{"http://localhost:8000/api/", "", "/v1/chat/", "http://localhost:8000/api/v1/chat/"},
+		{"http://localhost:8000/api", "", "/", "http://localhost:8000/api/"},
+		{"http://localhost:8000/api?key=1", "", "/v1/chat?stream=1", "http://localhost:8000/api/v1/chat?key=1&stream=1"},
+		{"http://localhost:8000/api?key=1", "", "/v1/chat", "http://localhost:8000/api/v1/chat?key=1"},
+		{"http://localhost:8000/a%2Fb", "", "/c%2Fd", "http://localhost:8000/a%2Fb/c%2Fd"},
+		{"http://localhost:8000/a%2Fb", "", "/c/d", "http://localhost:8000/a%2Fb/c/d"},
+		{"http://localhost:8000/a%2Fb?key=1", "", "/", "http://localhost:8000/a%2Fb/?key=1"},
+		{"http://localhost:8000/api", "/llm", "/llm/v1/chat", "http://localhost:8000/api/v1/chat"},
+		{"http://localhost:8000/api", "/llm", "/llm", "http://localhost:8000/api/"},
+		{"http://localhost:8000", "/llm/", "/llm/v1/chat", "http://localhost:8000/v1/chat"},
+	}
+	for _, tt := range tests {
+		upstreamURL, err := parseAddr(tt.upstream)
+		assert.NoError(t, err)
+		as := &AgentServer{}
+		if tt.strip != "" {
+			WithPathPrefix(tt.strip)(as)
+			WithRewriteRules(&RewriteRules{StripPrefix: tt.strip})(as)
+		}
+
+		req := httptest.NewRequest("POST", tt.target, nil)
+		as.rewriteUpstreamRequest(req)
+		as.targetUpstream(req, upstreamURL)
+		assert.Equal(t, tt.want, req.URL.String(), "%s %s", tt.upstream, tt.target)
+	}
+}
+
 func TestNewAgentServer(t *testing.T) {
 	// Test case 1: Valid hub and upstream addresses, with default options.
 	hubAddr := "http://localhost:8080"
@@ -188,8 +232,8 @@ func TestNewAgentServer(t *testing.T) {
 	if as.hubURL.String() != hubAddr {
 		t.Errorf("Expected hubURL to be %s, but got %s", hubAddr, as.hubURL.String())
 	}
-	if as.upstreamURL.String() != upstreamAddr {
-		t.Errorf("Expected upstreamURL to be %s, but got %s", upstreamAddr, as.upstreamURL.String())
+	if len(as.upstreams.upstreams) != 1 || as.upstreams.upstreams[0].url.String() != upstreamAddr {
+		t.Errorf("Expected the upstream to be %s", upstreamAddr)
 	}
 
 	// Test case 2: Valid hub and upstream addresses, with custom options.
@@ -394,3 +438,277 @@ func TestWithAgentID(t *testing.T) {
 	// Check that the agentID is set correctly
 	assert.Equal(t, 123, as.agentID)
 }
+
+type mockGPUCollector struct {
+	stats []hwinfo.GPUStat
+}
+
+func (m *mockGPUCollector) CollectGPUStats(ctx context.Context) ([]hwinfo.GPUStat, error) {
+	return m.stats, nil
+}
+
+// hangingGPUCollector blocks like nvidia-smi stuck on a wedged driver.
+type hangingGPUCollector struct{}
+
+func (hangingGPUCollector) CollectGPUStats(ctx context.Context) ([]hwinfo.GPUStat, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestCollectGPUStatsTimeout(t *testing.T) {
+	oldTimeout, oldFallback := gpuCollectTimeout, newFallbackGPUCollector
+	defer func() { gpuCollectTimeout, newFallbackGPUCollector = oldTimeout, oldFallback }()
+	gpuCollectTimeout = 10 * time.Millisecond
+
+	// Without the sysfs GPUs, the timeout is reported.
+	newFallbackGPUCollector = func() hwinfo.GPUCollector { return nil }
+	as := &AgentServer{gpuCollector: hangingGPUCollector{}}
+	_, err := as.collectGPUStats(context.Background())
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	// Otherwise it falls back to sysfs, for the later collections too.
+	stats := []hwinfo.GPUStat{{Index: 0, Name: "AMD Instinct MI100"}}
+	fallback := &mockGPUCollector{stats: stats}
+	newFallbackGPUCollector = func() hwinfo.GPUCollector { return fallback }
+	got, err := as.collectGPUStats(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, stats, got)
+	assert.Same(t, fallback, as.gpuCollector)
+}
+
+func TestRunReporter(t *testing.T) {
+	reported := make(chan *hwinfo.Telemetry, 10)
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, hub.PathReport, r.URL.Path)
+		var telemetry hwinfo.Telemetry
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&telemetry))
+		reported <- &telemetry
+	}))
+	defer mockServer.Close()
+
+	hubURL, _ := url.Parse(mockServer.URL)
+	stats := []hwinfo.GPUStat{{Index: 0, Name: "Tesla T4", MemoryTotalMB: 15360, MemoryUsedMB: 1024}}
+	as := &AgentServer{
+		hubURL:         hubURL,
+		token:          "abc123",
+		numWorker:      1,
+		hwInfo:         &hwinfo.HWInfo{CPUCores: 4},
+		gpuCollector:   &mockGPUCollector{stats: stats},
+		reportInterval: 10 * time.Millisecond,
+		workerStats:    make([]workerStat, 1),
+		upstreams:      newUpstreamPool(&upstream{}, &upstream{}),
+	}
+	as.workerStats[0].inFlight.Store(1)
+	as.upstreams.upstreams[0].waiting.Store(1)
+	as.upstreams.upstreams[1].waiting.Store(2)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go as.runReporter(ctx)
+
+	select {
+	case telemetry := <-reported:
+		assert.Equal(t, stats, telemetry.GPUStats)
+		assert.Equal(t, 1, telemetry.InFlight)
+		assert.Equal(t, 3, telemetry.QueueDepth)
+		assert.True(t, telemetry.UpstreamHealthy)
+	case <-time.After(time.Second):
+		t.Fatal("Expected telemetry to be reported")
+	}
+
+	// Upstream failures are reported as unhealthy.
+	as.upstreamFailures.Store(2)
+	for {
+		select {
+		case telemetry := <-reported:
+			if !telemetry.UpstreamHealthy {
+				return
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Expected unhealthy upstream to be reported")
+		}
+	}
+}
+
+func TestWithHardwarePolicy(t *testing.T) {
+	as, err := NewAgentServer("http://localhost:8080", "http://localhost:9090", "abc123", WithHardwarePolicy(hwinfo.ReportCoarse))
+	assert.NoError(t, err)
+	assert.Equal(t, hwinfo.ReportCoarse, as.hwPolicy)
+	assert.Empty(t, as.hwInfo.MacAddresses)
+	assert.Empty(t, as.hwInfo.Fingerprint)
+}
+
+func TestWithHubTLSConfig(t *testing.T) {
+	as := &AgentServer{}
+	assert.Equal(t, http.DefaultClient, as.hubHTTPClient())
+
+	tlsConfig := &tls.Config{ServerName: "hub.example.com"}
+	WithHubTLSConfig(tlsConfig)(as)
+	transport, ok := as.hubHTTPClient().Transport.(*http.Transport)
+	if assert.True(t, ok) {
+		assert.Equal(t, tlsConfig, transport.TLSClientConfig)
+	}
+}
+
+func TestDoHubRequestSigned(t *testing.T) {
+	signingKey := []byte("0123456789abcdef0123456789abcdef")
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "abc123", r.Header.Get("slime-agent-token"))
+		assert.True(t, token.VerifySignature(signingKey, r.Header.Get("slime-signature"), r.Method, r.URL.Path,
+			r.Header.Get("slime-agent-id"), r.Header.Get("slime-connection-id"),
+			r.Header.Get("slime-timestamp"), r.Header.Get("slime-nonce")))
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer mockServer.Close()
+
+	as, err := NewAgentServer(mockServer.URL, "http://localhost:9090", token.JoinCredential("abc123", signingKey))
+	if err != nil {
+		t.Fatalf("Failed to create agent server: %v", err)
+	}
+	assert.Equal(t, "abc123", as.token)
+	assert.Equal(t, signingKey, as.signingKey)
+
+	req := as.newHubAPIRequest(context.Background(), 123, hub.PathSubmit, nil)
+	req.Header.Set("slime-connection-id", "456")
+	resp, err := as.doHubRequest(req)
+	if assert.NoError(t, err) {
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		resp.Body.Close()
+	}
+}
+
+func TestDoHubRequestSignedWithBasePath(t *testing.T) {
+	// The hub is served under a base path, e.g. behind a reverse proxy stripping it.
+	signingKey := []byte("0123456789abcdef0123456789abcdef")
+	mux := http.NewServeMux()
+	mux.Handle("/slime/", http.StripPrefix("/slime", hub.NewHubServer("test-secret")))
+	hubServer := httptest.NewServer(mux)
+	defer hubServer.Close()
+	tok, _ := token.NewTokenManager([]byte("test-secret")).Encrypt(&token.AgentToken{Id: 1, Name: "test-agent", SigningKey: signingKey})
+
+	as, err := NewAgentServer(hubServer.URL+"/slime", "http://localhost:9090", token.JoinCredential(tok, signingKey))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, as.joinHub(context.Background(), 1))
+
+	resp, err := as.doHubRequest(as.newHubAPIRequest(context.Background(), 1, hub.PathReport, strings.NewReader("{}")))
+	if assert.NoError(t, err) {
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		resp.Body.Close()
+	}
+}
+
+func TestTunnelConformance(t *testing.T) {
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/length":
+			w.Header().Set("Content-Length", "5")
+			w.Write([]byte("hello"))
+		case "/chunked":
+			w.Write([]byte("hel"))
+			w.(http.Flusher).Flush()
+			w.Write([]byte("lo"))
+		case "/trailer":
+			w.Header().Set("Trailer", "Grpc-Status")
+			w.Write([]byte("hello"))
+			w.Header().Set("Grpc-Status", "0")
+		case "/undeclared":
+			w.Write([]byte("hello"))
+			w.(http.Flusher).Flush()
+			w.Header().Set(http.TrailerPrefix+"X-Checksum", "abc")
+		case "/stream":
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.Write([]byte("data: 1\n\n"))
+			w.(http.Flusher).Flush()
+			<-release
+			w.Write([]byte("data: 2\n\n"))
+		case "/no-content":
+			w.WriteHeader(http.StatusNoContent)
+		case "/echo-trailer":
+			io.Copy(io.Discard, r.Body)
+			w.Write([]byte(r.Trailer.Get("X-Request-Checksum")))
+		}
+	}))
+	defer upstream.Close()
+
+	hubServer := httptest.NewServer(hub.NewHubServer("test-secret"))
+	defer hubServer.Close()
+	tok, _ := token.NewTokenManager([]byte("test-secret")).Encrypt(&token.AgentToken{Id: 1, Name: "test-agent"})
+	as, err := NewAgentServer(hubServer.URL, upstream.URL, tok, WithNumWorker(2), WithReportInterval(0))
+	if !assert.NoError(t, err) {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go as.Run(ctx)
+
+	do := func(method, path string, body io.Reader) *http.Response {
+		req, _ := http.NewRequest(method, hubServer.URL+path, body)
+		req.Header.Set("slime-block", "1")
+		resp, err := http.DefaultClient.Do(req)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		return resp
+	}
+	readBody := func(resp *http.Response) string {
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		return string(body)
+	}
+
+	// Test case 1: the Content-Length is kept
+	resp := do("GET", "/length", nil)
+	assert.Equal(t, int64(5), resp.ContentLength)
+	assert.Empty(t, resp.TransferEncoding)
+	assert.Equal(t, "hello", readBody(resp))
+
+	// Test case 2: the chunked response is kept chunked
+	resp = do("GET", "/chunked", nil)
+	assert.Equal(t, int64(-1), resp.ContentLength)
+	assert.Equal(t, []string{"chunked"}, resp.TransferEncoding)
+	assert.Equal(t, "hello", readBody(resp))
+
+	// Test case 3: the declared trailers
+	resp = do("GET", "/trailer", nil)
+	assert.Contains(t, resp.Trailer, "Grpc-Status")
+	assert.Equal(t, "hello", readBody(resp))
+	assert.Equal(t, "0", resp.Trailer.Get("Grpc-Status"))
+
+	// Test case 4: the undeclared trailers
+	resp = do("GET", "/undeclared", nil)
+	assert.Equal(t, "hello", readBody(resp))
+	assert.Equal(t, "abc", resp.Trailer.Get("X-Checksum"))
+
+	// Test case 5: the events are streamed as they come
+	resp = do("GET", "/stream", nil)
+	event := make([]byte, len("data: 1\n\n"))
+	_, err = io.ReadFull(resp.Body, event)
+	assert.NoError(t, err)
+	assert.Equal(t, "data: 1\n\n", string(event))
+	close(release)
+	assert.Equal(t, "data: 2\n\n", readBody(resp))
+
+	// Test case 6: the response to HEAD has the Content-Length without the body
+	resp = do("HEAD", "/length", nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, int64(5), resp.ContentLength)
+	assert.Empty(t, readBody(resp))
+
+	// Test case 7: no content
+	resp = do("GET", "/no-content", nil)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.Empty(t, readBody(resp))
+
+	// Test case 8: the request trailers
+	req, _ := http.NewRequest("POST", hubServer.URL+"/echo-trailer", io.NopCloser(strings.NewReader("hello")))
+	req.Header.Set("slime-block", "1")
+	req.Trailer = http.Header{"X-Request-Checksum": {"xyz"}}
+	resp, err = http.DefaultClient.Do(req)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "xyz", readBody(resp))
+	}
+}
@@ -0,0 +1,80 @@
+/*
+Copyright © 2023 Harry C <hoveychen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package agent
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// session is the short-lived credential issued by the hub on join, if the hub requires one.
+type session struct {
+	token    string
+	issuedAt time.Time
+	expireAt time.Time
+}
+
+// needsRefresh reports whether the session is close to its expiry, and should be refreshed by joining again.
+func (s *session) needsRefresh(now time.Time) bool {
+	lifetime := s.expireAt.Sub(s.issuedAt)
+	return !now.Before(s.issuedAt.Add(lifetime * 4 / 5))
+}
+
+// setSession stores the session issued in the join response of the hub.
+func (as *AgentServer) setSession(agentID int, header http.Header) {
+	as.sessionLock.Lock()
+	defer as.sessionLock.Unlock()
+
+	sessionToken := header.Get("slime-session-token")
+	expireAt, err := strconv.ParseInt(header.Get("slime-session-expire-at"), 10, 64)
+	if sessionToken == "" || err != nil {
+		// The hub doesn't issue sessions.
+		delete(as.sessions, agentID)
+		return
+	}
+	if as.sessions == nil {
+		as.sessions = make(map[int]*session)
+	}
+	as.sessions[agentID] = &session{
+		token:    sessionToken,
+		issuedAt: time.Now(),
+		expireAt: time.Unix(expireAt, 0),
+	}
+}
+
+func (as *AgentServer) getSession(agentID int) *session {
+	as.sessionLock.Lock()
+	defer as.sessionLock.Unlock()
+	return as.sessions[agentID]
+}
+
+func (as *AgentServer) sessionNeedsRefresh(agentID int) bool {
+	s := as.getSession(agentID)
+	return s != nil && s.needsRefresh(time.Now())
+}
+
+// invalidateSession marks the session to be refreshed right away, e.g. it's been revoked by the hub.
+func (as *AgentServer) invalidateSession(agentID int) bool {
+	as.sessionLock.Lock()
+	defer as.sessionLock.Unlock()
+	s, ok := as.sessions[agentID]
+	if !ok {
+		return false
+	}
+	as.sessions[agentID] = &session{token: s.token, issuedAt: s.issuedAt, expireAt: s.issuedAt}
+	return true
+}
@@ -0,0 +1,78 @@
+/*
+Copyright © 2023 Harry C <hoveychen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package agent
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/hoveychen/slime/pkg/hub"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJoinHubSession(t *testing.T) {
+	expireAt := time.Now().Add(time.Hour)
+	var gotTokens []string
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotTokens = append(gotTokens, r.Header.Get("slime-agent-token"))
+		if r.URL.Path == hub.PathJoin {
+			w.Header().Set("slime-session-token", "session123")
+			w.Header().Set("slime-session-expire-at", strconv.FormatInt(expireAt.Unix(), 10))
+		}
+	}))
+	defer mockServer.Close()
+
+	as := &AgentServer{token: "abc123"}
+	as.hubURL, _ = url.Parse(mockServer.URL)
+
+	assert.NoError(t, as.joinHub(context.Background(), 123))
+	assert.False(t, as.sessionNeedsRefresh(123))
+
+	// Other APIs use the session token, while joining always uses the long-lived token.
+	_, err := as.postHubJSON(context.Background(), 123, hub.PathReport, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, as.joinHub(context.Background(), 123))
+	assert.Equal(t, []string{"abc123", "session123", "abc123"}, gotTokens)
+
+	assert.True(t, as.invalidateSession(123))
+	assert.True(t, as.sessionNeedsRefresh(123))
+	assert.False(t, as.invalidateSession(456))
+}
+
+func TestSessionNeedsRefresh(t *testing.T) {
+	now := time.Now()
+	s := &session{issuedAt: now, expireAt: now.Add(10 * time.Minute)}
+	assert.False(t, s.needsRefresh(now.Add(7*time.Minute)))
+	assert.True(t, s.needsRefresh(now.Add(8*time.Minute)))
+}
+
+func TestSetSessionWithoutHeaders(t *testing.T) {
+	as := &AgentServer{}
+	header := http.Header{}
+	header.Set("slime-session-token", "session123")
+	header.Set("slime-session-expire-at", "0")
+	as.setSession(1, header)
+	assert.NotNil(t, as.getSession(1))
+
+	// The hub stopped issuing sessions.
+	as.setSession(1, http.Header{})
+	assert.Nil(t, as.getSession(1))
+}
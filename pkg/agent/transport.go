@@ -0,0 +1,129 @@
+/*
+Copyright © 2023 Harry C <hoveychen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package agent
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// ProxyDirect disables the proxy, regardless of the environment.
+const ProxyDirect = "direct"
+
+// TransportConfig configures the HTTP transport to the hub or the upstreams. The zero values keep the defaults
+// of http.DefaultTransport.
+type TransportConfig struct {
+	DialTimeout           time.Duration
+	ResponseHeaderTimeout time.Duration
+	IdleConnTimeout       time.Duration
+	MaxIdleConnsPerHost   int
+	// RootCAs verifies the servers, instead of the system roots.
+	RootCAs *x509.CertPool
+	// InsecureSkipVerify skips verifying the servers, e.g. for the lab upstreams with self-signed certificates.
+	InsecureSkipVerify bool
+	// Proxy is the proxy URL, or ProxyDirect for no proxy. When empty, the HTTP_PROXY, HTTPS_PROXY and NO_PROXY
+	// environment variables are followed.
+	Proxy        string
+	DisableHTTP2 bool
+}
+
+// Validate checks the config is well-formed.
+func (tc *TransportConfig) Validate() error {
+	if tc.Proxy == "" || tc.Proxy == ProxyDirect {
+		return nil
+	}
+	u, err := url.Parse(tc.Proxy)
+	if err != nil {
+		return fmt.Errorf("invalid proxy: %w", err)
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return fmt.Errorf("invalid proxy %q", tc.Proxy)
+	}
+	return nil
+}
+
+// newTransport creates a transport with the config, on top of the TLS configuration if any.
+func (tc *TransportConfig) newTransport(tlsConfig *tls.Config) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if tc == nil {
+		transport.TLSClientConfig = tlsConfig
+		return transport
+	}
+
+	if tc.DialTimeout > 0 {
+		dialer := &net.Dialer{Timeout: tc.DialTimeout, KeepAlive: 30 * time.Second}
+		transport.DialContext = dialer.DialContext
+	}
+	if tc.ResponseHeaderTimeout > 0 {
+		transport.ResponseHeaderTimeout = tc.ResponseHeaderTimeout
+	}
+	if tc.IdleConnTimeout > 0 {
+		transport.IdleConnTimeout = tc.IdleConnTimeout
+	}
+	if tc.MaxIdleConnsPerHost > 0 {
+		transport.MaxIdleConnsPerHost = tc.MaxIdleConnsPerHost
+	}
+
+	if tc.RootCAs != nil || tc.InsecureSkipVerify {
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{}
+		} else {
+			tlsConfig = tlsConfig.Clone()
+		}
+		if tc.RootCAs != nil {
+			tlsConfig.RootCAs = tc.RootCAs
+		}
+		tlsConfig.InsecureSkipVerify = tc.InsecureSkipVerify
+	}
+	transport.TLSClientConfig = tlsConfig
+
+	switch tc.Proxy {
+	case "":
+	case ProxyDirect:
+		transport.Proxy = nil
+	default:
+		if proxyURL, err := url.Parse(tc.Proxy); err == nil {
+			transport.Proxy = http.ProxyURL(proxyURL)
+		}
+	}
+
+	if tc.DisableHTTP2 {
+		// Without the "h2" upgrade, the client offers only HTTP/1.1 in the TLS handshake.
+		transport.ForceAttemptHTTP2 = false
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+	return transport
+}
+
+// WithHubTransport configures the HTTP transport to the hub.
+func WithHubTransport(cfg *TransportConfig) AgentServerOption {
+	return func(as *AgentServer) {
+		as.hubTransport = cfg
+		as.hubClient = &http.Client{Transport: cfg.newTransport(as.hubTLSConfig)}
+	}
+}
+
+// WithUpstreamTransport configures the HTTP transport to the upstreams. Each upstream has its own transport.
+func WithUpstreamTransport(cfg *TransportConfig) AgentServerOption {
+	return func(as *AgentServer) {
+		as.upstreamTransport = cfg
+	}
+}
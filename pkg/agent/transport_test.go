@@ -0,0 +1,112 @@
+/*
+Copyright © 2023 Harry C <hoveychen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package agent
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewTransport(t *testing.T) {
+	// Test case 1: the defaults
+	transport := (*TransportConfig)(nil).newTransport(nil)
+	assert.NotNil(t, transport.Proxy)
+	assert.True(t, transport.ForceAttemptHTTP2)
+	assert.Nil(t, transport.TLSClientConfig)
+
+	// Test case 2: customized
+	pool := x509.NewCertPool()
+	cfg := &TransportConfig{
+		DialTimeout:           time.Second,
+		ResponseHeaderTimeout: 2 * time.Second,
+		IdleConnTimeout:       3 * time.Second,
+		MaxIdleConnsPerHost:   4,
+		RootCAs:               pool,
+		InsecureSkipVerify:    true,
+		Proxy:                 ProxyDirect,
+		DisableHTTP2:          true,
+	}
+	base := &tls.Config{ServerName: "upstream.example.com"}
+	transport = cfg.newTransport(base)
+	assert.Equal(t, 2*time.Second, transport.ResponseHeaderTimeout)
+	assert.Equal(t, 3*time.Second, transport.IdleConnTimeout)
+	assert.Equal(t, 4, transport.MaxIdleConnsPerHost)
+	assert.Nil(t, transport.Proxy)
+	assert.False(t, transport.ForceAttemptHTTP2)
+	assert.NotNil(t, transport.TLSNextProto)
+	assert.Equal(t, "upstream.example.com", transport.TLSClientConfig.ServerName)
+	assert.Equal(t, pool, transport.TLSClientConfig.RootCAs)
+	assert.True(t, transport.TLSClientConfig.InsecureSkipVerify)
+	assert.False(t, base.InsecureSkipVerify)
+
+	// Test case 3: the proxy URL
+	transport = (&TransportConfig{Proxy: "http://proxy:3128"}).newTransport(nil)
+	proxyURL, err := transport.Proxy(httptest.NewRequest("GET", "http://upstream/", nil))
+	assert.NoError(t, err)
+	assert.Equal(t, "proxy:3128", proxyURL.Host)
+}
+
+func TestTransportConfigValidate(t *testing.T) {
+	assert.NoError(t, (&TransportConfig{}).Validate())
+	assert.NoError(t, (&TransportConfig{Proxy: ProxyDirect}).Validate())
+	assert.NoError(t, (&TransportConfig{Proxy: "socks5://proxy:1080"}).Validate())
+	assert.Error(t, (&TransportConfig{Proxy: "proxy"}).Validate())
+}
+
+func TestInsecureUpstream(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+
+	as, err := NewAgentServer("http://localhost:8080", upstream.URL, "abc123")
+	assert.NoError(t, err)
+	_, err = as.upstreams.upstreams[0].client.Get(upstream.URL)
+	assert.Error(t, err)
+
+	as, err = NewAgentServer("http://localhost:8080", upstream.URL, "abc123",
+		WithUpstreamTransport(&TransportConfig{InsecureSkipVerify: true}))
+	assert.NoError(t, err)
+	resp, err := as.upstreams.upstreams[0].client.Get(upstream.URL)
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+	}
+}
+
+func TestAgentServerOwnClients(t *testing.T) {
+	a, err := NewAgentServerPool("http://localhost:8080", []string{"localhost:9090", "localhost:9091"}, "abc123")
+	assert.NoError(t, err)
+	b, err := NewAgentServer("http://localhost:8080", "localhost:9090", "abc123")
+	assert.NoError(t, err)
+
+	assert.NotSame(t, http.DefaultClient, a.hubHTTPClient())
+	assert.NotSame(t, a.hubHTTPClient(), b.hubHTTPClient())
+	assert.NotSame(t, a.upstreams.upstreams[0].client, a.upstreams.upstreams[1].client)
+	assert.NotSame(t, a.upstreams.upstreams[0].client, b.upstreams.upstreams[0].client)
+
+	// The hub transport and TLS configuration are combined in any order.
+	tlsConfig := &tls.Config{ServerName: "hub.example.com"}
+	c, err := NewAgentServer("http://localhost:8080", "localhost:9090", "abc123",
+		WithHubTLSConfig(tlsConfig), WithHubTransport(&TransportConfig{IdleConnTimeout: time.Minute}))
+	assert.NoError(t, err)
+	transport := c.hubHTTPClient().Transport.(*http.Transport)
+	assert.Equal(t, tlsConfig, transport.TLSClientConfig)
+	assert.Equal(t, time.Minute, transport.IdleConnTimeout)
+}
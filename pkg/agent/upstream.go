@@ -0,0 +1,304 @@
+/*
+Copyright © 2023 Harry C <hoveychen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package agent
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hoveychen/slime/pkg/hub"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// maxReplayBody is the largest request body buffered to fail over to another upstream.
+	maxReplayBody = 1 << 20
+	// The failing upstreams are skipped for a backoff, doubled on every consecutive failure.
+	minUpstreamBackoff = time.Second
+	maxUpstreamBackoff = 30 * time.Second
+)
+
+// upstream is one of the upstreams load-balanced by the agent.
+type upstream struct {
+	url *url.URL
+	// socket is the path of the unix domain socket the upstream listens on, if any.
+	socket   string
+	client   *http.Client
+	inFlight atomic.Int32
+	// waiting counts the requests sent to the upstream, which hasn't started the response yet.
+	waiting  atomic.Int32
+	failures atomic.Int32
+	// retryAt is when the failing upstream is tried again, in unix nanoseconds.
+	retryAt atomic.Int64
+}
+
+func newUpstream(u *url.URL, socket string, cfg *TransportConfig) *upstream {
+	transport := cfg.newTransport(nil)
+	if socket != "" {
+		transport.Proxy = nil
+		dialer := &net.Dialer{}
+		if cfg != nil && cfg.DialTimeout > 0 {
+			dialer.Timeout = cfg.DialTimeout
+		}
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "unix", socket)
+		}
+	}
+	return &upstream{url: u, socket: socket, client: &http.Client{Transport: transport}}
+}
+
+func (u *upstream) String() string {
+	if u.socket != "" {
+		return "unix://" + u.socket + ":" + u.url.RequestURI()
+	}
+	return u.url.Redacted()
+}
+
+// parseUpstreamAddr parses the upstream address, either the ones of parseAddr, or the unix domain socket in the form
+// of unix:///path/to/socket[:/base/path]. It returns the socket path for the latter. The base path is split at the
+// last ":/", so that the socket path may contain one.
+func parseUpstreamAddr(addr string) (*url.URL, string, error) {
+	socket, ok := strings.CutPrefix(addr, "unix://")
+	if !ok {
+		u, err := parseAddr(addr)
+		return u, "", err
+	}
+	base := ""
+	if i := strings.LastIndex(socket, ":/"); i >= 0 {
+		socket, base = socket[:i], socket[i+1:]
+	}
+	if !strings.HasPrefix(socket, "/") {
+		return nil, "", errors.New("the unix socket path must be absolute")
+	}
+	// The host is only for the Host header to the upstream.
+	u, err := url.Parse("http://localhost" + base)
+	if err != nil {
+		return nil, "", err
+	}
+	return u, socket, nil
+}
+
+func (u *upstream) healthy(now time.Time) bool {
+	return u.retryAt.Load() <= now.UnixNano()
+}
+
+func (u *upstream) markFailure(now time.Time) {
+	failures := u.failures.Add(1)
+	backoff := minUpstreamBackoff
+	for i := int32(1); i < failures && backoff < maxUpstreamBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxUpstreamBackoff {
+		backoff = maxUpstreamBackoff
+	}
+	u.retryAt.Store(now.Add(backoff).UnixNano())
+}
+
+func (u *upstream) markSuccess() {
+	u.failures.Store(0)
+	u.retryAt.Store(0)
+}
+
+// upstreamPool balances the requests across the upstreams, by the least in-flight requests.
+type upstreamPool struct {
+	upstreams []*upstream
+	next      atomic.Uint32
+}
+
+func newUpstreamPool(upstreams ...*upstream) *upstreamPool {
+	return &upstreamPool{upstreams: upstreams}
+}
+
+// queueDepth counts the requests waiting for the upstreams to start the responses.
+func (p *upstreamPool) queueDepth() int {
+	if p == nil {
+		return 0
+	}
+	var depth int
+	for _, u := range p.upstreams {
+		depth += int(u.waiting.Load())
+	}
+	return depth
+}
+
+// candidates returns the upstreams in the order to try. The healthy ones with the least in-flight requests come
+// first, taking turns on ties. The failing ones are the last resort, the soonest to retry first.
+func (p *upstreamPool) candidates(now time.Time) []*upstream {
+	n := len(p.upstreams)
+	start := int(p.next.Add(1))
+	var healthy, failing []*upstream
+	for i := 0; i < n; i++ {
+		u := p.upstreams[(start+i)%n]
+		if u.healthy(now) {
+			healthy = append(healthy, u)
+		} else {
+			failing = append(failing, u)
+		}
+	}
+	sort.SliceStable(healthy, func(i, j int) bool {
+		return healthy[i].inFlight.Load() < healthy[j].inFlight.Load()
+	})
+	sort.SliceStable(failing, func(i, j int) bool {
+		return failing[i].retryAt.Load() < failing[j].retryAt.Load()
+	})
+	return append(healthy, failing...)
+}
+
+// upstreamDeadline returns the deadline of the request from the time left given by the hub, and removes it from
+// the request to the upstream. The deadline is counted from now by the clock of the agent, regardless of the hub's.
+func upstreamDeadline(r *http.Request, now time.Time) (time.Time, bool) {
+	header := r.Header.Get("slime-timeout-ms")
+	if header == "" {
+		return time.Time{}, false
+	}
+	r.Header.Del("slime-timeout-ms")
+	ms, err := strconv.ParseInt(header, 10, 64)
+	if err != nil || ms <= 0 {
+		return time.Time{}, false
+	}
+	return now.Add(time.Duration(ms) * time.Millisecond), true
+}
+
+// upstreamErrorResponse makes the response reporting the failure of the upstream to the hub, which replies the
+// application with 504 if the upstream timed out, or 502 otherwise.
+func upstreamErrorResponse(r *http.Request, err error) *http.Response {
+	code, statusCode := hub.ErrorUpstreamUnavailable, http.StatusBadGateway
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		code, statusCode = hub.ErrorUpstreamTimeout, http.StatusGatewayTimeout
+	}
+	header := http.Header{}
+	header.Set("slime-upstream-error", code)
+	return &http.Response{
+		Status:     http.StatusText(statusCode),
+		StatusCode: statusCode,
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     header,
+		Body:       http.NoBody,
+		Request:    r,
+	}
+}
+
+// tunnelResponse prepares the upstream response to be written to the hub in HTTP/1.1. The body of unknown length,
+// e.g. from an HTTP/2 upstream, is chunked to carry the trailers, rather than delimited by closing the connection.
+func tunnelResponse(resp *http.Response) {
+	resp.ProtoMajor, resp.ProtoMinor = 1, 1
+	noBody := resp.Request != nil && resp.Request.Method == http.MethodHead ||
+		resp.StatusCode < 200 || resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusNotModified
+	if resp.ContentLength < 0 && !noBody {
+		resp.TransferEncoding = []string{"chunked"}
+	}
+	if resp.Trailer == nil {
+		// The trailers not declared ahead are filled in once the body is read.
+		resp.Trailer = http.Header{}
+	}
+}
+
+// bufferBody reads the small request body in memory, so that the request can be retried on another upstream.
+func bufferBody(r *http.Request) error {
+	if r.Body == nil || r.Body == http.NoBody {
+		r.GetBody = func() (io.ReadCloser, error) { return http.NoBody, nil }
+		return nil
+	}
+	if r.ContentLength < 0 || r.ContentLength > maxReplayBody {
+		return nil
+	}
+	body, err := io.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		return err
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+	return nil
+}
+
+// invokeUpstream sends the request to the upstreams in turn, until one responds. The request is only failed over
+// if its body can be replayed.
+func (as *AgentServer) invokeUpstream(ctx context.Context, r *http.Request, log *logrus.Entry) (*http.Response, error) {
+	candidates := as.upstreams.candidates(time.Now())
+	if len(candidates) > 1 {
+		if err := bufferBody(r); err != nil {
+			return nil, err
+		}
+		if r.GetBody == nil {
+			candidates = candidates[:1]
+		}
+	}
+
+	var lastErr error
+	for i, u := range candidates {
+		req := r.Clone(ctx)
+		// The trailers are filled in the map of the original request once its body is read.
+		req.Trailer = r.Trailer
+		if i > 0 {
+			body, err := r.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req.Body = body
+		}
+		as.targetUpstream(req, u.url)
+
+		u.inFlight.Add(1)
+		u.waiting.Add(1)
+		resp, err := u.client.Do(req)
+		u.waiting.Add(-1)
+		if err == nil {
+			u.markSuccess()
+			var once sync.Once
+			resp.Body = &releaseBody{ReadCloser: resp.Body, release: func() {
+				once.Do(func() { u.inFlight.Add(-1) })
+			}}
+			return resp, nil
+		}
+		u.inFlight.Add(-1)
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		u.markFailure(time.Now())
+		lastErr = err
+		if i+1 < len(candidates) {
+			log.WithError(err).WithField("upstream", u.String()).Warn("Upstream failed. Failing over")
+		}
+	}
+	return nil, lastErr
+}
+
+// releaseBody calls the release once the response body is closed.
+type releaseBody struct {
+	io.ReadCloser
+	release func()
+}
+
+func (b *releaseBody) Close() error {
+	defer b.release()
+	return b.ReadCloser.Close()
+}
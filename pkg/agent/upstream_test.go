@@ -0,0 +1,310 @@
+/*
+Copyright © 2023 Harry C <hoveychen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package agent
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hoveychen/slime/pkg/hub"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUpstreamPoolCandidates(t *testing.T) {
+	a, _ := url.Parse("http://a")
+	b, _ := url.Parse("http://b")
+	c, _ := url.Parse("http://c")
+	pool := newUpstreamPool(newUpstream(a, "", nil), newUpstream(b, "", nil), newUpstream(c, "", nil))
+	now := time.Now()
+
+	// Test case 1: the least in-flight first
+	pool.upstreams[0].inFlight.Store(2)
+	pool.upstreams[1].inFlight.Store(1)
+	candidates := pool.candidates(now)
+	assert.Equal(t, "c", candidates[0].url.Host)
+	assert.Equal(t, "b", candidates[1].url.Host)
+	assert.Equal(t, "a", candidates[2].url.Host)
+
+	// Test case 2: taking turns on ties
+	pool.upstreams[0].inFlight.Store(0)
+	pool.upstreams[1].inFlight.Store(0)
+	first := map[string]bool{}
+	for i := 0; i < 3; i++ {
+		first[pool.candidates(now)[0].url.Host] = true
+	}
+	assert.Len(t, first, 3)
+
+	// Test case 3: the failing ones are the last resort
+	pool.upstreams[2].markFailure(now)
+	pool.upstreams[0].markFailure(now)
+	pool.upstreams[0].markFailure(now)
+	candidates = pool.candidates(now)
+	assert.Equal(t, "b", candidates[0].url.Host)
+	assert.Equal(t, "c", candidates[1].url.Host)
+	assert.Equal(t, "a", candidates[2].url.Host)
+
+	// Test case 4: retried after the backoff
+	assert.True(t, pool.upstreams[2].healthy(now.Add(minUpstreamBackoff)))
+	assert.False(t, pool.upstreams[0].healthy(now.Add(minUpstreamBackoff)))
+	pool.upstreams[0].markSuccess()
+	assert.True(t, pool.upstreams[0].healthy(now))
+}
+
+func TestUpstreamBackoff(t *testing.T) {
+	u := &upstream{}
+	now := time.Now()
+	for i := 0; i < 10; i++ {
+		u.markFailure(now)
+	}
+	assert.Equal(t, now.Add(maxUpstreamBackoff).UnixNano(), u.retryAt.Load())
+}
+
+func TestInvokeUpstreamFailover(t *testing.T) {
+	var received []string
+	live := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received = append(received, string(body))
+		w.Write([]byte("ok"))
+	}))
+	defer live.Close()
+	dead := httptest.NewServer(http.NotFoundHandler())
+	deadURL, _ := url.Parse(dead.URL)
+	dead.Close()
+	liveURL, _ := url.Parse(live.URL)
+
+	as := &AgentServer{upstreams: newUpstreamPool(newUpstream(deadURL, "", nil), newUpstream(liveURL, "", nil))}
+	log := logrus.NewEntry(logrus.StandardLogger())
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest("POST", "/v1/chat", strings.NewReader("hello"))
+		as.rewriteUpstreamRequest(req)
+		resp, err := as.invokeUpstream(context.Background(), req, log)
+		if assert.NoError(t, err) {
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			resp.Body.Close()
+		}
+	}
+	assert.Equal(t, []string{"hello", "hello"}, received)
+	assert.False(t, as.upstreams.upstreams[0].healthy(time.Now()))
+	assert.Zero(t, as.upstreams.upstreams[1].inFlight.Load())
+
+	// The unknown length body can't be replayed on another upstream.
+	as.upstreams.upstreams[0].markSuccess()
+	as.upstreams.upstreams[1].inFlight.Store(1)
+	req := httptest.NewRequest("POST", "/v1/chat", io.NopCloser(strings.NewReader("hello")))
+	req.ContentLength = -1
+	as.rewriteUpstreamRequest(req)
+	_, err := as.invokeUpstream(context.Background(), req, log)
+	assert.Error(t, err)
+}
+
+func TestUpstreamQueueDepth(t *testing.T) {
+	started := make(chan struct{})
+	respond := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-respond
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+	serverURL, _ := url.Parse(server.URL)
+
+	as := &AgentServer{upstreams: newUpstreamPool(newUpstream(serverURL, "", nil))}
+	assert.Zero(t, as.upstreams.queueDepth())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		req := httptest.NewRequest("GET", "/v1/chat", nil)
+		as.rewriteUpstreamRequest(req)
+		resp, err := as.invokeUpstream(context.Background(), req, logrus.NewEntry(logrus.StandardLogger()))
+		if assert.NoError(t, err) {
+			// The request is still in flight, but no longer waiting for the upstream.
+			assert.Zero(t, as.upstreams.queueDepth())
+			assert.Equal(t, int32(1), as.upstreams.upstreams[0].inFlight.Load())
+			resp.Body.Close()
+		}
+	}()
+
+	// The request waits for the upstream to start the response.
+	<-started
+	assert.Equal(t, 1, as.upstreams.queueDepth())
+	close(respond)
+	<-done
+}
+
+func TestParseUpstreamAddr(t *testing.T) {
+	u, socket, err := parseUpstreamAddr("http://localhost:8000/api")
+	assert.NoError(t, err)
+	assert.Empty(t, socket)
+	assert.Equal(t, "http://localhost:8000/api", u.String())
+
+	u, socket, err = parseUpstreamAddr("unix:///run/llm.sock")
+	assert.NoError(t, err)
+	assert.Equal(t, "/run/llm.sock", socket)
+	assert.Equal(t, "http://localhost", u.String())
+
+	u, socket, err = parseUpstreamAddr("unix:///run/llm.sock:/api/v1?key=1")
+	assert.NoError(t, err)
+	assert.Equal(t, "/run/llm.sock", socket)
+	assert.Equal(t, "/api/v1", u.Path)
+	assert.Equal(t, "key=1", u.RawQuery)
+
+	u, socket, err = parseUpstreamAddr("unix:///run/a:/llm.sock:/api")
+	assert.NoError(t, err)
+	assert.Equal(t, "/run/a:/llm.sock", socket)
+	assert.Equal(t, "/api", u.Path)
+
+	_, _, err = parseUpstreamAddr("unix://run/llm.sock")
+	assert.Error(t, err)
+}
+
+func TestInvokeUnixUpstream(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "llm.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Skip("unix domain socket is not supported:", err)
+	}
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Host + " " + r.URL.RequestURI()))
+	})}
+	go server.Serve(listener)
+	defer server.Close()
+
+	upstreamURL, socket, err := parseUpstreamAddr("unix://" + socket + ":/api")
+	assert.NoError(t, err)
+	as := &AgentServer{upstreams: newUpstreamPool(newUpstream(upstreamURL, socket, nil))}
+
+	req := httptest.NewRequest("GET", "/v1/chat?stream=1", nil)
+	as.rewriteUpstreamRequest(req)
+	resp, err := as.invokeUpstream(context.Background(), req, logrus.NewEntry(logrus.StandardLogger()))
+	if assert.NoError(t, err) {
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		assert.Equal(t, "localhost /api/v1/chat?stream=1", string(body))
+	}
+}
+
+func TestUpstreamDeadline(t *testing.T) {
+	req := httptest.NewRequest("GET", "/", nil)
+	_, ok := upstreamDeadline(req, time.Now())
+	assert.False(t, ok)
+
+	now := time.Now()
+	req.Header.Set("slime-timeout-ms", "60000")
+	got, ok := upstreamDeadline(req, now)
+	assert.True(t, ok)
+	assert.Equal(t, now.Add(time.Minute), got)
+	assert.Empty(t, req.Header.Get("slime-timeout-ms"))
+
+	// The clock of the agent is an hour off from the hub's. The request still has the time left given by the hub.
+	for _, skew := range []time.Duration{time.Hour, -time.Hour} {
+		skewed := time.Now().Add(skew)
+		req.Header.Set("slime-timeout-ms", "500")
+		got, ok = upstreamDeadline(req, skewed)
+		assert.True(t, ok)
+		assert.Equal(t, 500*time.Millisecond, got.Sub(skewed))
+	}
+
+	req.Header.Set("slime-timeout-ms", "soon")
+	_, ok = upstreamDeadline(req, now)
+	assert.False(t, ok)
+}
+
+func TestUpstreamErrorResponse(t *testing.T) {
+	dead := httptest.NewServer(http.NotFoundHandler())
+	deadURL, _ := url.Parse(dead.URL)
+	dead.Close()
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer slow.Close()
+	slowURL, _ := url.Parse(slow.URL)
+	log := logrus.NewEntry(logrus.StandardLogger())
+
+	// Test case 1: connection refused
+	as := &AgentServer{upstreams: newUpstreamPool(newUpstream(deadURL, "", nil))}
+	req := httptest.NewRequest("GET", "/v1/chat", nil)
+	as.rewriteUpstreamRequest(req)
+	_, err := as.invokeUpstream(context.Background(), req, log)
+	resp := upstreamErrorResponse(req, err)
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+	assert.Equal(t, hub.ErrorUpstreamUnavailable, resp.Header.Get("slime-upstream-error"))
+
+	// Test case 2: timed out
+	as = &AgentServer{upstreams: newUpstreamPool(newUpstream(slowURL, "", nil))}
+	req = httptest.NewRequest("GET", "/v1/chat", nil)
+	as.rewriteUpstreamRequest(req)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = as.invokeUpstream(ctx, req, log)
+	resp = upstreamErrorResponse(req, err)
+	assert.Equal(t, http.StatusGatewayTimeout, resp.StatusCode)
+	assert.Equal(t, hub.ErrorUpstreamTimeout, resp.Header.Get("slime-upstream-error"))
+
+	// The response is submitted to the hub as is.
+	var buf strings.Builder
+	assert.NoError(t, resp.Write(&buf))
+	assert.True(t, strings.HasPrefix(buf.String(), "HTTP/1.1 504 Gateway Timeout\r\n"), buf.String())
+}
+
+func TestTunnelResponse(t *testing.T) {
+	// Test case 1: the body of unknown length is chunked
+	resp := &http.Response{StatusCode: http.StatusOK, ProtoMajor: 2, ContentLength: -1,
+		Request: httptest.NewRequest("GET", "/", nil)}
+	tunnelResponse(resp)
+	assert.Equal(t, 1, resp.ProtoMajor)
+	assert.Equal(t, 1, resp.ProtoMinor)
+	assert.Equal(t, []string{"chunked"}, resp.TransferEncoding)
+	assert.NotNil(t, resp.Trailer)
+
+	// Test case 2: the Content-Length is kept
+	resp = &http.Response{StatusCode: http.StatusOK, ProtoMajor: 1, ProtoMinor: 1, ContentLength: 5,
+		Request: httptest.NewRequest("GET", "/", nil)}
+	tunnelResponse(resp)
+	assert.Empty(t, resp.TransferEncoding)
+
+	// Test case 3: no body
+	resp = &http.Response{StatusCode: http.StatusOK, ProtoMajor: 2, ContentLength: -1,
+		Request: httptest.NewRequest("HEAD", "/", nil)}
+	tunnelResponse(resp)
+	assert.Empty(t, resp.TransferEncoding)
+	resp = &http.Response{StatusCode: http.StatusNotModified, ProtoMajor: 2, ContentLength: -1}
+	tunnelResponse(resp)
+	assert.Empty(t, resp.TransferEncoding)
+}
+
+func TestNewAgentServerPool(t *testing.T) {
+	as, err := NewAgentServerPool("http://localhost:8080", []string{"http://localhost:9090", "localhost:9091"}, "abc123",
+		WithNumWorker(2), WithAgentID(100), WithAgentIDOffset(10))
+	assert.NoError(t, err)
+	assert.Equal(t, 4, as.numWorker)
+	assert.Equal(t, 110, as.agentID)
+	assert.Len(t, as.upstreams.upstreams, 2)
+	assert.Equal(t, "localhost:9090", as.upstreams.upstreams[0].url.Host)
+
+	_, err = NewAgentServerPool("http://localhost:8080", nil, "abc123")
+	assert.Error(t, err)
+	_, err = NewAgentServerPool("http://localhost:8080", []string{"http://localhost:9090", "invalid"}, "abc123")
+	assert.Error(t, err)
+}
@@ -0,0 +1,235 @@
+/*
+Copyright © 2023 Harry C <hoveychen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package hub
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hoveychen/slime/pkg/pool"
+	"github.com/sirupsen/logrus"
+)
+
+type AccessLogFormat string
+
+const (
+	AccessLogJSON AccessLogFormat = "json"
+	// AccessLogCLF is the Common Log Format, followed by the slime specific fields.
+	AccessLogCLF AccessLogFormat = "clf"
+)
+
+// ParseAccessLogFormat parses the access log format by name.
+func ParseAccessLogFormat(s string) (AccessLogFormat, error) {
+	switch format := AccessLogFormat(s); format {
+	case AccessLogJSON, AccessLogCLF:
+		return format, nil
+	}
+	return "", fmt.Errorf("invalid access log format %q", s)
+}
+
+// The outcomes of the application requests.
+const (
+	OutcomeOK            = "ok"
+	OutcomeUnauthorized  = "unauthorized"
+	OutcomeBadRequest    = "bad_request"
+	OutcomeRateLimited   = "rate_limited"
+	OutcomeShed          = "shed"
+	OutcomeNoAgent       = "no_agent"
+	OutcomeTimeout       = "timeout"
+	OutcomeAgentError    = "agent_error"
+	OutcomeUpstreamError = "upstream_error"
+	OutcomeCanceled      = "canceled"
+)
+
+// statusClientClosed is logged for the requests canceled by the applications before any response, as nginx does.
+const statusClientClosed = 499
+
+// AccessLogEntry is the record of a single application request.
+type AccessLogEntry struct {
+	Time      time.Time
+	RequestID string
+	Remote    string
+	Method    string
+	Path      string
+	Proto     string
+	Scope     string
+	// App identifies the application credential without revealing it.
+	App          string
+	AgentName    string
+	AgentID      int
+	QueueWaitMS  float64
+	UpstreamMS   float64
+	DurationMS   float64
+	Status       int
+	Bytes        int64
+	Outcome      string
+	delegateTime time.Time
+}
+
+// WithAccessLog writes an access log entry per application request to the writer.
+func WithAccessLog(w io.Writer, format AccessLogFormat) HubServerOption {
+	return func(hs *HubServer) {
+		hs.accessLog = &accessLogger{w: w, format: format}
+	}
+}
+
+type accessLogger struct {
+	lock   sync.Mutex
+	w      io.Writer
+	format AccessLogFormat
+}
+
+func (l *accessLogger) Write(entry *AccessLogEntry) error {
+	var line []byte
+	switch l.format {
+	case AccessLogCLF:
+		line = []byte(formatCLF(entry))
+	default:
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		line = append(data, '\n')
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	_, err := l.w.Write(line)
+	return err
+}
+
+// formatCLF formats the entry in Common Log Format, with the app as the user, followed by the request ID, scope,
+// agent name and ID, queue wait and upstream time in milliseconds, and outcome.
+func formatCLF(entry *AccessLogEntry) string {
+	host, _, err := net.SplitHostPort(entry.Remote)
+	if err != nil {
+		host = entry.Remote
+	}
+	bytes := "-"
+	if entry.Bytes > 0 {
+		bytes = strconv.FormatInt(entry.Bytes, 10)
+	}
+	return fmt.Sprintf("%s - %s [%s] %q %d %s %q %q %q %d %.1f %.1f %s\n",
+		host, clfField(entry.App), entry.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		entry.Method+" "+entry.Path+" "+entry.Proto, entry.Status, bytes,
+		entry.RequestID, entry.Scope, entry.AgentName, entry.AgentID, entry.QueueWaitMS, entry.UpstreamMS, entry.Outcome)
+}
+
+func clfField(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func newAccessLogEntry(r *http.Request, appKey []byte) *AccessLogEntry {
+	entry := &AccessLogEntry{
+		Time:      time.Now(),
+		RequestID: requestIDOf(r),
+		Remote:    r.RemoteAddr,
+		Method:    r.Method,
+		Path:      r.URL.Path,
+		Proto:     r.Proto,
+		Scope:     r.Header.Get("slime-scope"),
+	}
+	if password := r.Header.Get("slime-app-password"); password != "" {
+		mac := hmac.New(sha256.New, appKey)
+		mac.Write([]byte(password))
+		entry.App = hex.EncodeToString(mac.Sum(nil)[:4])
+	}
+	return entry
+}
+
+// startDelegate records the agent selected for the request.
+func (entry *AccessLogEntry) startDelegate(conn *pool.Connection) {
+	entry.delegateTime = time.Now()
+	entry.AgentName = conn.AgentName()
+	entry.AgentID = conn.AgentID()
+	entry.QueueWaitMS = durationMS(entry.delegateTime.Sub(entry.Time))
+}
+
+func (entry *AccessLogEntry) endDelegate() {
+	entry.UpstreamMS = durationMS(time.Since(entry.delegateTime))
+}
+
+// finishAppRequest completes the entry once the application request is done, records it in the stats and
+// writes the access log if enabled.
+func (hs *HubServer) finishAppRequest(entry *AccessLogEntry, rec *responseRecorder) {
+	entry.DurationMS = durationMS(time.Since(entry.Time))
+	entry.Status = rec.status
+	entry.Bytes = rec.bytes
+	if entry.Status == 0 {
+		if entry.Outcome == OutcomeCanceled {
+			entry.Status = statusClientClosed
+		} else {
+			entry.Status = http.StatusOK
+		}
+	}
+	hs.stats.record(entry)
+	if hs.accessLog == nil {
+		return
+	}
+	if err := hs.accessLog.Write(entry); err != nil {
+		logrus.WithError(err).Error("Failed to write access log")
+	}
+}
+
+func durationMS(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// responseRecorder records the status code and the size of the response.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (rec *responseRecorder) WriteHeader(statusCode int) {
+	if rec.status == 0 {
+		rec.status = statusCode
+	}
+	rec.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	n, err := rec.ResponseWriter.Write(b)
+	rec.bytes += int64(n)
+	return n, err
+}
+
+func (rec *responseRecorder) Flush() {
+	if flusher, ok := rec.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (rec *responseRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
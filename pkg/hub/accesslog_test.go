@@ -0,0 +1,116 @@
+/*
+Copyright © 2023 Harry C <hoveychen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package hub
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAccessLogJSON(t *testing.T) {
+	var buf bytes.Buffer
+	hs := NewHubServer("test-secret", WithAppPassword("pass"), WithAccessLog(&buf, AccessLogJSON))
+
+	req := httptest.NewRequest("GET", "/v1/chat", nil)
+	req.Header.Set("X-Request-Id", "req-1")
+	req.Header.Set("slime-scope", "llm")
+	req.Header.Set("slime-app-password", "pass")
+	hs.ServeHTTP(httptest.NewRecorder(), req)
+
+	var entry AccessLogEntry
+	assert.NoError(t, json.Unmarshal(buf.Bytes(), &entry))
+	assert.Equal(t, "req-1", entry.RequestID)
+	assert.Equal(t, "GET", entry.Method)
+	assert.Equal(t, "/v1/chat", entry.Path)
+	assert.Equal(t, "llm", entry.Scope)
+	assert.Len(t, entry.App, 8)
+	assert.NotContains(t, buf.String(), "pass")
+	assert.Equal(t, http.StatusServiceUnavailable, entry.Status)
+	assert.Equal(t, int64(len("No available agent")), entry.Bytes)
+	assert.Equal(t, OutcomeNoAgent, entry.Outcome)
+
+	// The unauthorized requests are logged as well, with a generated request ID.
+	buf.Reset()
+	hs.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	assert.NoError(t, json.Unmarshal(buf.Bytes(), &entry))
+	assert.NotEmpty(t, entry.RequestID)
+	assert.NotEqual(t, "req-1", entry.RequestID)
+	assert.Equal(t, http.StatusUnauthorized, entry.Status)
+	assert.Equal(t, OutcomeUnauthorized, entry.Outcome)
+}
+
+func TestAccessLogAppIdentity(t *testing.T) {
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("slime-app-password", "pass")
+
+	app := newAccessLogEntry(req, []byte("secret")).App
+	assert.Len(t, app, 8)
+	assert.Equal(t, app, newAccessLogEntry(req, []byte("secret")).App)
+	// Without the secret, the password cannot be guessed from the identity.
+	assert.NotEqual(t, app, newAccessLogEntry(req, []byte("other-secret")).App)
+	sum := sha256.Sum256([]byte("pass"))
+	assert.NotEqual(t, hex.EncodeToString(sum[:4]), app)
+
+	assert.Empty(t, newAccessLogEntry(httptest.NewRequest("GET", "/", nil), []byte("secret")).App)
+}
+
+func TestFormatCLF(t *testing.T) {
+	entry := &AccessLogEntry{
+		Time:        time.Date(2023, 10, 1, 12, 0, 0, 0, time.UTC),
+		RequestID:   "req-1",
+		Remote:      "10.0.0.1:1234",
+		Method:      "POST",
+		Path:        "/v1/chat",
+		Proto:       "HTTP/1.1",
+		Scope:       "llm",
+		AgentName:   "gpu-1",
+		AgentID:     123,
+		QueueWaitMS: 1.5,
+		UpstreamMS:  200,
+		Status:      200,
+		Bytes:       42,
+		Outcome:     OutcomeOK,
+	}
+	assert.Equal(t, `10.0.0.1 - - [01/Oct/2023:12:00:00 +0000] "POST /v1/chat HTTP/1.1" 200 42 "req-1" "llm" "gpu-1" 123 1.5 200.0 ok`+"\n", formatCLF(entry))
+}
+
+func TestParseAccessLogFormat(t *testing.T) {
+	format, err := ParseAccessLogFormat("clf")
+	assert.NoError(t, err)
+	assert.Equal(t, AccessLogCLF, format)
+	_, err = ParseAccessLogFormat("xml")
+	assert.Error(t, err)
+}
+
+func TestResponseRecorder(t *testing.T) {
+	rr := httptest.NewRecorder()
+	rec := &responseRecorder{ResponseWriter: rr}
+	rec.Write([]byte("hello"))
+	rec.WriteHeader(http.StatusTeapot)
+	rec.Flush()
+
+	assert.Equal(t, http.StatusOK, rec.status)
+	assert.Equal(t, int64(5), rec.bytes)
+	assert.True(t, rr.Flushed)
+}
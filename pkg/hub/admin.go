@@ -0,0 +1,129 @@
+/*
+Copyright © 2023 Harry C <hoveychen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package hub
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// WithAdminPassword enables the admin API, authenticated with the password.
+func WithAdminPassword(password string) HubServerOption {
+	return func(hs *HubServer) {
+		hs.adminPassword = password
+	}
+}
+
+// EnrollmentDecision is the body of the admin requests to approve or reject an enrollment.
+type EnrollmentDecision struct {
+	CodeID int64
+}
+
+func (hs *HubServer) handleAdminRequest(w http.ResponseWriter, r *http.Request) {
+	adminLog := logrus.WithFields(logrus.Fields{
+		"remote": r.RemoteAddr,
+		"path":   r.URL.Path,
+	})
+	// The browsers sign in the dashboard with the basic auth, any user name. As the browsers send the cached basic
+	// auth along with the cross-site requests too, it's only accepted to read, and the requests changing the state,
+	// e.g. approving an enrollment, require the admin password header.
+	readOnly := r.Method == http.MethodGet || r.Method == http.MethodHead
+	password := r.Header.Get("slime-admin-password")
+	if password == "" && readOnly {
+		_, password, _ = r.BasicAuth()
+	}
+	if hs.adminPassword == "" || subtle.ConstantTimeCompare([]byte(password), []byte(hs.adminPassword)) != 1 {
+		if readOnly {
+			w.Header().Set("WWW-Authenticate", `Basic realm="slime", charset="UTF-8"`)
+		}
+		hs.replyStatus(w, adminLog, http.StatusUnauthorized, "Unauthorized", "Invalid admin password")
+		return
+	}
+
+	switch {
+	case r.URL.Path == PathAdminEnrollments && r.Method == http.MethodGet:
+		hs.replyJSON(w, hs.Enrollments())
+	case r.URL.Path == PathAdminApprove && r.Method == http.MethodPost:
+		hs.handleEnrollmentDecision(w, r, adminLog, hs.ApproveEnrollment)
+	case r.URL.Path == PathAdminReject && r.Method == http.MethodPost:
+		hs.handleEnrollmentDecision(w, r, adminLog, hs.RejectEnrollment)
+	case r.URL.Path == PathAdminRevoke && r.Method == http.MethodPost:
+		adminLog.Info("Sessions revoked.")
+		hs.replyJSON(w, hs.RevokeSessions())
+	case r.URL.Path == PathAdminStats && r.Method == http.MethodGet:
+		hs.replyJSON(w, hs.Stats())
+	case r.URL.Path == PathAdminDashboard && r.Method == http.MethodGet:
+		hs.handleDashboard(w, r, adminLog)
+	case strings.HasPrefix(r.URL.Path, PathAdminAgents) && r.Method == http.MethodGet:
+		hs.handleTelemetryHistory(w, r, adminLog)
+	default:
+		hs.replyStatus(w, adminLog, http.StatusNotFound, "Not Found", "Unsupported admin API")
+	}
+}
+
+func (hs *HubServer) handleEnrollmentDecision(w http.ResponseWriter, r *http.Request, adminLog *logrus.Entry, decide func(int64) (*Enrollment, error)) {
+	var decision EnrollmentDecision
+	if err := json.NewDecoder(r.Body).Decode(&decision); err != nil {
+		hs.replyStatus(w, adminLog, http.StatusBadRequest, "Bad Request", "Invalid enrollment decision")
+		return
+	}
+	adminLog = adminLog.WithField("codeID", decision.CodeID)
+
+	e, err := decide(decision.CodeID)
+	switch {
+	case errors.Is(err, ErrEnrollmentNotFound):
+		hs.replyStatus(w, adminLog, http.StatusNotFound, "Not Found", err.Error())
+		return
+	case errors.Is(err, ErrEnrollmentDecided):
+		hs.replyStatus(w, adminLog, http.StatusConflict, "Conflict", err.Error())
+		return
+	case err != nil:
+		hs.error(w, adminLog, err, "Failed to decide the enrollment")
+		return
+	}
+	adminLog.WithFields(logrus.Fields{
+		"name":   e.Name,
+		"status": e.Status,
+	}).Info("Enrollment decided.")
+	hs.replyJSON(w, e)
+}
+
+// handleTelemetryHistory replies the telemetry history of the agent at "/v1/admin/agents/{agentID}/telemetry".
+func (hs *HubServer) handleTelemetryHistory(w http.ResponseWriter, r *http.Request, adminLog *logrus.Entry) {
+	rest, ok := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, PathAdminAgents), "/telemetry")
+	agentID, err := strconv.Atoi(rest)
+	if !ok || err != nil {
+		hs.replyStatus(w, adminLog, http.StatusNotFound, "Not Found", "Unsupported admin API")
+		return
+	}
+	history := hs.TelemetryHistory(agentID)
+	if len(history) == 0 {
+		hs.replyStatus(w, adminLog.WithField("agentID", agentID), http.StatusNotFound, "Not Found", "No telemetry of the agent")
+		return
+	}
+	hs.replyJSON(w, history)
+}
+
+func (hs *HubServer) replyJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
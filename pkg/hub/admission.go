@@ -0,0 +1,78 @@
+/*
+Copyright © 2023 Harry C <hoveychen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package hub
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+var (
+	ErrQueueFull    = errors.New("admission queue is full")
+	ErrQueueTimeout = errors.New("admission queue timeout")
+)
+
+// WithQueueTimeout limits how long a request waits for a concurrent slot. 0 waits until the request is canceled.
+func WithQueueTimeout(timeout time.Duration) HubServerOption {
+	return func(hs *HubServer) {
+		hs.queueTimeout = timeout
+	}
+}
+
+// WithMaxQueue limits the number of requests waiting for a concurrent slot. 0 for no limit.
+func WithMaxQueue(n int) HubServerOption {
+	return func(hs *HubServer) {
+		hs.maxQueue = n
+	}
+}
+
+// QueueDepth returns the number of requests waiting for a concurrent slot.
+func (hs *HubServer) QueueDepth() int {
+	return int(hs.queued.Load())
+}
+
+// admitConcurrent takes a concurrent slot, waiting within the limits of the queue.
+// The slot must be returned once the request is done.
+func (hs *HubServer) admitConcurrent(ctx context.Context) error {
+	select {
+	case hs.concurrent <- struct{}{}:
+		return nil
+	default:
+	}
+
+	if depth := hs.queued.Add(1); hs.maxQueue > 0 && depth > int64(hs.maxQueue) {
+		hs.queued.Add(-1)
+		return ErrQueueFull
+	}
+	defer hs.queued.Add(-1)
+
+	var timeout <-chan time.Time
+	if hs.queueTimeout > 0 {
+		timer := time.NewTimer(hs.queueTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case hs.concurrent <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timeout:
+		return ErrQueueTimeout
+	}
+}
@@ -0,0 +1,73 @@
+/*
+Copyright © 2023 Harry C <hoveychen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package hub
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdmitConcurrent(t *testing.T) {
+	hs := NewHubServer("test-secret", WithConcurrent(1), WithMaxQueue(1), WithQueueTimeout(50*time.Millisecond))
+	ctx := context.Background()
+
+	// Test case 1: a free slot is taken right away
+	assert.NoError(t, hs.admitConcurrent(ctx))
+
+	// Test case 2: timeout in the queue
+	assert.ErrorIs(t, hs.admitConcurrent(ctx), ErrQueueTimeout)
+	assert.Equal(t, 0, hs.QueueDepth())
+
+	// Test case 3: the queue is full
+	waiting := make(chan error)
+	go func() {
+		waiting <- hs.admitConcurrent(ctx)
+	}()
+	for hs.QueueDepth() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	assert.ErrorIs(t, hs.admitConcurrent(ctx), ErrQueueFull)
+
+	// Test case 4: the waiting request is admitted once the slot is returned
+	<-hs.concurrent
+	assert.NoError(t, <-waiting)
+	assert.Equal(t, 0, hs.QueueDepth())
+}
+
+func TestAdmitConcurrentCanceled(t *testing.T) {
+	hs := NewHubServer("test-secret", WithConcurrent(1))
+	assert.NoError(t, hs.admitConcurrent(context.Background()))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, hs.admitConcurrent(ctx), context.DeadlineExceeded)
+	assert.Equal(t, 0, hs.QueueDepth())
+}
+
+func TestHandleAppRequestShed(t *testing.T) {
+	hs := NewHubServer("test-secret", WithConcurrent(1), WithQueueTimeout(10*time.Millisecond))
+	hs.concurrent <- struct{}{}
+
+	rr := httptest.NewRecorder()
+	hs.ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+	assert.Equal(t, "Server busy", rr.Body.String())
+}
@@ -2,23 +2,47 @@ package hub
 
 import (
 	"sync"
+	"time"
 
 	"github.com/hoveychen/slime/pkg/hwinfo"
 )
 
+const (
+	defaultTelemetryHistorySize = 120
+	// defaultTelemetryTTL is how long the telemetry is kept. The history of the agents gone expires with it, while
+	// the agents re-polling the hub without joining again keep their hardware info.
+	defaultTelemetryTTL = 10 * time.Minute
+)
+
 type Catalog interface {
 	GetHardwareInfo(agentID int) *hwinfo.HWInfo
 	SetHardwareInfo(agentID int, hwInfo *hwinfo.HWInfo)
 }
 
+// TelemetryCatalog is implemented by the catalogs keeping the telemetry history of the agents. The catalogs given
+// by WithCatalog may implement it optionally.
+type TelemetryCatalog interface {
+	AddTelemetry(agentID int, telemetry *hwinfo.Telemetry)
+	GetTelemetryHistory(agentID int) []*hwinfo.Telemetry
+	GetLatestTelemetry(agentID int) *hwinfo.Telemetry
+}
+
+var _ TelemetryCatalog = (*MemoryCatalog)(nil)
+
 type MemoryCatalog struct {
-	hwInfoMap map[int]*hwinfo.HWInfo
-	mutex     sync.RWMutex
+	hwInfoMap    map[int]*hwinfo.HWInfo
+	telemetryMap map[int][]*hwinfo.Telemetry
+	historySize  int
+	telemetryTTL time.Duration
+	mutex        sync.RWMutex
 }
 
 func NewMemoryCatalog() *MemoryCatalog {
 	return &MemoryCatalog{
-		hwInfoMap: make(map[int]*hwinfo.HWInfo),
+		hwInfoMap:    make(map[int]*hwinfo.HWInfo),
+		telemetryMap: make(map[int][]*hwinfo.Telemetry),
+		historySize:  defaultTelemetryHistorySize,
+		telemetryTTL: defaultTelemetryTTL,
 	}
 }
 
@@ -37,3 +61,54 @@ func (mc *MemoryCatalog) SetHardwareInfo(agentID int, hwInfo *hwinfo.HWInfo) {
 	}
 	mc.hwInfoMap[agentID] = hwInfo
 }
+
+// AddTelemetry appends the telemetry to the agent's history, dropping the oldest one if the history is full.
+// The telemetry without a time is stamped now. The expired telemetry of all the agents is dropped meanwhile.
+func (mc *MemoryCatalog) AddTelemetry(agentID int, telemetry *hwinfo.Telemetry) {
+	now := time.Now()
+	if telemetry.Time.IsZero() {
+		telemetry.Time = now
+	}
+	mc.mutex.Lock()
+	defer mc.mutex.Unlock()
+	for id, history := range mc.telemetryMap {
+		if history = mc.unexpired(history, now); len(history) == 0 {
+			delete(mc.telemetryMap, id)
+		} else {
+			mc.telemetryMap[id] = history
+		}
+	}
+	history := append(mc.telemetryMap[agentID], telemetry)
+	if len(history) > mc.historySize {
+		history = history[len(history)-mc.historySize:]
+	}
+	mc.telemetryMap[agentID] = history
+}
+
+// GetTelemetryHistory returns the agent's unexpired telemetry history, from the oldest to the latest.
+func (mc *MemoryCatalog) GetTelemetryHistory(agentID int) []*hwinfo.Telemetry {
+	mc.mutex.RLock()
+	defer mc.mutex.RUnlock()
+	history := mc.unexpired(mc.telemetryMap[agentID], time.Now())
+	return append([]*hwinfo.Telemetry(nil), history...)
+}
+
+func (mc *MemoryCatalog) GetLatestTelemetry(agentID int) *hwinfo.Telemetry {
+	mc.mutex.RLock()
+	defer mc.mutex.RUnlock()
+	history := mc.unexpired(mc.telemetryMap[agentID], time.Now())
+	if len(history) == 0 {
+		return nil
+	}
+	return history[len(history)-1]
+}
+
+// unexpired returns the tail of the history received within the TTL.
+func (mc *MemoryCatalog) unexpired(history []*hwinfo.Telemetry, now time.Time) []*hwinfo.Telemetry {
+	for i, telemetry := range history {
+		if now.Sub(telemetry.Time) < mc.telemetryTTL {
+			return history[i:]
+		}
+	}
+	return nil
+}
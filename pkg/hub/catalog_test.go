@@ -2,6 +2,7 @@ package hub
 
 import (
 	"testing"
+	"time"
 
 	"github.com/hoveychen/slime/pkg/hwinfo"
 	"github.com/stretchr/testify/assert"
@@ -35,3 +36,35 @@ func TestMemoryCatalog_SetHardwareInfo(t *testing.T) {
 	hwInfo = mc.GetHardwareInfo(123)
 	assert.Equal(t, expectedHWInfo, hwInfo)
 }
+
+func TestMemoryCatalog_Telemetry(t *testing.T) {
+	mc := NewMemoryCatalog()
+	mc.historySize = 3
+
+	// Test case 1: no telemetry
+	assert.Nil(t, mc.GetLatestTelemetry(123))
+	assert.Empty(t, mc.GetTelemetryHistory(123))
+
+	// Test case 2: history is kept in order, and trimmed to the history size
+	for i := 1; i <= 5; i++ {
+		mc.AddTelemetry(123, &hwinfo.Telemetry{InFlight: i})
+	}
+	history := mc.GetTelemetryHistory(123)
+	if assert.Len(t, history, 3) {
+		assert.Equal(t, 3, history[0].InFlight)
+		assert.Equal(t, 5, history[2].InFlight)
+	}
+	assert.Equal(t, 5, mc.GetLatestTelemetry(123).InFlight)
+
+	// Test case 3: other agents are not affected
+	assert.Nil(t, mc.GetLatestTelemetry(456))
+
+	// Test case 4: the expired telemetry is dropped, e.g. of the agents gone
+	mc.telemetryTTL = time.Minute
+	mc.AddTelemetry(789, &hwinfo.Telemetry{Time: time.Now().Add(-2 * time.Minute), InFlight: 1})
+	assert.Nil(t, mc.GetLatestTelemetry(789))
+	assert.Empty(t, mc.GetTelemetryHistory(789))
+	mc.AddTelemetry(123, &hwinfo.Telemetry{InFlight: 6})
+	assert.NotContains(t, mc.telemetryMap, 789)
+	assert.Equal(t, 6, mc.GetLatestTelemetry(123).InFlight)
+}
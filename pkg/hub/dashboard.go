@@ -0,0 +1,57 @@
+/*
+Copyright © 2023 Harry C <hoveychen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package hub
+
+import (
+	_ "embed"
+	"html/template"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/hoveychen/slime/pkg/hwinfo"
+	"github.com/sirupsen/logrus"
+)
+
+// dashboardRefresh is how often the dashboard page reloads itself.
+const dashboardRefresh = 5 * time.Second
+
+//go:embed dashboard.html
+var dashboardHTML string
+
+var dashboardTemplate = template.Must(template.New("dashboard").Funcs(template.FuncMap{
+	"gpus": countGPUs,
+	"hardware": func(info *hwinfo.HWInfo) string {
+		if info == nil {
+			return "-"
+		}
+		return strings.TrimSpace(info.PlatformOS + "/" + info.PlatformArch + " " + strings.Join(info.GPUNames, ", "))
+	},
+	"since": func(t time.Time) string {
+		return time.Since(t).Truncate(time.Second).String()
+	},
+	"refresh": func() int {
+		return int(dashboardRefresh.Seconds())
+	},
+}).Parse(dashboardHTML))
+
+func (hs *HubServer) handleDashboard(w http.ResponseWriter, r *http.Request, adminLog *logrus.Entry) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := dashboardTemplate.Execute(w, hs.Stats()); err != nil {
+		adminLog.WithError(err).Error("Failed to render the dashboard")
+	}
+}
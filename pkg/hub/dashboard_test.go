@@ -0,0 +1,118 @@
+/*
+Copyright © 2023 Harry C <hoveychen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package hub
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/hoveychen/slime/pkg/hwinfo"
+	"github.com/hoveychen/slime/pkg/pool"
+	"github.com/hoveychen/slime/pkg/token"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDashboard(t *testing.T) {
+	catalog := NewMemoryCatalog()
+	hs := NewHubServer("test-secret", WithAdminPassword("admin"), WithCatalog(catalog))
+	hs.connPool.AddConnection(pool.NewConnection(1, &token.AgentToken{Name: "gpu-<1>"}))
+	catalog.SetHardwareInfo(1, &hwinfo.HWInfo{GPUNames: []string{"NVIDIA A100"}, Fingerprint: "machine-1"})
+
+	serve := func(path string, setAuth func(*http.Request)) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		setAuth(req)
+		rr := httptest.NewRecorder()
+		hs.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// Test case 1: the browser is asked to sign in
+	rr := serve(PathAdminDashboard, func(r *http.Request) {})
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	assert.Contains(t, rr.Header().Get("WWW-Authenticate"), "Basic")
+
+	rr = serve(PathAdminDashboard, func(r *http.Request) { r.SetBasicAuth("admin", "wrong") })
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+
+	// Test case 2: the dashboard with the basic auth
+	rr = serve(PathAdminDashboard, func(r *http.Request) { r.SetBasicAuth("", "admin") })
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Header().Get("Content-Type"), "text/html")
+	assert.Contains(t, rr.Body.String(), "gpu-&lt;1&gt;")
+	assert.Contains(t, rr.Body.String(), "NVIDIA A100")
+	assert.Contains(t, rr.Body.String(), `http-equiv="refresh"`)
+
+	// Test case 3: the stats with the admin password header
+	rr = serve(PathAdminStats, func(r *http.Request) { r.Header.Set("slime-admin-password", "admin") })
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var stats DashboardStats
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &stats))
+	if assert.Len(t, stats.Agents, 1) {
+		assert.Equal(t, "gpu-<1>", stats.Agents[0].AgentName)
+		assert.False(t, stats.Agents[0].Processing)
+	}
+	assert.Equal(t, 1, stats.GPUs)
+
+	// Test case 4: the basic auth can't change the state, e.g. from a cross-site form
+	rr = serve(PathAdminEnrollments, func(r *http.Request) { r.SetBasicAuth("", "admin") })
+	assert.Equal(t, http.StatusOK, rr.Code)
+	req := httptest.NewRequest("POST", PathAdminApprove, strings.NewReader(`{"CodeID":1}`))
+	req.SetBasicAuth("", "admin")
+	rr = httptest.NewRecorder()
+	hs.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	assert.Empty(t, rr.Header().Get("WWW-Authenticate"))
+}
+
+func TestDashboardDisabled(t *testing.T) {
+	hs := NewHubServer("test-secret")
+
+	// Without the admin password, the admin paths are application requests.
+	rr := httptest.NewRecorder()
+	hs.ServeHTTP(rr, httptest.NewRequest("GET", PathAdminDashboard, nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+}
+
+func TestAdminTelemetryHistory(t *testing.T) {
+	catalog := NewMemoryCatalog()
+	hs := NewHubServer("test-secret", WithAdminPassword("admin"), WithCatalog(catalog))
+	catalog.AddTelemetry(1, &hwinfo.Telemetry{InFlight: 0})
+	catalog.AddTelemetry(1, &hwinfo.Telemetry{InFlight: 1})
+
+	serve := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("slime-admin-password", "admin")
+		rr := httptest.NewRecorder()
+		hs.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := serve(PathAdminAgents + "1/telemetry")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var history []*hwinfo.Telemetry
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &history))
+	if assert.Len(t, history, 2) {
+		assert.Equal(t, 1, history[1].InFlight)
+	}
+
+	// Unknown agent and malformed path.
+	assert.Equal(t, http.StatusNotFound, serve(PathAdminAgents+"2/telemetry").Code)
+	assert.Equal(t, http.StatusNotFound, serve(PathAdminAgents+"abc/telemetry").Code)
+	assert.Equal(t, http.StatusNotFound, serve(PathAdminAgents+"1").Code)
+}
@@ -0,0 +1,200 @@
+/*
+Copyright © 2023 Harry C <hoveychen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package hub
+
+import (
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/hoveychen/slime/pkg/hwinfo"
+	"github.com/hoveychen/slime/pkg/token"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/proto"
+)
+
+var (
+	ErrEnrollmentNotFound = errors.New("enrollment not found")
+	ErrEnrollmentDecided  = errors.New("enrollment already decided")
+)
+
+type EnrollmentStatus string
+
+const (
+	EnrollmentPending  EnrollmentStatus = "pending"
+	EnrollmentApproved EnrollmentStatus = "approved"
+	EnrollmentRejected EnrollmentStatus = "rejected"
+)
+
+// EnrollRequest is sent by the agent with the enrollment code, to enroll or to poll the enrollment status.
+type EnrollRequest struct {
+	// ID is generated by the agent, and kept secret to poll the enrollment.
+	ID           string
+	Name         string
+	HardwareInfo *hwinfo.HWInfo
+}
+
+type EnrollResponse struct {
+	Status EnrollmentStatus
+	// Token is the issued agent token, once approved.
+	Token string `json:",omitempty"`
+}
+
+// Enrollment is an agent enrolled with a one-time enrollment code. It's identified by the code ID.
+type Enrollment struct {
+	CodeID       int64
+	Name         string
+	Remote       string
+	HardwareInfo *hwinfo.HWInfo
+	Status       EnrollmentStatus
+	CreatedAt    time.Time
+	DecidedAt    time.Time
+
+	requestID string
+	code      *token.AgentToken
+	token     string
+}
+
+// Enrollments returns the enrollments in the order of arrival.
+func (hs *HubServer) Enrollments() []*Enrollment {
+	hs.enrollLock.Lock()
+	defer hs.enrollLock.Unlock()
+
+	var enrollments []*Enrollment
+	for _, e := range hs.enrollments {
+		copied := *e
+		enrollments = append(enrollments, &copied)
+	}
+	sort.Slice(enrollments, func(i, j int) bool {
+		return enrollments[i].CreatedAt.Before(enrollments[j].CreatedAt)
+	})
+	return enrollments
+}
+
+// ApproveEnrollment issues the agent token for the pending enrollment, scoped as the enrollment code.
+func (hs *HubServer) ApproveEnrollment(codeID int64) (*Enrollment, error) {
+	hs.enrollLock.Lock()
+	defer hs.enrollLock.Unlock()
+
+	e, ok := hs.enrollments[codeID]
+	if !ok {
+		return nil, ErrEnrollmentNotFound
+	}
+	if e.Status != EnrollmentPending {
+		return nil, ErrEnrollmentDecided
+	}
+
+	agentToken := proto.Clone(e.code).(*token.AgentToken)
+	agentToken.Id = rand.Int63()
+	agentToken.Enrollment = false
+	agentToken.ExpireAt = 0
+	agentToken.TokenAge = 0
+	agentToken.IssuedAt = time.Now().Unix()
+	if agentToken.Name == "" {
+		agentToken.Name = e.Name
+	}
+	if age := e.code.GetTokenAge(); age > 0 {
+		agentToken.ExpireAt = time.Now().Add(time.Duration(age) * time.Second).Unix()
+	}
+	encrypted, err := hs.tokenMgr.Encrypt(agentToken)
+	if err != nil {
+		return nil, err
+	}
+
+	e.token = encrypted
+	e.Status = EnrollmentApproved
+	e.DecidedAt = time.Now()
+	copied := *e
+	return &copied, nil
+}
+
+// RejectEnrollment rejects the pending enrollment. The enrollment code can't be used again.
+func (hs *HubServer) RejectEnrollment(codeID int64) (*Enrollment, error) {
+	hs.enrollLock.Lock()
+	defer hs.enrollLock.Unlock()
+
+	e, ok := hs.enrollments[codeID]
+	if !ok {
+		return nil, ErrEnrollmentNotFound
+	}
+	if e.Status != EnrollmentPending {
+		return nil, ErrEnrollmentDecided
+	}
+	e.Status = EnrollmentRejected
+	e.DecidedAt = time.Now()
+	copied := *e
+	return &copied, nil
+}
+
+func (hs *HubServer) handleAgentEnroll(w http.ResponseWriter, r *http.Request) {
+	agentLog := logrus.WithField("remote", r.RemoteAddr)
+	code, err := hs.tokenMgr.Decrypt(r.Header.Get("slime-enrollment-code"))
+	if err != nil || !code.GetEnrollment() {
+		hs.replyStatus(w, agentLog, http.StatusUnauthorized, "Unauthorized", "Invalid enrollment code")
+		return
+	}
+	agentLog = agentLog.WithField("codeID", code.GetId())
+
+	var req EnrollRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ID == "" {
+		hs.replyStatus(w, agentLog, http.StatusBadRequest, "Bad Request", "Invalid enrollment request")
+		return
+	}
+
+	hs.enrollLock.Lock()
+	e, ok := hs.enrollments[code.GetId()]
+	if !ok {
+		if code.GetExpireAt() > 0 && time.Now().After(time.Unix(code.GetExpireAt(), 0)) {
+			hs.enrollLock.Unlock()
+			hs.replyStatus(w, agentLog, http.StatusUnauthorized, "Unauthorized", "Enrollment code expired")
+			return
+		}
+		e = &Enrollment{
+			CodeID:       code.GetId(),
+			Name:         req.Name,
+			Remote:       r.RemoteAddr,
+			HardwareInfo: req.HardwareInfo,
+			Status:       EnrollmentPending,
+			CreatedAt:    time.Now(),
+			requestID:    req.ID,
+			code:         code,
+		}
+		if hs.enrollments == nil {
+			hs.enrollments = make(map[int64]*Enrollment)
+		}
+		hs.enrollments[code.GetId()] = e
+		agentLog.WithField("name", req.Name).Info("Agent is waiting for enrollment approval.")
+	}
+	if e.requestID != req.ID {
+		hs.enrollLock.Unlock()
+		hs.replyStatus(w, agentLog, http.StatusConflict, "Conflict", "Enrollment code already used")
+		return
+	}
+	resp := EnrollResponse{Status: e.Status, Token: e.token}
+	hs.enrollLock.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	switch resp.Status {
+	case EnrollmentPending:
+		w.WriteHeader(http.StatusAccepted)
+	case EnrollmentRejected:
+		w.WriteHeader(http.StatusForbidden)
+	}
+	json.NewEncoder(w).Encode(&resp)
+}
@@ -0,0 +1,128 @@
+/*
+Copyright © 2023 Harry C <hoveychen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package hub
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hoveychen/slime/pkg/token"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEnrollment(t *testing.T) {
+	hs := NewHubServer("test-secret", WithAdminPassword("admin"))
+	tokenMgr := token.NewTokenManager([]byte("test-secret"))
+	code, _ := tokenMgr.Encrypt(&token.AgentToken{Id: 1, Scopes: []string{"llm"}, Enrollment: true, TokenAge: 3600})
+
+	enroll := func(code, id string) (int, *EnrollResponse) {
+		req := httptest.NewRequest("POST", PathEnroll, strings.NewReader(`{"ID":"`+id+`","Name":"volunteer"}`))
+		req.Header.Set("slime-enrollment-code", code)
+		rr := httptest.NewRecorder()
+		hs.ServeHTTP(rr, req)
+		var resp EnrollResponse
+		json.NewDecoder(rr.Body).Decode(&resp)
+		return rr.Code, &resp
+	}
+	admin := func(method, path, password, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("slime-admin-password", password)
+		rr := httptest.NewRecorder()
+		hs.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// Test case 1: the agent is pending, and the code is bound to it
+	status, resp := enroll(code, "secret-id")
+	assert.Equal(t, http.StatusAccepted, status)
+	assert.Equal(t, EnrollmentPending, resp.Status)
+	status, _ = enroll(code, "another-id")
+	assert.Equal(t, http.StatusConflict, status)
+
+	// Test case 2: the enrollment code can't be used as an agent token
+	req := httptest.NewRequest("POST", PathJoin, strings.NewReader("{}"))
+	req.Header.Set("slime-agent-token", code)
+	req.Header.Set("slime-agent-id", "123")
+	rr := httptest.NewRecorder()
+	hs.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+
+	// Test case 3: the admin lists and approves the enrollment
+	assert.Equal(t, http.StatusUnauthorized, admin("GET", PathAdminEnrollments, "wrong", "").Code)
+	rr = admin("GET", PathAdminEnrollments, "admin", "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var enrollments []*Enrollment
+	assert.NoError(t, json.NewDecoder(rr.Body).Decode(&enrollments))
+	if assert.Len(t, enrollments, 1) {
+		assert.Equal(t, int64(1), enrollments[0].CodeID)
+		assert.Equal(t, "volunteer", enrollments[0].Name)
+	}
+	assert.Equal(t, http.StatusOK, admin("POST", PathAdminApprove, "admin", `{"CodeID":1}`).Code)
+	assert.Equal(t, http.StatusConflict, admin("POST", PathAdminReject, "admin", `{"CodeID":1}`).Code)
+	assert.Equal(t, http.StatusNotFound, admin("POST", PathAdminApprove, "admin", `{"CodeID":2}`).Code)
+
+	// Test case 4: the agent gets the scoped agent token
+	status, resp = enroll(code, "secret-id")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, EnrollmentApproved, resp.Status)
+	tok, err := tokenMgr.Decrypt(resp.Token)
+	if assert.NoError(t, err) {
+		assert.False(t, tok.Enrollment)
+		assert.NotEqual(t, int64(1), tok.Id)
+		assert.Equal(t, "volunteer", tok.Name)
+		assert.Equal(t, []string{"llm"}, tok.Scopes)
+		assert.InDelta(t, time.Now().Add(time.Hour).Unix(), tok.ExpireAt, 2)
+	}
+}
+
+func TestEnrollmentRejected(t *testing.T) {
+	hs := NewHubServer("test-secret")
+	tokenMgr := token.NewTokenManager([]byte("test-secret"))
+	code, _ := tokenMgr.Encrypt(&token.AgentToken{Id: 1, Enrollment: true})
+	expired, _ := tokenMgr.Encrypt(&token.AgentToken{Id: 2, Enrollment: true, ExpireAt: time.Now().Add(-time.Second).Unix()})
+	agentToken, _ := tokenMgr.Encrypt(&token.AgentToken{Id: 3})
+
+	enroll := func(code string) int {
+		req := httptest.NewRequest("POST", PathEnroll, strings.NewReader(`{"ID":"secret-id"}`))
+		req.Header.Set("slime-enrollment-code", code)
+		rr := httptest.NewRecorder()
+		hs.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, enroll(expired))
+	assert.Equal(t, http.StatusUnauthorized, enroll(agentToken))
+
+	assert.Equal(t, http.StatusAccepted, enroll(code))
+	_, err := hs.RejectEnrollment(1)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusForbidden, enroll(code))
+	_, err = hs.ApproveEnrollment(1)
+	assert.ErrorIs(t, err, ErrEnrollmentDecided)
+}
+
+func TestAdminDisabled(t *testing.T) {
+	hs := NewHubServer("test-secret")
+	req := httptest.NewRequest("GET", PathAdminEnrollments, nil)
+	req.Header.Set("slime-admin-password", "guess")
+	rr := httptest.NewRecorder()
+	hs.handleAdminRequest(rr, req)
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+}
@@ -0,0 +1,93 @@
+/*
+Copyright © 2023 Harry C <hoveychen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package hub
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/sirupsen/logrus"
+)
+
+// The codes of the errors replied by slime rather than the upstreams, given in the Slime-Error header and the JSON
+// error body.
+const (
+	ErrorUnauthorized        = "unauthorized"
+	ErrorBadRequest          = "bad_request"
+	ErrorRateLimited         = "rate_limited"
+	ErrorServerBusy          = "server_busy"
+	ErrorNoAgent             = "no_agent"
+	ErrorTimeout             = "timeout"
+	ErrorAgentFailure        = "agent_failure"
+	ErrorUpstreamUnavailable = "upstream_unavailable"
+	ErrorUpstreamTimeout     = "upstream_timeout"
+)
+
+// ErrorBody is the JSON body of the errors replied by slime.
+type ErrorBody struct {
+	Error ErrorDetail `json:"error"`
+}
+
+type ErrorDetail struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// WithJSONErrors replies the errors made by slime with a JSON body, instead of a plain text one.
+func WithJSONErrors(enable bool) HubServerOption {
+	return func(hs *HubServer) {
+		hs.jsonErrors = enable
+	}
+}
+
+// upstreamError is the failure of the upstream reported by the agent, with the slime error code.
+type upstreamError struct {
+	code string
+}
+
+func (e *upstreamError) Error() string {
+	return "upstream failed: " + e.code
+}
+
+func (e *upstreamError) StatusCode() int {
+	if e.code == ErrorUpstreamTimeout {
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
+
+// replyError replies an error made by slime to the application, tagged with the error code.
+func (hs *HubServer) replyError(w http.ResponseWriter, log *logrus.Entry, statusCode int, code, statusMsg, explainMsg string) {
+	w.Header().Set("Slime-Error", code)
+	if !hs.jsonErrors {
+		hs.replyStatus(w, log, statusCode, statusMsg, explainMsg)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(&ErrorBody{
+		Error: ErrorDetail{
+			Code:      code,
+			Message:   statusMsg,
+			RequestID: w.Header().Get("X-Request-Id"),
+		},
+	})
+	if log != nil {
+		log.Warn(explainMsg)
+	}
+}
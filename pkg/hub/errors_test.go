@@ -0,0 +1,128 @@
+/*
+Copyright © 2023 Harry C <hoveychen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package hub
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/hoveychen/slime/pkg/pool"
+	"github.com/hoveychen/slime/pkg/token"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReplyError(t *testing.T) {
+	// Test case 1: plain text
+	hs := NewHubServer("test-secret")
+	rr := httptest.NewRecorder()
+	hs.replyError(rr, nil, http.StatusServiceUnavailable, ErrorNoAgent, "No available agent", "No available agent")
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+	assert.Equal(t, ErrorNoAgent, rr.Header().Get("Slime-Error"))
+	assert.Equal(t, "No available agent", rr.Body.String())
+
+	// Test case 2: JSON
+	hs = NewHubServer("test-secret", WithJSONErrors(true))
+	rr = httptest.NewRecorder()
+	rr.Header().Set("X-Request-Id", "req-1")
+	hs.replyError(rr, nil, http.StatusServiceUnavailable, ErrorNoAgent, "No available agent", "No available agent")
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+	assert.Equal(t, ErrorNoAgent, rr.Header().Get("Slime-Error"))
+	assert.Equal(t, "application/json", rr.Header().Get("Content-Type"))
+	var body ErrorBody
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &body))
+	assert.Equal(t, ErrorDetail{Code: ErrorNoAgent, Message: "No available agent", RequestID: "req-1"}, body.Error)
+}
+
+func TestAppRequestErrors(t *testing.T) {
+	hs := NewHubServer("test-secret", WithJSONErrors(true))
+
+	// serve delegates an application request to a new agent connection, which acts as the agent.
+	serve := func(agent func(conn *pool.Connection)) *httptest.ResponseRecorder {
+		conn := pool.NewConnection(1, &token.AgentToken{Name: "test-agent"})
+		hs.connPool.AddConnection(conn)
+		go func() {
+			conn.Accept(context.Background())
+			agent(conn)
+		}()
+		rr := httptest.NewRecorder()
+		hs.ServeHTTP(rr, httptest.NewRequest("GET", "/v1/chat", nil))
+		return rr
+	}
+	// submit submits the raw response to the hub as the agent.
+	submit := func(conn *pool.Connection, resp string) {
+		req := httptest.NewRequest("POST", PathSubmit, strings.NewReader(resp))
+		req.Header.Set("slime-connection-id", strconv.Itoa(conn.ID()))
+		req = req.WithContext(token.NewContext(req.Context(), &token.AgentToken{Name: "test-agent"}))
+		hs.handleAgentSubmit(httptest.NewRecorder(), req)
+	}
+	errorCode := func(rr *httptest.ResponseRecorder) string {
+		var body ErrorBody
+		assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &body))
+		return body.Error.Code
+	}
+
+	// Test case 1: no agent
+	rr := httptest.NewRecorder()
+	hs.ServeHTTP(rr, httptest.NewRequest("GET", "/v1/chat", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+	assert.Equal(t, ErrorNoAgent, errorCode(rr))
+
+	// Test case 2: the upstream is unreachable
+	rr = serve(func(conn *pool.Connection) {
+		submit(conn, "HTTP/1.1 502 Bad Gateway\r\nSlime-Upstream-Error: upstream_unavailable\r\nContent-Length: 0\r\n\r\n")
+	})
+	assert.Equal(t, http.StatusBadGateway, rr.Code)
+	assert.Equal(t, ErrorUpstreamUnavailable, rr.Header().Get("Slime-Error"))
+	assert.Equal(t, ErrorUpstreamUnavailable, errorCode(rr))
+
+	// Test case 3: the upstream timed out
+	rr = serve(func(conn *pool.Connection) {
+		submit(conn, "HTTP/1.1 504 Gateway Timeout\r\nSlime-Upstream-Error: upstream_timeout\r\nContent-Length: 0\r\n\r\n")
+	})
+	assert.Equal(t, http.StatusGatewayTimeout, rr.Code)
+	assert.Equal(t, ErrorUpstreamTimeout, errorCode(rr))
+
+	// Test case 4: the errors of the upstream are passed through
+	rr = serve(func(conn *pool.Connection) {
+		submit(conn, "HTTP/1.1 500 Internal Server Error\r\nContent-Length: 4\r\n\r\noops")
+	})
+	assert.Equal(t, http.StatusInternalServerError, rr.Code)
+	assert.Empty(t, rr.Header().Get("Slime-Error"))
+	assert.Equal(t, "oops", rr.Body.String())
+
+	// Test case 5: the agent failed before the response
+	rr = serve(func(conn *pool.Connection) {
+		submit(conn, "garbage")
+	})
+	assert.Equal(t, http.StatusBadGateway, rr.Code)
+	assert.Equal(t, ErrorAgentFailure, errorCode(rr))
+
+	// Test case 6: the agent failed in the middle of the response
+	assert.PanicsWithValue(t, http.ErrAbortHandler, func() {
+		serve(func(conn *pool.Connection) {
+			w, _ := conn.NewSubmitter()
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte("partial"))
+			conn.Close(errors.New("agent gone"))
+		})
+	})
+}
@@ -0,0 +1,213 @@
+/*
+Copyright © 2023 Harry C <hoveychen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package hub
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/hoveychen/slime/pkg/pool"
+)
+
+// ForwardedHeadersMode is how the X-Forwarded-* headers are set on the requests forwarded to the agents.
+type ForwardedHeadersMode string
+
+const (
+	// ForwardedAppend appends the client to the X-Forwarded-For, and keeps the X-Forwarded-Proto and
+	// X-Forwarded-Host set by the proxies in front of the hub.
+	ForwardedAppend ForwardedHeadersMode = "append"
+	// ForwardedReplace discards the X-Forwarded-* headers given by the client, when the hub faces the internet.
+	ForwardedReplace ForwardedHeadersMode = "replace"
+	// ForwardedOff leaves the X-Forwarded-* headers untouched.
+	ForwardedOff ForwardedHeadersMode = "off"
+)
+
+// ParseForwardedHeadersMode parses the X-Forwarded-* headers mode by name.
+func ParseForwardedHeadersMode(s string) (ForwardedHeadersMode, error) {
+	switch mode := ForwardedHeadersMode(s); mode {
+	case ForwardedAppend, ForwardedReplace, ForwardedOff:
+		return mode, nil
+	}
+	return "", fmt.Errorf("invalid forwarded headers mode %q", s)
+}
+
+// WithStripHeaders sets whether the hop-by-hop headers and the slime control headers are stripped from the
+// forwarded requests and the responses. Enabled by default.
+func WithStripHeaders(strip bool) HubServerOption {
+	return func(hs *HubServer) {
+		hs.stripHeaders = strip
+	}
+}
+
+// WithForwardedHeaders sets how the X-Forwarded-* headers are set on the forwarded requests.
+// Defaults to ForwardedAppend.
+func WithForwardedHeaders(mode ForwardedHeadersMode) HubServerOption {
+	return func(hs *HubServer) {
+		hs.forwardedHeaders = mode
+	}
+}
+
+// hopByHopHeaders are meaningful only for a single connection, and must not be forwarded by proxies.
+// The list follows the one of net/http/httputil.ReverseProxy, except the Trailer, which announces the end-to-end
+// trailers passed through.
+var hopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"TE",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopByHopHeaders removes the hop-by-hop headers, including the ones listed in the Connection header.
+func removeHopByHopHeaders(h http.Header) {
+	for _, value := range h.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopByHopHeaders {
+		h.Del(name)
+	}
+}
+
+// removeControlHeaders removes the slime-* headers, which control the hub and never reach the other side,
+// e.g. the application password.
+func removeControlHeaders(h http.Header) {
+	for name := range h {
+		if strings.HasPrefix(strings.ToLower(name), "slime-") {
+			delete(h, name)
+		}
+	}
+}
+
+// prepareForward cleans up the headers of the application request before it's forwarded to the agent.
+func (hs *HubServer) prepareForward(r *http.Request) {
+	if hs.stripHeaders {
+		// The upstreams like gRPC require "TE: trailers", telling that the trailers are passed through.
+		teTrailers := hasToken(r.Header.Values("TE"), "trailers")
+		removeHopByHopHeaders(r.Header)
+		removeControlHeaders(r.Header)
+		if teTrailers {
+			r.Header.Set("TE", "trailers")
+		}
+	}
+
+	if hs.forwardedHeaders == "" || hs.forwardedHeaders == ForwardedOff {
+		return
+	}
+	if hs.forwardedHeaders == ForwardedReplace {
+		r.Header.Del("X-Forwarded-For")
+		r.Header.Del("X-Forwarded-Proto")
+		r.Header.Del("X-Forwarded-Host")
+	}
+	if clientIP, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		if prior := r.Header.Values("X-Forwarded-For"); len(prior) > 0 {
+			clientIP = strings.Join(prior, ", ") + ", " + clientIP
+		}
+		r.Header.Set("X-Forwarded-For", clientIP)
+	}
+	if r.Header.Get("X-Forwarded-Proto") == "" {
+		proto := "http"
+		if r.TLS != nil {
+			proto = "https"
+		}
+		r.Header.Set("X-Forwarded-Proto", proto)
+	}
+	if r.Header.Get("X-Forwarded-Host") == "" && r.Host != "" {
+		r.Header.Set("X-Forwarded-Host", r.Host)
+	}
+}
+
+// copyResponseHeader copies the headers of the upstream response to the application.
+func (hs *HubServer) copyResponseHeader(dst, src http.Header) {
+	for k, v := range src {
+		dst[k] = v
+	}
+	if hs.stripHeaders {
+		removeHopByHopHeaders(dst)
+		removeControlHeaders(dst)
+	}
+}
+
+// announceTrailers declares the trailers of the upstream response known ahead, before the header is written.
+// http.ReadResponse takes the Trailer header of a chunked response into its Trailer, so it's declared again from
+// there, unless the header still carries the announcement.
+func announceTrailers(dst, trailer http.Header) {
+	if len(trailer) == 0 || dst.Get("Trailer") != "" {
+		return
+	}
+	names := make([]string, 0, len(trailer))
+	for name := range trailer {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	dst.Set("Trailer", strings.Join(names, ", "))
+}
+
+// copyTrailers sends the trailers of the upstream response, including the ones not declared ahead, once the body
+// is written.
+func copyTrailers(dst, trailer http.Header) {
+	for name, values := range trailer {
+		dst[http.TrailerPrefix+name] = values
+	}
+}
+
+// copyResponseBody copies the body of the upstream response to the application. The body of unknown length, e.g.
+// the server-sent events, is flushed as it comes.
+func copyResponseBody(dst *pool.WriteCloser, resp *http.Response) error {
+	if resp.ContentLength >= 0 {
+		_, err := io.Copy(dst, resp.Body)
+		return err
+	}
+	dst.Flush()
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := resp.Body.Read(buf)
+		if n > 0 {
+			if _, err := dst.Write(buf[:n]); err != nil {
+				return err
+			}
+			dst.Flush()
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// hasToken reports whether the comma-separated header values contain the token, case-insensitively.
+func hasToken(values []string, token string) bool {
+	for _, value := range values {
+		for _, t := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,170 @@
+/*
+Copyright © 2023 Harry C <hoveychen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package hub
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/hoveychen/slime/pkg/pool"
+	"github.com/hoveychen/slime/pkg/token"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseForwardedHeadersMode(t *testing.T) {
+	mode, err := ParseForwardedHeadersMode("replace")
+	assert.NoError(t, err)
+	assert.Equal(t, ForwardedReplace, mode)
+	_, err = ParseForwardedHeadersMode("on")
+	assert.Error(t, err)
+}
+
+func TestRemoveHopByHopHeaders(t *testing.T) {
+	h := http.Header{}
+	h.Set("Connection", "keep-alive, X-Custom-Hop")
+	h.Set("Keep-Alive", "timeout=5")
+	h.Set("TE", "trailers")
+	h.Set("Upgrade", "websocket")
+	h.Set("X-Custom-Hop", "1")
+	h.Set("Content-Type", "application/json")
+	h.Set("Trailer", "Grpc-Status")
+
+	// The trailers are end-to-end, and so is their announcement.
+	removeHopByHopHeaders(h)
+	assert.Equal(t, http.Header{"Content-Type": {"application/json"}, "Trailer": {"Grpc-Status"}}, h)
+}
+
+func TestPrepareForward(t *testing.T) {
+	newRequest := func() *http.Request {
+		r := httptest.NewRequest("POST", "http://hub.example.com/v1/chat", nil)
+		r.RemoteAddr = "192.0.2.1:1234"
+		r.Header.Set("slime-app-password", "pass")
+		r.Header.Set("Slime-Scope", "llm")
+		r.Header.Set("Connection", "close")
+		r.Header.Set("X-Forwarded-For", "198.51.100.1")
+		r.Header.Set("X-Forwarded-Proto", "https")
+		r.Header.Set("Authorization", "Bearer app")
+		return r
+	}
+
+	// Test case 1: by default
+	hs := NewHubServer("test-secret")
+	r := newRequest()
+	hs.prepareForward(r)
+	assert.Empty(t, r.Header.Get("slime-app-password"))
+	assert.Empty(t, r.Header.Get("slime-scope"))
+	assert.Empty(t, r.Header.Get("Connection"))
+	assert.Equal(t, "Bearer app", r.Header.Get("Authorization"))
+	assert.Equal(t, "198.51.100.1, 192.0.2.1", r.Header.Get("X-Forwarded-For"))
+	assert.Equal(t, "https", r.Header.Get("X-Forwarded-Proto"))
+	assert.Equal(t, "hub.example.com", r.Header.Get("X-Forwarded-Host"))
+
+	// Test case 2: replace the headers given by the clients
+	hs = NewHubServer("test-secret", WithForwardedHeaders(ForwardedReplace))
+	r = newRequest()
+	r.TLS = &tls.ConnectionState{}
+	hs.prepareForward(r)
+	assert.Equal(t, "192.0.2.1", r.Header.Get("X-Forwarded-For"))
+	assert.Equal(t, "https", r.Header.Get("X-Forwarded-Proto"))
+
+	r = newRequest()
+	hs.prepareForward(r)
+	assert.Equal(t, "http", r.Header.Get("X-Forwarded-Proto"))
+
+	// Test case 3: disabled
+	hs = NewHubServer("test-secret", WithStripHeaders(false), WithForwardedHeaders(ForwardedOff))
+	r = newRequest()
+	hs.prepareForward(r)
+	assert.Equal(t, "pass", r.Header.Get("slime-app-password"))
+	assert.Equal(t, "close", r.Header.Get("Connection"))
+	assert.Equal(t, "198.51.100.1", r.Header.Get("X-Forwarded-For"))
+	assert.Empty(t, r.Header.Get("X-Forwarded-Host"))
+}
+
+func TestForwardTETrailers(t *testing.T) {
+	hs := NewHubServer("test-secret")
+	r := httptest.NewRequest("POST", "/v1/chat", nil)
+	r.Header.Set("TE", "trailers, deflate")
+	hs.prepareForward(r)
+	assert.Equal(t, "trailers", r.Header.Get("TE"))
+
+	r = httptest.NewRequest("POST", "/v1/chat", nil)
+	r.Header.Set("TE", "deflate")
+	hs.prepareForward(r)
+	assert.Empty(t, r.Header.Get("TE"))
+}
+
+func TestCopyTrailers(t *testing.T) {
+	trailer := http.Header{"Grpc-Status": nil, "Grpc-Message": nil}
+	h := http.Header{}
+	announceTrailers(h, trailer)
+	assert.Equal(t, "Grpc-Message, Grpc-Status", h.Get("Trailer"))
+
+	trailer.Set("Grpc-Status", "0")
+	trailer.Set("X-Checksum", "abc")
+	copyTrailers(h, trailer)
+	assert.Equal(t, []string{"0"}, h[http.TrailerPrefix+"Grpc-Status"])
+	assert.Equal(t, []string{"abc"}, h[http.TrailerPrefix+"X-Checksum"])
+
+	// No trailers to announce.
+	h = http.Header{}
+	announceTrailers(h, nil)
+	assert.Empty(t, h)
+
+	// The announcement passed through is kept.
+	h = http.Header{"Trailer": {"Grpc-Status"}}
+	announceTrailers(h, http.Header{"Grpc-Status": nil, "X-Checksum": nil})
+	assert.Equal(t, []string{"Grpc-Status"}, h["Trailer"])
+}
+
+func TestForwardHeaders(t *testing.T) {
+	hs := NewHubServer("test-secret", WithAppPassword("pass"))
+	conn := pool.NewConnection(1, &token.AgentToken{Name: "test-agent"})
+	hs.connPool.AddConnection(conn)
+
+	forwarded := make(chan *http.Request, 1)
+	go func() {
+		forwarded <- conn.Accept(context.Background())
+		w, _ := conn.NewSubmitter()
+		hs.copyResponseHeader(w.Header(), http.Header{
+			"Content-Type":     {"text/plain"},
+			"Keep-Alive":       {"timeout=5"},
+			"Slime-Agent-Name": {"spoofed"},
+		})
+		w.WriteHeader(http.StatusOK)
+		w.Close()
+	}()
+
+	req := httptest.NewRequest("GET", "/v1/chat", nil)
+	req.Header.Set("slime-app-password", "pass")
+	req.Header.Set("slime-block", "1")
+	rr := httptest.NewRecorder()
+	hs.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "text/plain", rr.Header().Get("Content-Type"))
+	assert.Empty(t, rr.Header().Get("Keep-Alive"))
+	assert.Empty(t, rr.Header().Get("slime-agent-name"))
+
+	r := <-forwarded
+	assert.Empty(t, r.Header.Get("slime-app-password"))
+	assert.Empty(t, r.Header.Get("slime-block"))
+	assert.Equal(t, "192.0.2.1", r.Header.Get("X-Forwarded-For"))
+	assert.NotEmpty(t, r.Header.Get("X-Request-Id"))
+}
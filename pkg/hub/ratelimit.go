@@ -0,0 +1,218 @@
+/*
+Copyright © 2023 Harry C <hoveychen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package hub
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	RateLimitByApp   = "app"
+	RateLimitByScope = "scope"
+	RateLimitByIP    = "ip"
+
+	// rateLimitSweepInterval is how often the idle buckets are dropped.
+	rateLimitSweepInterval = time.Minute
+)
+
+// RateLimit limits the application requests sharing the same key, e.g. the same scope.
+type RateLimit struct {
+	// Key is what the requests are grouped by: app (the app password), scope or ip.
+	Key string
+	// Match restricts the limit to a single key value, e.g. a scope. Empty applies to every value, each with its own bucket.
+	Match string
+	// Rate is the number of requests per second. 0 for no rate limit.
+	Rate float64
+	// Burst is the number of requests allowed at once. Defaults to the rate rounded up.
+	Burst int
+	// Concurrent is the number of requests processed at the same time. 0 for no limit.
+	Concurrent int
+	// TrustForwardedFor groups by the address appended to X-Forwarded-For by the proxy in front of the hub,
+	// instead of the remote address.
+	TrustForwardedFor bool
+}
+
+// WithRateLimits rejects the application requests exceeding any of the limits with 429 Too Many Requests.
+func WithRateLimits(limits ...RateLimit) HubServerOption {
+	return func(hs *HubServer) {
+		for _, limit := range limits {
+			hs.rateLimiters = append(hs.rateLimiters, newRateLimiter(limit))
+		}
+	}
+}
+
+// Validate checks the limit is well-formed.
+func (limit *RateLimit) Validate() error {
+	switch limit.Key {
+	case RateLimitByApp, RateLimitByScope, RateLimitByIP:
+	default:
+		return fmt.Errorf("invalid rate limit key %q", limit.Key)
+	}
+	if limit.Rate < 0 || limit.Burst < 0 || limit.Concurrent < 0 {
+		return fmt.Errorf("negative rate limit for key %q", limit.Key)
+	}
+	if limit.Rate == 0 && limit.Concurrent == 0 {
+		return fmt.Errorf("neither rate nor concurrent is set for key %q", limit.Key)
+	}
+	return nil
+}
+
+func (limit *RateLimit) keyOf(r *http.Request) string {
+	switch limit.Key {
+	case RateLimitByApp:
+		return r.Header.Get("slime-app-password")
+	case RateLimitByScope:
+		return r.Header.Get("slime-scope")
+	case RateLimitByIP:
+		if limit.TrustForwardedFor {
+			if forwarded := r.Header.Values("X-Forwarded-For"); len(forwarded) > 0 {
+				addrs := strings.Split(forwarded[len(forwarded)-1], ",")
+				return strings.TrimSpace(addrs[len(addrs)-1])
+			}
+		}
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			return r.RemoteAddr
+		}
+		return host
+	}
+	return ""
+}
+
+type bucket struct {
+	tokens   float64
+	last     time.Time
+	inFlight int
+}
+
+type rateLimiter struct {
+	limit RateLimit
+	burst float64
+
+	lock      sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+func newRateLimiter(limit RateLimit) *rateLimiter {
+	burst := float64(limit.Burst)
+	if burst == 0 {
+		burst = math.Max(1, math.Ceil(limit.Rate))
+	}
+	return &rateLimiter{
+		limit:   limit,
+		burst:   burst,
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// acquire takes a token and a concurrency slot for the key. On rejection, it returns how long to wait before retrying.
+func (rl *rateLimiter) acquire(key string, now time.Time) (bool, time.Duration) {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+
+	if now.Sub(rl.lastSweep) > rateLimitSweepInterval {
+		rl.sweep(now)
+	}
+
+	b, ok := rl.buckets[key]
+	if !ok {
+		b = &bucket{tokens: rl.burst, last: now}
+		rl.buckets[key] = b
+	}
+	if rl.limit.Rate > 0 {
+		b.tokens = math.Min(rl.burst, b.tokens+now.Sub(b.last).Seconds()*rl.limit.Rate)
+		b.last = now
+	}
+
+	if rl.limit.Concurrent > 0 && b.inFlight >= rl.limit.Concurrent {
+		return false, time.Second
+	}
+	if rl.limit.Rate > 0 {
+		if b.tokens < 1 {
+			return false, time.Duration((1 - b.tokens) / rl.limit.Rate * float64(time.Second))
+		}
+		b.tokens--
+	}
+	b.inFlight++
+	return true, 0
+}
+
+// release returns the concurrency slot, and the token as well if the request was never processed.
+func (rl *rateLimiter) release(key string, refund bool) {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+
+	b, ok := rl.buckets[key]
+	if !ok {
+		return
+	}
+	b.inFlight--
+	if refund && rl.limit.Rate > 0 {
+		b.tokens = math.Min(rl.burst, b.tokens+1)
+	}
+}
+
+// sweep drops the idle buckets, which are refilled and have no requests in process.
+func (rl *rateLimiter) sweep(now time.Time) {
+	for key, b := range rl.buckets {
+		if b.inFlight > 0 {
+			continue
+		}
+		if rl.limit.Rate > 0 && b.tokens+now.Sub(b.last).Seconds()*rl.limit.Rate < rl.burst {
+			continue
+		}
+		delete(rl.buckets, key)
+	}
+	rl.lastSweep = now
+}
+
+// admitRateLimits checks the request against all the rate limits. If admitted, the returned function must be called
+// once the request is done. Otherwise, it returns how long to wait before retrying.
+func (hs *HubServer) admitRateLimits(r *http.Request) (func(), time.Duration, bool) {
+	type acquired struct {
+		limiter *rateLimiter
+		key     string
+	}
+	var acquireds []acquired
+	releaseAll := func(refund bool) {
+		for _, a := range acquireds {
+			a.limiter.release(a.key, refund)
+		}
+	}
+
+	now := time.Now()
+	for _, rl := range hs.rateLimiters {
+		key := rl.limit.keyOf(r)
+		if rl.limit.Match != "" && key != rl.limit.Match {
+			continue
+		}
+		ok, retryAfter := rl.acquire(key, now)
+		if !ok {
+			// Don't charge the other limits for a rejected request.
+			releaseAll(true)
+			return nil, retryAfter, false
+		}
+		acquireds = append(acquireds, acquired{limiter: rl, key: key})
+	}
+	return func() { releaseAll(false) }, 0, true
+}
@@ -0,0 +1,123 @@
+/*
+Copyright © 2023 Harry C <hoveychen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package hub
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiterTokenBucket(t *testing.T) {
+	rl := newRateLimiter(RateLimit{Key: RateLimitByIP, Rate: 2, Burst: 2})
+	now := time.Now()
+
+	// Test case 1: the burst is allowed at once
+	for i := 0; i < 2; i++ {
+		ok, _ := rl.acquire("1.2.3.4", now)
+		assert.True(t, ok)
+		rl.release("1.2.3.4", false)
+	}
+	ok, retryAfter := rl.acquire("1.2.3.4", now)
+	assert.False(t, ok)
+	assert.Equal(t, 500*time.Millisecond, retryAfter)
+
+	// Test case 2: the other keys have their own buckets
+	ok, _ = rl.acquire("5.6.7.8", now)
+	assert.True(t, ok)
+
+	// Test case 3: refilled over time
+	ok, _ = rl.acquire("1.2.3.4", now.Add(500*time.Millisecond))
+	assert.True(t, ok)
+}
+
+func TestRateLimiterConcurrent(t *testing.T) {
+	rl := newRateLimiter(RateLimit{Key: RateLimitByScope, Concurrent: 1})
+	now := time.Now()
+
+	ok, _ := rl.acquire("llm", now)
+	assert.True(t, ok)
+	ok, retryAfter := rl.acquire("llm", now)
+	assert.False(t, ok)
+	assert.Equal(t, time.Second, retryAfter)
+
+	rl.release("llm", false)
+	ok, _ = rl.acquire("llm", now)
+	assert.True(t, ok)
+}
+
+func TestRateLimiterSweep(t *testing.T) {
+	rl := newRateLimiter(RateLimit{Key: RateLimitByIP, Rate: 1})
+	now := time.Now()
+	rl.acquire("busy", now)
+	rl.acquire("idle", now)
+	rl.release("idle", false)
+
+	rl.sweep(now.Add(time.Minute))
+	assert.Contains(t, rl.buckets, "busy")
+	assert.NotContains(t, rl.buckets, "idle")
+}
+
+func TestRateLimitKey(t *testing.T) {
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.Header.Set("slime-scope", "llm")
+	req.Header.Set("slime-app-password", "app1")
+	req.Header.Add("X-Forwarded-For", "1.1.1.1, 2.2.2.2")
+
+	assert.Equal(t, "app1", (&RateLimit{Key: RateLimitByApp}).keyOf(req))
+	assert.Equal(t, "llm", (&RateLimit{Key: RateLimitByScope}).keyOf(req))
+	assert.Equal(t, "10.0.0.1", (&RateLimit{Key: RateLimitByIP}).keyOf(req))
+	assert.Equal(t, "2.2.2.2", (&RateLimit{Key: RateLimitByIP, TrustForwardedFor: true}).keyOf(req))
+}
+
+func TestRateLimitValidate(t *testing.T) {
+	assert.NoError(t, (&RateLimit{Key: RateLimitByIP, Rate: 1}).Validate())
+	assert.NoError(t, (&RateLimit{Key: RateLimitByScope, Concurrent: 1}).Validate())
+	assert.Error(t, (&RateLimit{Key: "user", Rate: 1}).Validate())
+	assert.Error(t, (&RateLimit{Key: RateLimitByIP}).Validate())
+	assert.Error(t, (&RateLimit{Key: RateLimitByIP, Rate: -1}).Validate())
+}
+
+func TestHandleAppRequestRateLimited(t *testing.T) {
+	hs := NewHubServer("test-secret", WithRateLimits(
+		RateLimit{Key: RateLimitByIP, Rate: 100},
+		RateLimit{Key: RateLimitByScope, Match: "llm", Rate: 1},
+	))
+
+	serve := func(scope string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("slime-scope", scope)
+		rr := httptest.NewRecorder()
+		hs.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// No agent is available, but the request is admitted.
+	assert.Equal(t, http.StatusServiceUnavailable, serve("llm").Code)
+	rr := serve("llm")
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+	assert.Equal(t, "1", rr.Header().Get("Retry-After"))
+	// The other scopes are not limited.
+	assert.Equal(t, http.StatusServiceUnavailable, serve("other").Code)
+
+	// The rejected request is not charged on the ip limit. The bucket refills a token every 10ms meanwhile.
+	ipLimiter := hs.rateLimiters[0]
+	assert.InDelta(t, 98, ipLimiter.buckets["192.0.2.1"].tokens, 0.5)
+}
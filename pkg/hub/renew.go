@@ -0,0 +1,63 @@
+/*
+Copyright © 2023 Harry C <hoveychen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package hub
+
+import (
+	"time"
+
+	"github.com/hoveychen/slime/pkg/token"
+	"google.golang.org/protobuf/proto"
+)
+
+// WithRenewWindow sets how long before the expiry the renewable tokens are renewed.
+// By default, the tokens are renewed in the last third of their lifetime.
+func WithRenewWindow(window time.Duration) HubServerOption {
+	return func(hs *HubServer) {
+		hs.renewWindow = window
+	}
+}
+
+// renewToken returns the renewed token if the token is renewable and within the renewal window, otherwise nil.
+// The renewed token keeps the lifetime of the token, capped by its max lifetime.
+func (hs *HubServer) renewToken(tok *token.AgentToken, now time.Time) *token.AgentToken {
+	if tok.GetSession() || tok.GetRenewUntil() == 0 || tok.GetExpireAt() == 0 || tok.GetIssuedAt() == 0 {
+		return nil
+	}
+
+	expireAt := time.Unix(tok.GetExpireAt(), 0)
+	lifetime := expireAt.Sub(time.Unix(tok.GetIssuedAt(), 0))
+	window := hs.renewWindow
+	if window == 0 {
+		window = lifetime / 3
+	}
+	if expireAt.Sub(now) > window {
+		return nil
+	}
+
+	renewedExpireAt := now.Add(lifetime)
+	if renewUntil := time.Unix(tok.GetRenewUntil(), 0); renewedExpireAt.After(renewUntil) {
+		renewedExpireAt = renewUntil
+	}
+	if !renewedExpireAt.After(expireAt) {
+		// The max lifetime is reached.
+		return nil
+	}
+
+	renewed := proto.Clone(tok).(*token.AgentToken)
+	renewed.IssuedAt = now.Unix()
+	renewed.ExpireAt = renewedExpireAt.Unix()
+	return renewed
+}
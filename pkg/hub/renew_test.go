@@ -0,0 +1,90 @@
+/*
+Copyright © 2023 Harry C <hoveychen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package hub
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hoveychen/slime/pkg/token"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRenewToken(t *testing.T) {
+	hs := NewHubServer("test-secret")
+	now := time.Now()
+	issuedAt := now.Add(-50 * time.Minute)
+	renewable := &token.AgentToken{
+		Id:         1,
+		IssuedAt:   issuedAt.Unix(),
+		ExpireAt:   issuedAt.Add(time.Hour).Unix(),
+		RenewUntil: now.Add(24 * time.Hour).Unix(),
+	}
+
+	// Test case 1: renewed with the same lifetime
+	renewed := hs.renewToken(renewable, now)
+	if assert.NotNil(t, renewed) {
+		assert.Equal(t, int64(1), renewed.Id)
+		assert.Equal(t, now.Unix(), renewed.IssuedAt)
+		assert.Equal(t, now.Add(time.Hour).Unix(), renewed.ExpireAt)
+	}
+
+	// Test case 2: out of the renewal window
+	assert.Nil(t, hs.renewToken(renewable, issuedAt.Add(30*time.Minute)))
+	hs.renewWindow = 45 * time.Minute
+	assert.NotNil(t, hs.renewToken(renewable, issuedAt.Add(30*time.Minute)))
+	hs.renewWindow = 0
+
+	// Test case 3: capped by the max lifetime
+	renewable.RenewUntil = now.Add(30 * time.Minute).Unix()
+	renewed = hs.renewToken(renewable, now)
+	if assert.NotNil(t, renewed) {
+		assert.Equal(t, renewable.RenewUntil, renewed.ExpireAt)
+	}
+	renewable.RenewUntil = renewable.ExpireAt
+	assert.Nil(t, hs.renewToken(renewable, now))
+
+	// Test case 4: not renewable
+	assert.Nil(t, hs.renewToken(&token.AgentToken{Id: 1, IssuedAt: issuedAt.Unix(), ExpireAt: issuedAt.Add(time.Hour).Unix()}, now))
+	assert.Nil(t, hs.renewToken(&token.AgentToken{Id: 1, IssuedAt: issuedAt.Unix(), RenewUntil: now.Add(time.Hour).Unix()}, now))
+}
+
+func TestRenewedTokenHeader(t *testing.T) {
+	hs := NewHubServer("test-secret")
+	tokenMgr := token.NewTokenManager([]byte("test-secret"))
+	issuedAt := time.Now().Add(-50 * time.Minute)
+	agentToken, _ := tokenMgr.Encrypt(&token.AgentToken{
+		Id:         1,
+		IssuedAt:   issuedAt.Unix(),
+		ExpireAt:   issuedAt.Add(time.Hour).Unix(),
+		RenewUntil: time.Now().Add(24 * time.Hour).Unix(),
+	})
+
+	req := httptest.NewRequest("POST", PathJoin, strings.NewReader("{}"))
+	req.Header.Set("slime-agent-token", agentToken)
+	req.Header.Set("slime-agent-id", "123")
+	rr := httptest.NewRecorder()
+	hs.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	renewed, err := tokenMgr.Decrypt(rr.Header().Get("slime-renewed-token"))
+	if assert.NoError(t, err) {
+		assert.InDelta(t, time.Now().Add(time.Hour).Unix(), renewed.ExpireAt, 2)
+	}
+}
@@ -0,0 +1,66 @@
+/*
+Copyright © 2023 Harry C <hoveychen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package hub
+
+import (
+	"sync"
+	"time"
+)
+
+const defaultReplayWindow = 5 * time.Minute
+
+// replayCache remembers the nonces of the signed requests within the replay window.
+// Requests outside of the window are rejected by their timestamps, so older nonces can be forgotten.
+type replayCache struct {
+	window    time.Duration
+	lock      sync.Mutex
+	seen      map[string]time.Time
+	lastSweep time.Time
+}
+
+func newReplayCache(window time.Duration) *replayCache {
+	return &replayCache{
+		window: window,
+		seen:   make(map[string]time.Time),
+	}
+}
+
+// InWindow reports whether the request timestamp is close enough to now.
+func (c *replayCache) InWindow(ts, now time.Time) bool {
+	return ts.After(now.Add(-c.window)) && ts.Before(now.Add(c.window))
+}
+
+// Add records the nonce, and reports false if it has been seen within the window.
+func (c *replayCache) Add(nonce string, now time.Time) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if now.Sub(c.lastSweep) > c.window {
+		for k, expireAt := range c.seen {
+			if now.After(expireAt) {
+				delete(c.seen, k)
+			}
+		}
+		c.lastSweep = now
+	}
+
+	if expireAt, ok := c.seen[nonce]; ok && !now.After(expireAt) {
+		return false
+	}
+	// A timestamp can be up to one window ahead, so the nonce must be kept for two.
+	c.seen[nonce] = now.Add(2 * c.window)
+	return true
+}
@@ -15,8 +15,48 @@ limitations under the License.
 */
 package hub
 
+import "strings"
+
 const (
 	PathJoin   = "/v1/agent/join"
 	PathAccept = "/v1/agent/accept"
 	PathSubmit = "/v1/agent/submit"
+	PathReport = "/v1/agent/report"
+	PathEnroll = "/v1/agent/enroll"
+
+	PathAdminPrefix      = "/v1/admin/"
+	PathAdminEnrollments = "/v1/admin/enrollments"
+	PathAdminApprove     = "/v1/admin/enrollments/approve"
+	PathAdminReject      = "/v1/admin/enrollments/reject"
+	PathAdminStats       = "/v1/admin/stats"
+	PathAdminDashboard   = "/v1/admin/dashboard"
+	PathAdminRevoke      = "/v1/admin/sessions/revoke"
+	// PathAdminAgents is followed by "{agentID}/telemetry" for the telemetry history of the agent.
+	PathAdminAgents = "/v1/admin/agents/"
 )
+
+// APIPath returns the agent API path the request path ends with, e.g. PathAccept for "/slime/v1/agent/accept", or
+// the path as is. The requests of the agents are signed with it, so that the signatures hold when the hub is served
+// under a base path, or behind a proxy stripping one.
+func APIPath(path string) string {
+	for _, apiPath := range []string{PathJoin, PathAccept, PathSubmit, PathReport} {
+		if strings.HasSuffix(path, apiPath) {
+			return apiPath
+		}
+	}
+	return path
+}
+
+// TrimPathPrefix trims the prefix from the path at a segment boundary, so "/api" matches "/api/v1" but not "/apis",
+// and reports whether the path is under the prefix. Any path is under the empty prefix.
+func TrimPathPrefix(path, prefix string) (string, bool) {
+	prefix = strings.TrimSuffix(prefix, "/")
+	if !strings.HasPrefix(path, prefix) {
+		return path, false
+	}
+	rest := path[len(prefix):]
+	if rest != "" && !strings.HasPrefix(rest, "/") {
+		return path, false
+	}
+	return rest, true
+}
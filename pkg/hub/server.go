@@ -17,17 +17,23 @@ package hub
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
 	"errors"
-	"io"
+	"math"
 	"math/rand"
 	"net/http"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/hoveychen/slime/pkg/hwinfo"
 	"github.com/hoveychen/slime/pkg/pool"
+	"github.com/hoveychen/slime/pkg/tlsutil"
 	"github.com/hoveychen/slime/pkg/token"
+	"github.com/hoveychen/slime/pkg/tracing"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/exp/slices"
 )
@@ -43,8 +49,10 @@ type ConnectionInfo struct {
 	AgentName    string
 	ScopePaths   []string
 	Scopes       []string
+	PathPrefix   string
 	Processing   bool
 	HardwareInfo *hwinfo.HWInfo
+	Telemetry    *hwinfo.Telemetry
 }
 
 // Hub server is responsible for:
@@ -56,6 +64,38 @@ type HubServer struct {
 	concurrent  chan struct{}
 	catalog     Catalog
 	appPassword string
+
+	requireClientCert bool
+	replay            *replayCache
+	acceptLock        sync.Mutex
+
+	sessionTTL   time.Duration
+	sessionEpoch atomic.Int64
+	renewWindow  time.Duration
+
+	rateLimiters []*rateLimiter
+	accessLog    *accessLogger
+	// appKey keys the hash identifying the applications in the access log, so it cannot be reversed without the secret.
+	appKey       []byte
+	stats        *requestStats
+	tracer       *tracing.Tracer
+	queueTimeout time.Duration
+	maxQueue     int
+	queued       atomic.Int64
+
+	// The timeouts of the application requests.
+	timeout       time.Duration
+	scopeTimeouts map[string]time.Duration
+	maxTimeout    time.Duration
+	jsonErrors    bool
+
+	// The header hygiene of the forwarded requests.
+	stripHeaders     bool
+	forwardedHeaders ForwardedHeadersMode
+
+	adminPassword string
+	enrollments   map[int64]*Enrollment
+	enrollLock    sync.Mutex
 }
 
 type HubServerOption func(hs *HubServer)
@@ -72,6 +112,21 @@ func WithAppPassword(password string) HubServerOption {
 	}
 }
 
+// WithRequireClientCert requires the agents to present a TLS client certificate verified by the client CA.
+func WithRequireClientCert(require bool) HubServerOption {
+	return func(hs *HubServer) {
+		hs.requireClientCert = require
+	}
+}
+
+// WithReplayWindow sets how far the timestamps of the signed requests may drift from the hub's clock.
+// Replayed nonces are rejected within the window.
+func WithReplayWindow(window time.Duration) HubServerOption {
+	return func(hs *HubServer) {
+		hs.replay = newReplayCache(window)
+	}
+}
+
 func WithCatalog(c Catalog) HubServerOption {
 	return func(hs *HubServer) {
 		hs.catalog = c
@@ -82,7 +137,15 @@ func NewHubServer(secret string, opts ...HubServerOption) *HubServer {
 	hs := &HubServer{
 		tokenMgr: token.NewTokenManager([]byte(secret)),
 		connPool: pool.NewPool(),
+		appKey:   []byte(secret),
+		replay:   newReplayCache(defaultReplayWindow),
+		stats:    newRequestStats(),
+
+		stripHeaders:     true,
+		forwardedHeaders: ForwardedAppend,
 	}
+	// Sessions issued before a restart are invalidated.
+	hs.sessionEpoch.Store(time.Now().UnixNano())
 	for _, opt := range opts {
 		opt(hs)
 	}
@@ -93,6 +156,15 @@ func NewHubServer(secret string, opts ...HubServerOption) *HubServer {
 }
 
 func (hs *HubServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("slime-enrollment-code") != "" && r.Method == "POST" && r.URL.Path == PathEnroll {
+		hs.handleAgentEnroll(w, r)
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, PathAdminPrefix) && (hs.adminPassword != "" || r.Header.Get("slime-admin-password") != "") {
+		hs.handleAdminRequest(w, r)
+		return
+	}
+
 	token := r.Header.Get("slime-agent-token")
 	if token != "" && r.Method == "POST" {
 		var handler http.Handler
@@ -103,6 +175,8 @@ func (hs *HubServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			handler = http.HandlerFunc(hs.handleAgentAccept)
 		case PathSubmit:
 			handler = http.HandlerFunc(hs.handleAgentSubmit)
+		case PathReport:
+			handler = http.HandlerFunc(hs.handleAgentReport)
 		default:
 			hs.error(w, logrus.WithField("remote", r.RemoteAddr), nil, "Unsupport path")
 			return
@@ -117,25 +191,99 @@ func (hs *HubServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 }
 
 func (hs *HubServer) handleAppRequest(w http.ResponseWriter, r *http.Request) {
+	entry := newAccessLogEntry(r, hs.appKey)
+	rec := &responseRecorder{ResponseWriter: w}
+	defer hs.finishAppRequest(entry, rec)
+	w = rec
+	propagateRequestID(w, r, entry.RequestID)
+
+	parent, _ := tracing.ParseTraceparent(r.Header.Get("traceparent"))
+	requestSpan := hs.tracer.Start(parent, "hub.request", tracing.SpanKindServer)
+	requestSpan.SetAttribute("slime.request_id", entry.RequestID)
+	requestSpan.SetAttribute("http.method", r.Method)
+	requestSpan.SetAttribute("http.target", r.URL.Path)
+	requestSpan.SetAttribute("slime.scope", entry.Scope)
+	defer func() {
+		requestSpan.SetAttribute("http.status_code", rec.status)
+		requestSpan.SetAttribute("slime.outcome", entry.Outcome)
+		requestSpan.End()
+	}()
+	queueSpan := hs.tracer.Start(requestSpan.Context(), "hub.queue", tracing.SpanKindInternal)
+	defer queueSpan.End()
+
 	if hs.appPassword != "" && r.Header.Get("slime-app-password") != hs.appPassword {
-		hs.replyStatus(w, logrus.WithField("remote", r.RemoteAddr), http.StatusUnauthorized, "Unauthorized", "Invalid password")
+		entry.Outcome = OutcomeUnauthorized
+		hs.replyError(w, logrus.WithField("remote", r.RemoteAddr), http.StatusUnauthorized, ErrorUnauthorized, "Unauthorized", "Invalid password")
+		return
+	}
+
+	timeout, err := hs.timeoutOf(r)
+	if err != nil {
+		entry.Outcome = OutcomeBadRequest
+		hs.replyError(w, logrus.WithField("remote", r.RemoteAddr).WithError(err), http.StatusBadRequest, ErrorBadRequest, "Bad Request", "Invalid timeout")
 		return
 	}
+	clientCtx := r.Context()
+	if timeout > 0 {
+		ctx, cancel := context.WithDeadline(clientCtx, entry.Time.Add(timeout))
+		defer cancel()
+		r = r.WithContext(ctx)
+	}
+	// timedOut reports whether the request ended by its deadline, rather than canceled by the client.
+	timedOut := func() bool {
+		return clientCtx.Err() == nil && errors.Is(r.Context().Err(), context.DeadlineExceeded)
+	}
+
+	release, retryAfter, ok := hs.admitRateLimits(r)
+	if !ok {
+		entry.Outcome = OutcomeRateLimited
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		hs.replyError(w, logrus.WithField("remote", r.RemoteAddr), http.StatusTooManyRequests, ErrorRateLimited, "Too Many Requests", "Rate limited")
+		return
+	}
+	defer release()
+
+	dequeue := hs.stats.enqueue(entry.Scope)
+	defer dequeue()
 
 	if hs.concurrent != nil {
-		hs.concurrent <- struct{}{}
+		if err := hs.admitConcurrent(r.Context()); err != nil {
+			log := logrus.WithField("remote", r.RemoteAddr).WithError(err)
+			if timedOut() {
+				hs.replyTimeout(rec, entry, log)
+				return
+			}
+			if r.Context().Err() != nil {
+				entry.Outcome = OutcomeCanceled
+				log.Debug("Application request canceled in queue")
+				return
+			}
+			entry.Outcome = OutcomeShed
+			hs.replyError(w, log, http.StatusServiceUnavailable, ErrorServerBusy, "Server busy", "Application request shed")
+			return
+		}
 		defer func() {
 			<-hs.concurrent
 		}()
 	}
 
 	scope := r.Header.Get("slime-scope")
+	block := r.Header.Get("slime-block") != ""
+	hs.prepareForward(r)
 
 	for r.Context().Err() == nil {
 		conns := hs.connPool.GetPendingConnections()
 		rand.Shuffle(len(conns), func(i, j int) {
 			conns[i], conns[j] = conns[j], conns[i]
 		})
+		// The agents mounted under the longest path prefix serve the request, and the ones with unhealthy
+		// upstreams are the last resort.
+		slices.SortStableFunc(conns, func(a, b *pool.Connection) int {
+			if d := len(b.PathPrefix()) - len(a.PathPrefix()); d != 0 {
+				return d
+			}
+			return hs.unhealthyRank(a) - hs.unhealthyRank(b)
+		})
 		for _, conn := range conns {
 			if scope != "" && !slices.Contains(conn.Scopes(), scope) {
 				continue
@@ -143,30 +291,86 @@ func (hs *HubServer) handleAppRequest(w http.ResponseWriter, r *http.Request) {
 			if len(conn.ScopePaths()) > 0 && !slices.Contains(conn.ScopePaths(), r.URL.Path) {
 				continue
 			}
+			if _, ok := TrimPathPrefix(r.URL.Path, conn.PathPrefix()); !ok {
+				continue
+			}
 
-			if err := conn.Delegate(r.Context(), w, r); err != nil {
-				logrus.WithError(err).WithField("remote", r.RemoteAddr).Error("Failed to delegate request")
-
+			dequeue()
+			queueSpan.End()
+			dispatchSpan := hs.tracer.Start(requestSpan.Context(), "hub.dispatch", tracing.SpanKindInternal)
+			dispatchSpan.SetAttribute("slime.agent_name", conn.AgentName())
+			dispatchSpan.SetAttribute("slime.agent_id", conn.AgentID())
+			propagateSpan(r, dispatchSpan)
+			setUpstreamTimeout(r)
+
+			entry.startDelegate(conn)
+			err := conn.Delegate(r.Context(), w, r)
+			entry.endDelegate()
+			dispatchSpan.SetError(err)
+			dispatchSpan.End()
+			if err != nil {
+				log := logrus.WithError(err).WithField("remote", r.RemoteAddr)
 				if r.Context().Err() != nil {
 					// Prevent agent from submitting the result.
 					hs.connPool.RemoveConnection(conn)
+					if timedOut() {
+						hs.replyTimeout(rec, entry, log)
+						return
+					}
+					entry.Outcome = OutcomeCanceled
+					log.Info("Application request canceled")
+					return
 				}
 
+				var upErr *upstreamError
+				if errors.As(err, &upErr) {
+					entry.Outcome = OutcomeUpstreamError
+					hs.replyError(w, log, upErr.StatusCode(), upErr.code, http.StatusText(upErr.StatusCode()), "Upstream failed")
+					return
+				}
 				if errors.Is(err, pool.ErrRetry) {
+					log.Warn("Agent gone, retry another one")
 					continue
 				}
+				entry.Outcome = OutcomeAgentError
+				if rec.status != 0 {
+					// Too late to reply an error. Abort the response so that the application won't take the
+					// partial one as complete.
+					log.Error("Agent failed in response")
+					panic(http.ErrAbortHandler)
+				}
+				hs.replyError(w, log, http.StatusBadGateway, ErrorAgentFailure, "Bad Gateway", "Agent failed")
+				return
 			}
 
+			entry.Outcome = OutcomeOK
 			return
 		}
 
 		// No connections meet the request.
-		if r.Header.Get("slime-block") == "" {
-			hs.replyStatus(w, logrus.WithField("remote", r.RemoteAddr), http.StatusServiceUnavailable, "No available agent", "No available agent")
+		if !block {
+			entry.Outcome = OutcomeNoAgent
+			hs.replyError(w, logrus.WithField("remote", r.RemoteAddr), http.StatusServiceUnavailable, ErrorNoAgent, "No available agent", "No available agent")
 			return
 		}
-		time.Sleep(1 * time.Second)
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
 	}
+	if timedOut() {
+		hs.replyTimeout(rec, entry, logrus.WithField("remote", r.RemoteAddr))
+		return
+	}
+	entry.Outcome = OutcomeCanceled
+}
+
+func (hs *HubServer) unhealthyRank(conn *pool.Connection) int {
+	telemetry := hs.latestTelemetry(conn.AgentID())
+	if telemetry != nil && !telemetry.UpstreamHealthy {
+		return 1
+	}
+	return 0
 }
 
 func (hs *HubServer) error(w http.ResponseWriter, log *logrus.Entry, err error, msg string) {
@@ -197,8 +401,12 @@ func (hs *HubServer) wrapTokenValidator(h http.Handler) http.Handler {
 			hs.replyStatus(w, agentLog, http.StatusUnauthorized, "Unauthorized", "Failed to decrypt token")
 			return
 		}
+		if tok.GetEnrollment() {
+			hs.replyStatus(w, agentLog, http.StatusUnauthorized, "Unauthorized", "Enrollment code used as token")
+			return
+		}
 
-		if tok.ExpireAt > 0 {
+		if tok.ExpireAt > 0 && !tok.GetSession() {
 			expireAt := time.Unix(tok.ExpireAt, 0)
 			if time.Now().After(expireAt) {
 				hs.replyStatus(w, agentLog, http.StatusUnauthorized, "Unauthorized", "Token expired")
@@ -206,18 +414,111 @@ func (hs *HubServer) wrapTokenValidator(h http.Handler) http.Handler {
 			}
 		}
 
-		_, err = strconv.Atoi(r.Header.Get("slime-agent-id"))
+		if msg := hs.checkSession(r, tok); msg != "" {
+			hs.replyStatus(w, agentLog, http.StatusUnauthorized, "Unauthorized", msg)
+			return
+		}
+
+		if hs.requireClientCert && (r.TLS == nil || len(r.TLS.VerifiedChains) == 0) {
+			hs.replyStatus(w, agentLog, http.StatusUnauthorized, "Unauthorized", "Client certificate required")
+			return
+		}
+
+		if fingerprint := tok.GetCertFingerprint(); fingerprint != "" {
+			// The token is bound to the certificate, so a stolen token is useless without the private key.
+			if r.TLS == nil {
+				// The certificate can't be verified when the TLS connections are terminated before the hub, e.g. by a proxy.
+				hs.replyStatus(w, agentLog, http.StatusUnauthorized, "Unauthorized", "Client certificate required, but the hub is not serving TLS")
+				return
+			}
+			if len(r.TLS.PeerCertificates) == 0 || !strings.EqualFold(tlsutil.Fingerprint(r.TLS.PeerCertificates[0]), fingerprint) {
+				hs.replyStatus(w, agentLog, http.StatusUnauthorized, "Unauthorized", "Client certificate mismatch")
+				return
+			}
+		}
+
+		if len(tok.GetSigningKey()) > 0 {
+			if msg := hs.verifySignature(r, tok); msg != "" {
+				hs.replyStatus(w, agentLog, http.StatusUnauthorized, "Unauthorized", msg)
+				return
+			}
+		}
+
+		agentID, err := strconv.Atoi(r.Header.Get("slime-agent-id"))
 		if err != nil {
 			hs.replyStatus(w, agentLog, http.StatusUnauthorized, "Unauthorized", "Failed to parse node id")
 			return
 		}
 
+		if len(tok.GetAgentIds()) > 0 && !slices.Contains(tok.GetAgentIds(), int64(agentID)) {
+			hs.replyStatus(w, agentLog.WithField("agentID", agentID), http.StatusForbidden, "Forbidden", "Agent ID not allowed by the token")
+			return
+		}
+
+		if renewed := hs.renewToken(tok, time.Now()); renewed != nil {
+			if encrypted, err := hs.tokenMgr.Encrypt(renewed); err == nil {
+				w.Header().Set("slime-renewed-token", encrypted)
+				agentLog.WithFields(logrus.Fields{
+					"agent":    tok.GetName(),
+					"expireAt": time.Unix(renewed.GetExpireAt(), 0),
+				}).Info("Token renewed.")
+			} else {
+				agentLog.WithError(err).Error("Failed to renew token")
+			}
+		}
+
 		r = r.WithContext(token.NewContext(r.Context(), tok))
 
 		h.ServeHTTP(w, r)
 	})
 }
 
+// verifySignature verifies the signed request, and returns the reason if it's rejected.
+func (hs *HubServer) verifySignature(r *http.Request, tok *token.AgentToken) string {
+	timestamp := r.Header.Get("slime-timestamp")
+	nonce := r.Header.Get("slime-nonce")
+	signature := r.Header.Get("slime-signature")
+	if timestamp == "" || nonce == "" || signature == "" {
+		return "Missing request signature"
+	}
+
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return "Invalid request timestamp"
+	}
+	now := time.Now()
+	if !hs.replay.InWindow(time.Unix(unix, 0), now) {
+		return "Request timestamp out of window"
+	}
+
+	if !token.VerifySignature(tok.GetSigningKey(), signature, r.Method, APIPath(r.URL.Path),
+		r.Header.Get("slime-agent-id"), r.Header.Get("slime-connection-id"), timestamp, nonce) {
+		return "Invalid request signature"
+	}
+
+	// Only record the nonce of authentic requests, so that forged requests can't burn them.
+	if !hs.replay.Add(strconv.FormatInt(tok.GetId(), 10)+":"+nonce, now) {
+		return "Replayed request"
+	}
+	return ""
+}
+
+// TelemetryHistory returns the telemetry history of the agent, from the oldest to the latest. It's empty if the
+// catalog doesn't keep the telemetry.
+func (hs *HubServer) TelemetryHistory(agentID int) []*hwinfo.Telemetry {
+	if tc, ok := hs.catalog.(TelemetryCatalog); ok {
+		return tc.GetTelemetryHistory(agentID)
+	}
+	return nil
+}
+
+func (hs *HubServer) latestTelemetry(agentID int) *hwinfo.Telemetry {
+	if tc, ok := hs.catalog.(TelemetryCatalog); ok {
+		return tc.GetLatestTelemetry(agentID)
+	}
+	return nil
+}
+
 func (hs *HubServer) GetConnectionsInfos() []*ConnectionInfo {
 	var connectionsInfos []*ConnectionInfo
 
@@ -231,8 +532,10 @@ func (hs *HubServer) GetConnectionsInfos() []*ConnectionInfo {
 			Since:        conn.Since(),
 			ScopePaths:   conn.ScopePaths(),
 			Scopes:       conn.Scopes(),
+			PathPrefix:   conn.PathPrefix(),
 			Processing:   conn.IsProcessing(),
 			HardwareInfo: hs.catalog.GetHardwareInfo(conn.AgentID()),
+			Telemetry:    hs.latestTelemetry(conn.AgentID()),
 		})
 	}
 	return connectionsInfos
@@ -247,13 +550,26 @@ func (hs *HubServer) handleAgentJoin(w http.ResponseWriter, r *http.Request) {
 		"agentID": agentID,
 	})
 
+	if hs.sessionTTL > 0 {
+		session, expireAt, err := hs.issueSession(token, agentID)
+		if err != nil {
+			hs.error(w, agentLog, err, "Failed to issue session")
+			return
+		}
+		w.Header().Set("slime-session-token", session)
+		w.Header().Set("slime-session-expire-at", strconv.FormatInt(expireAt.Unix(), 10))
+	}
+
 	var hwInfo hwinfo.HWInfo
 	json.NewDecoder(r.Body).Decode(&hwInfo)
 	hs.catalog.SetHardwareInfo(agentID, &hwInfo)
+	if hwInfo.Fingerprint != "" {
+		agentLog = agentLog.WithField("fingerprint", hwInfo.Fingerprint)
+	}
 	agentLog.Info("Agent has arrived.")
 }
 
-func (hs *HubServer) handleAgentAccept(w http.ResponseWriter, r *http.Request) {
+func (hs *HubServer) handleAgentReport(w http.ResponseWriter, r *http.Request) {
 	agentID, _ := strconv.Atoi(r.Header.Get("slime-agent-id"))
 	token := token.FromContext(r.Context())
 	agentLog := logrus.WithFields(logrus.Fields{
@@ -262,30 +578,60 @@ func (hs *HubServer) handleAgentAccept(w http.ResponseWriter, r *http.Request) {
 		"agentID": agentID,
 	})
 
-	agentLog.Info("Agent is listening...")
-	// Check if there is any existing connection by the agent.
-	// Terminate the existing connection if there is any.
-	existings := hs.connPool.GetPendingConnections()
-	existings = append(existings, hs.connPool.GetProcessingConnections()...)
+	var telemetry hwinfo.Telemetry
+	if err := json.NewDecoder(r.Body).Decode(&telemetry); err != nil {
+		hs.error(w, agentLog, err, "Invalid telemetry")
+		return
+	}
+	telemetry.Time = time.Now()
+	if tc, ok := hs.catalog.(TelemetryCatalog); ok {
+		tc.AddTelemetry(agentID, &telemetry)
+	}
 
-	for _, conn := range existings {
-		if conn.AgentID() != agentID {
-			continue
-		}
-		if err := conn.Close(pool.ErrAgentAlreadyConnected); err != nil {
-			agentLog.WithError(err).Error("Failed to terminate the connection")
-		} else {
-			agentLog.WithField("connectionID", conn.ID()).Warn("Agent already connected. Terminating the existing connection.")
-		}
-		hs.connPool.RemoveConnection(conn)
+	if hwInfo := hs.catalog.GetHardwareInfo(agentID); hwInfo != nil && telemetry.GPUStats != nil {
+		// Keep the GPU stats in the hardware info up to date.
+		updated := *hwInfo
+		updated.GPUStats = telemetry.GPUStats
+		hs.catalog.SetHardwareInfo(agentID, &updated)
 	}
+	agentLog.Debug("Agent reported telemetry.")
+}
 
-	conn := pool.NewConnection(agentID, token)
-	hs.connPool.AddConnection(conn)
+func (hs *HubServer) handleAgentAccept(w http.ResponseWriter, r *http.Request) {
+	agentID, _ := strconv.Atoi(r.Header.Get("slime-agent-id"))
+	token := token.FromContext(r.Context())
+	agentLog := logrus.WithFields(logrus.Fields{
+		"remote":  r.RemoteAddr,
+		"agent":   token.GetName(),
+		"agentID": agentID,
+	})
+
+	agentLog.Info("Agent is listening...")
+	pathPrefix := r.Header.Get("slime-path-prefix")
+	if pathPrefix != "" && !strings.HasPrefix(pathPrefix, "/") {
+		hs.replyStatus(w, agentLog, http.StatusBadRequest, "Bad Request", "Invalid path prefix")
+		return
+	}
+	conn, statusCode, msg := hs.addAgentConnection(agentID, token, pathPrefix, agentLog)
+	if conn == nil {
+		hs.replyStatus(w, agentLog, statusCode, http.StatusText(statusCode), msg)
+		return
+	}
+	ctx := r.Context()
+	if token.GetSession() {
+		// Stop waiting once the session expires, so that the agent refreshes it.
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, time.Unix(token.GetExpireAt(), 0))
+		defer cancel()
+	}
 	// Blocking, wait for a new job
-	req := conn.Accept(r.Context())
+	req := conn.Accept(ctx)
 	if r.Context().Err() != nil || req == nil {
 		hs.connPool.RemoveConnection(conn)
+		if r.Context().Err() == nil && ctx.Err() != nil {
+			hs.replyStatus(w, agentLog, http.StatusUnauthorized, "Unauthorized", "Session expired")
+			return
+		}
 		hs.error(w, agentLog, r.Context().Err(), "Agent accept canceled")
 		return
 	}
@@ -309,6 +655,60 @@ func (hs *HubServer) handleAgentAccept(w http.ResponseWriter, r *http.Request) {
 	}).Info("Agent accepted.")
 }
 
+// addAgentConnection adds a new pending connection for the agent, within the limits of the token.
+// An existing connection of the same agent ID is terminated, unless it belongs to another token.
+// On rejection, it returns the status code and the reason.
+func (hs *HubServer) addAgentConnection(agentID int, tok *token.AgentToken, pathPrefix string, agentLog *logrus.Entry) (*pool.Connection, int, string) {
+	hs.acceptLock.Lock()
+	defer hs.acceptLock.Unlock()
+
+	existings := hs.connPool.GetPendingConnections()
+	existings = append(existings, hs.connPool.GetProcessingConnections()...)
+
+	var replaced []*pool.Connection
+	var others []*pool.Connection
+	for _, conn := range existings {
+		if conn.AgentID() == agentID {
+			if conn.TokenID() != tok.GetId() {
+				return nil, http.StatusConflict, "Agent ID is connected with another token"
+			}
+			replaced = append(replaced, conn)
+			continue
+		}
+		if conn.TokenID() == tok.GetId() {
+			others = append(others, conn)
+		}
+	}
+
+	if max := int(tok.GetMaxConnections()); max > 0 && len(others) >= max {
+		return nil, http.StatusForbidden, "Too many connections with the token"
+	}
+	if max := int(tok.GetMaxAgentIds()); max > 0 {
+		agentIDs := map[int]bool{agentID: true}
+		for _, conn := range others {
+			agentIDs[conn.AgentID()] = true
+		}
+		if len(agentIDs) > max {
+			return nil, http.StatusForbidden, "Too many agent IDs with the token"
+		}
+	}
+
+	// Terminate the existing connection by the agent.
+	for _, conn := range replaced {
+		if err := conn.Close(pool.ErrAgentAlreadyConnected); err != nil {
+			agentLog.WithError(err).Error("Failed to terminate the connection")
+		} else {
+			agentLog.WithField("connectionID", conn.ID()).Warn("Agent already connected. Terminating the existing connection.")
+		}
+		hs.connPool.RemoveConnection(conn)
+	}
+
+	conn := pool.NewConnection(agentID, tok)
+	conn.SetPathPrefix(pathPrefix)
+	hs.connPool.AddConnection(conn)
+	return conn, http.StatusOK, ""
+}
+
 func (hs *HubServer) handleAgentSubmit(w http.ResponseWriter, r *http.Request) {
 	agentID, _ := strconv.Atoi(r.Header.Get("slime-agent-id"))
 	token := token.FromContext(r.Context())
@@ -344,8 +744,9 @@ func (hs *HubServer) handleAgentSubmit(w http.ResponseWriter, r *http.Request) {
 	}
 	defer submitter.Close()
 
-	// To support Server Sent Event, we have to use a short buffer
-	upResp, err := http.ReadResponse(bufio.NewReaderSize(r.Body, 20), nil)
+	// To support Server Sent Event, we have to use a short buffer.
+	// The request tells whether the response has a body, e.g. not for HEAD.
+	upResp, err := http.ReadResponse(bufio.NewReaderSize(r.Body, 20), conn.Request())
 	if err != nil {
 		if err := conn.Close(err); err != nil {
 			agentLog.WithError(err).Error("Failed to close connection")
@@ -354,19 +755,46 @@ func (hs *HubServer) handleAgentSubmit(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	for k, v := range upResp.Header {
-		submitter.Header()[k] = v
+	if code := upResp.Header.Get("slime-upstream-error"); code != "" {
+		// The agent failed to get a response from the upstream. The application is replied with the error.
+		upResp.Body.Close()
+		if err := conn.Close(&upstreamError{code: code}); err != nil {
+			agentLog.WithError(err).Error("Failed to close connection")
+		}
+		agentLog.WithField("code", code).Warn("Agent reported upstream failure")
+		w.WriteHeader(http.StatusOK)
+		return
 	}
-	submitter.Header().Set("slime-agent-id", strconv.Itoa(agentID))
-	submitter.WriteHeader(upResp.StatusCode)
 
-	writeDone := make(chan struct{}, 1)
+	// The application request may take the response writer back at any time, e.g. on timeout, so the header is
+	// only accessed through the submitter.
+	writeDone := make(chan error, 1)
 	go func() {
-		io.Copy(submitter, upResp.Body)
-		writeDone <- struct{}{}
+		err := submitter.UpdateHeader(func(h http.Header) {
+			hs.copyResponseHeader(h, upResp.Header)
+			announceTrailers(h, upResp.Trailer)
+			h.Set("slime-agent-id", strconv.Itoa(agentID))
+		}, upResp.StatusCode)
+		if err == nil {
+			err = copyResponseBody(submitter, upResp)
+		}
+		if err == nil {
+			err = submitter.UpdateHeader(func(h http.Header) {
+				copyTrailers(h, upResp.Trailer)
+			}, 0)
+		}
+		writeDone <- err
 	}()
 	select {
-	case <-writeDone:
+	case err := <-writeDone:
+		if err != nil {
+			// Either the agent or the application is gone in the middle of the response.
+			if err := conn.Close(err); err != nil {
+				agentLog.WithError(err).Error("Failed to close connection")
+			}
+			hs.error(w, agentLog, err, "Copy upstream response")
+			return
+		}
 	case <-r.Context().Done():
 		if err := conn.Close(r.Context().Err()); err != nil {
 			agentLog.WithError(err).Error("Failed to close connection")
@@ -16,13 +16,19 @@ limitations under the License.
 package hub
 
 import (
+	"context"
 	"errors"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/hoveychen/slime/pkg/hwinfo"
+	"github.com/hoveychen/slime/pkg/pool"
 	"github.com/hoveychen/slime/pkg/token"
+	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -152,3 +158,297 @@ func TestHandleAgentJoin(t *testing.T) {
 		t.Errorf("handleAgentJoin returned wrong status code: got %v want %v", status, http.StatusOK)
 	}
 }
+
+func TestHandleAgentReport(t *testing.T) {
+	hs := &HubServer{
+		catalog: NewMemoryCatalog(),
+	}
+	hs.catalog.SetHardwareInfo(123, &hwinfo.HWInfo{CPUCores: 8})
+
+	body := `{"LoadAverage1":1.5,"InFlight":1,"UpstreamHealthy":true,"GPUStats":[{"Index":0,"Name":"Tesla T4","MemoryUsedMB":512}]}`
+	req := httptest.NewRequest("POST", PathReport, strings.NewReader(body))
+	req.Header.Set("slime-agent-id", "123")
+	req = req.WithContext(token.NewContext(req.Context(), &token.AgentToken{Id: 1, Name: "test-agent"}))
+	rr := httptest.NewRecorder()
+
+	hs.handleAgentReport(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	telemetry := hs.latestTelemetry(123)
+	if assert.NotNil(t, telemetry) {
+		assert.Equal(t, float32(1.5), telemetry.LoadAverage1)
+		assert.Equal(t, 1, telemetry.InFlight)
+		assert.True(t, telemetry.UpstreamHealthy)
+		assert.False(t, telemetry.Time.IsZero())
+	}
+	// The GPU stats of the hardware info are refreshed.
+	hwInfo := hs.catalog.GetHardwareInfo(123)
+	assert.Equal(t, 8, hwInfo.CPUCores)
+	if assert.Len(t, hwInfo.GPUStats, 1) {
+		assert.Equal(t, float32(512), hwInfo.GPUStats[0].MemoryUsedMB)
+	}
+
+	// Malformed report is rejected, and the history is left untouched.
+	req = httptest.NewRequest("POST", PathReport, strings.NewReader("{"))
+	req.Header.Set("slime-agent-id", "123")
+	req = req.WithContext(token.NewContext(req.Context(), &token.AgentToken{Id: 1, Name: "test-agent"}))
+	rr = httptest.NewRecorder()
+	hs.handleAgentReport(rr, req)
+	assert.Equal(t, http.StatusInternalServerError, rr.Code)
+	assert.Len(t, hs.TelemetryHistory(123), 1)
+}
+
+func TestUnhealthyRank(t *testing.T) {
+	catalog := NewMemoryCatalog()
+	hs := &HubServer{
+		catalog: catalog,
+	}
+	healthy := pool.NewConnection(1, &token.AgentToken{})
+	unhealthy := pool.NewConnection(2, &token.AgentToken{})
+	unknown := pool.NewConnection(3, &token.AgentToken{})
+	catalog.AddTelemetry(1, &hwinfo.Telemetry{UpstreamHealthy: true})
+	catalog.AddTelemetry(2, &hwinfo.Telemetry{UpstreamHealthy: false})
+
+	assert.Equal(t, 0, hs.unhealthyRank(healthy))
+	assert.Equal(t, 1, hs.unhealthyRank(unhealthy))
+	assert.Equal(t, 0, hs.unhealthyRank(unknown))
+}
+
+func TestWrapTokenValidatorSignedRequest(t *testing.T) {
+	signingKey := []byte("0123456789abcdef0123456789abcdef")
+	tokenMgr := &mockTokenManager{tok: &token.AgentToken{Id: 1, SigningKey: signingKey}}
+	hs := &HubServer{tokenMgr: tokenMgr, replay: newReplayCache(time.Minute)}
+	mockHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	handler := hs.wrapTokenValidator(mockHandler)
+
+	newRequest := func(ts time.Time, nonce string) *http.Request {
+		req := httptest.NewRequest("POST", PathSubmit, nil)
+		timestamp := strconv.FormatInt(ts.Unix(), 10)
+		req.Header.Set("slime-agent-token", "encrypted-token")
+		req.Header.Set("slime-agent-id", "123")
+		req.Header.Set("slime-connection-id", "456")
+		req.Header.Set("slime-timestamp", timestamp)
+		req.Header.Set("slime-nonce", nonce)
+		req.Header.Set("slime-signature", token.Sign(signingKey, "POST", PathSubmit, "123", "456", timestamp, nonce))
+		return req
+	}
+	serve := func(req *http.Request) int {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	// Test case 1: valid signature
+	assert.Equal(t, http.StatusOK, serve(newRequest(time.Now(), "nonce-1")))
+
+	// Test case 2: replayed nonce
+	assert.Equal(t, http.StatusUnauthorized, serve(newRequest(time.Now(), "nonce-1")))
+
+	// Test case 3: stale timestamp
+	assert.Equal(t, http.StatusUnauthorized, serve(newRequest(time.Now().Add(-2*time.Minute), "nonce-2")))
+
+	// Test case 4: tampered connection ID
+	req := newRequest(time.Now(), "nonce-3")
+	req.Header.Set("slime-connection-id", "789")
+	assert.Equal(t, http.StatusUnauthorized, serve(req))
+	// The nonce of the forged request is not burnt.
+	assert.Equal(t, http.StatusOK, serve(newRequest(time.Now(), "nonce-3")))
+
+	// Test case 5: unsigned request
+	req = httptest.NewRequest("POST", PathSubmit, nil)
+	req.Header.Set("slime-agent-token", "encrypted-token")
+	req.Header.Set("slime-agent-id", "123")
+	assert.Equal(t, http.StatusUnauthorized, serve(req))
+}
+
+func TestReplayCache(t *testing.T) {
+	c := newReplayCache(time.Minute)
+	now := time.Now()
+
+	assert.True(t, c.InWindow(now.Add(30*time.Second), now))
+	assert.False(t, c.InWindow(now.Add(-2*time.Minute), now))
+	assert.False(t, c.InWindow(now.Add(2*time.Minute), now))
+
+	assert.True(t, c.Add("a", now))
+	assert.False(t, c.Add("a", now.Add(time.Minute)))
+	assert.True(t, c.Add("b", now))
+
+	// Expired nonces are swept.
+	assert.True(t, c.Add("c", now.Add(3*time.Minute)))
+	assert.NotContains(t, c.seen, "a")
+	assert.Contains(t, c.seen, "c")
+}
+
+func TestWrapTokenValidatorAgentIDs(t *testing.T) {
+	tokenMgr := &mockTokenManager{tok: &token.AgentToken{Id: 1, AgentIds: []int64{123, 124}}}
+	hs := &HubServer{tokenMgr: tokenMgr}
+	handler := hs.wrapTokenValidator(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	serve := func(agentID string) int {
+		req := httptest.NewRequest("POST", PathAccept, nil)
+		req.Header.Set("slime-agent-token", "encrypted-token")
+		req.Header.Set("slime-agent-id", agentID)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	assert.Equal(t, http.StatusOK, serve("123"))
+	assert.Equal(t, http.StatusOK, serve("124"))
+	assert.Equal(t, http.StatusForbidden, serve("125"))
+}
+
+func TestAddAgentConnection(t *testing.T) {
+	hs := &HubServer{connPool: pool.NewPool()}
+	log := logrus.NewEntry(logrus.StandardLogger())
+	tokenA := &token.AgentToken{Id: 1, MaxConnections: 2, MaxAgentIds: 2}
+	tokenB := &token.AgentToken{Id: 2}
+
+	// Test case 1: first connection
+	connA1, statusCode, _ := hs.addAgentConnection(100, tokenA, "", log)
+	assert.NotNil(t, connA1)
+	assert.Equal(t, http.StatusOK, statusCode)
+
+	// Test case 2: another token can't kick out the connection
+	conn, statusCode, _ := hs.addAgentConnection(100, tokenB, "", log)
+	assert.Nil(t, conn)
+	assert.Equal(t, http.StatusConflict, statusCode)
+	assert.NotNil(t, hs.connPool.GetConnection(connA1.ID()))
+
+	// Test case 3: the same token replaces its own connection
+	connA2, statusCode, _ := hs.addAgentConnection(100, tokenA, "", log)
+	assert.NotNil(t, connA2)
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.Nil(t, hs.connPool.GetConnection(connA1.ID()))
+
+	// Test case 4: within the limits
+	connA3, statusCode, _ := hs.addAgentConnection(101, tokenA, "", log)
+	assert.NotNil(t, connA3)
+	assert.Equal(t, http.StatusOK, statusCode)
+
+	// Test case 5: too many agent IDs / connections
+	conn, statusCode, _ = hs.addAgentConnection(102, tokenA, "", log)
+	assert.Nil(t, conn)
+	assert.Equal(t, http.StatusForbidden, statusCode)
+
+	tokenC := &token.AgentToken{Id: 3, MaxAgentIds: 1}
+	_, statusCode, _ = hs.addAgentConnection(200, tokenC, "", log)
+	assert.Equal(t, http.StatusOK, statusCode)
+	_, statusCode, msg := hs.addAgentConnection(201, tokenC, "", log)
+	assert.Equal(t, http.StatusForbidden, statusCode)
+	assert.Equal(t, "Too many agent IDs with the token", msg)
+
+	// Test case 6: other tokens are not limited
+	conn, statusCode, _ = hs.addAgentConnection(102, tokenB, "", log)
+	assert.NotNil(t, conn)
+	assert.Equal(t, http.StatusOK, statusCode)
+}
+
+func TestTrimPathPrefix(t *testing.T) {
+	tests := []struct {
+		path   string
+		prefix string
+		want   string
+		ok     bool
+	}{
+		{"/v1/chat", "", "/v1/chat", true},
+		{"/llm", "/llm", "", true},
+		{"/llm/v1/chat", "/llm", "/v1/chat", true},
+		{"/llm/v1/chat", "/llm/", "/v1/chat", true},
+		{"/llms/v1/chat", "/llm", "/llms/v1/chat", false},
+		{"/v1/chat", "/llm", "/v1/chat", false},
+	}
+	for _, tt := range tests {
+		rest, ok := TrimPathPrefix(tt.path, tt.prefix)
+		assert.Equal(t, tt.want, rest, "%s %s", tt.path, tt.prefix)
+		assert.Equal(t, tt.ok, ok, "%s %s", tt.path, tt.prefix)
+	}
+}
+
+func TestAgentAcceptCanceledKeepsCatalog(t *testing.T) {
+	catalog := NewMemoryCatalog()
+	hs := NewHubServer("test-secret", WithCatalog(catalog))
+	catalog.SetHardwareInfo(1, &hwinfo.HWInfo{CPUCores: 8})
+	catalog.AddTelemetry(1, &hwinfo.Telemetry{InFlight: 1})
+
+	// The agent closes the accept request.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	req := httptest.NewRequest("POST", PathAccept, nil)
+	req.Header.Set("slime-agent-id", "1")
+	req = req.WithContext(token.NewContext(ctx, &token.AgentToken{Id: 1, Name: "test-agent"}))
+	hs.handleAgentAccept(httptest.NewRecorder(), req)
+
+	// The agent polls again without joining, so its hardware info and telemetry are kept.
+	assert.NotNil(t, catalog.GetHardwareInfo(1))
+	assert.Len(t, catalog.GetTelemetryHistory(1), 1)
+}
+
+// hardwareCatalog only implements the Catalog, without keeping the telemetry.
+type hardwareCatalog struct {
+	hwInfo *hwinfo.HWInfo
+}
+
+func (c *hardwareCatalog) GetHardwareInfo(agentID int) *hwinfo.HWInfo         { return c.hwInfo }
+func (c *hardwareCatalog) SetHardwareInfo(agentID int, hwInfo *hwinfo.HWInfo) { c.hwInfo = hwInfo }
+
+func TestCatalogWithoutTelemetry(t *testing.T) {
+	hs := NewHubServer("test-secret", WithCatalog(&hardwareCatalog{}))
+
+	req := httptest.NewRequest("POST", PathReport, strings.NewReader(`{"InFlight":1}`))
+	req.Header.Set("slime-agent-id", "1")
+	req = req.WithContext(token.NewContext(req.Context(), &token.AgentToken{Id: 1, Name: "test-agent"}))
+	rr := httptest.NewRecorder()
+	hs.handleAgentReport(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Empty(t, hs.TelemetryHistory(1))
+	assert.Nil(t, hs.latestTelemetry(1))
+}
+
+func TestAPIPath(t *testing.T) {
+	assert.Equal(t, PathAccept, APIPath(PathAccept))
+	assert.Equal(t, PathSubmit, APIPath("/slime"+PathSubmit))
+	assert.Equal(t, "/v1/chat", APIPath("/v1/chat"))
+}
+
+func TestPathPrefixRouting(t *testing.T) {
+	hs := NewHubServer("test-secret")
+	log := logrus.NewEntry(logrus.StandardLogger())
+
+	serve := func(path string) int {
+		rr := httptest.NewRecorder()
+		hs.ServeHTTP(rr, httptest.NewRequest("GET", path, nil))
+		agentID, _ := strconv.Atoi(rr.Header().Get("slime-agent-id"))
+		if rr.Code != http.StatusOK {
+			return -rr.Code
+		}
+		return agentID
+	}
+	// Each connection serves a single request.
+	accept := func(conn *pool.Connection) {
+		go func() {
+			conn.Accept(context.Background())
+			w, _ := conn.NewSubmitter()
+			w.Header().Set("slime-agent-id", strconv.Itoa(conn.AgentID()))
+			w.WriteHeader(http.StatusOK)
+			w.Close()
+		}()
+	}
+
+	llm, _, _ := hs.addAgentConnection(1, &token.AgentToken{Id: 1}, "/llm", log)
+	accept(llm)
+
+	// Test case 1: the requests out of the prefix are not routed to the agent.
+	assert.Equal(t, -http.StatusServiceUnavailable, serve("/v1/chat"))
+	assert.Equal(t, -http.StatusServiceUnavailable, serve("/llms/v1/chat"))
+
+	// Test case 2: the agent with the longest prefix is preferred over the catch-all one.
+	catchAll, _, _ := hs.addAgentConnection(2, &token.AgentToken{Id: 2}, "", log)
+	accept(catchAll)
+	assert.Equal(t, 1, serve("/llm/v1/chat"))
+	assert.Equal(t, 2, serve("/v1/chat"))
+}
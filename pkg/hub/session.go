@@ -0,0 +1,120 @@
+/*
+Copyright © 2023 Harry C <hoveychen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package hub
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/hoveychen/slime/pkg/token"
+	"google.golang.org/protobuf/proto"
+)
+
+// maxSessionSubmitGrace is how long after its session ends an in-flight request can still submit its result.
+const maxSessionSubmitGrace = 10 * time.Minute
+
+// WithSessionTTL makes the hub exchange the long-lived agent tokens for short-lived session credentials on join.
+// The other agent APIs only accept the session credentials then.
+func WithSessionTTL(ttl time.Duration) HubServerOption {
+	return func(hs *HubServer) {
+		hs.sessionTTL = ttl
+	}
+}
+
+// SessionRevocation is the reply of revoking the sessions with the admin API.
+type SessionRevocation struct {
+	RevokedAt time.Time
+}
+
+// RevokeSessions revokes all the issued sessions. The agents have to join again with their long-lived tokens.
+func (hs *HubServer) RevokeSessions() *SessionRevocation {
+	// The epoch is when the sessions are last revoked.
+	now := time.Now()
+	hs.sessionEpoch.Store(now.UnixNano())
+	return &SessionRevocation{RevokedAt: now}
+}
+
+// issueSession returns a session credential derived from the long-lived token, pinned to the agent ID.
+func (hs *HubServer) issueSession(tok *token.AgentToken, agentID int) (string, time.Time, error) {
+	expireAt := time.Now().Add(hs.sessionTTL)
+	if tok.GetExpireAt() > 0 && time.Unix(tok.GetExpireAt(), 0).Before(expireAt) {
+		expireAt = time.Unix(tok.GetExpireAt(), 0)
+	}
+
+	session := proto.Clone(tok).(*token.AgentToken)
+	session.Session = true
+	session.SessionEpoch = hs.sessionEpoch.Load()
+	session.ExpireAt = expireAt.Unix()
+	session.AgentIds = []int64{int64(agentID)}
+
+	encrypted, err := hs.tokenMgr.Encrypt(session)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return encrypted, expireAt, nil
+}
+
+// checkSession checks whether the token is the right kind of credential for the request,
+// and returns the reason if it's rejected.
+func (hs *HubServer) checkSession(r *http.Request, tok *token.AgentToken) string {
+	if !tok.GetSession() {
+		if hs.sessionTTL > 0 && r.URL.Path != PathJoin {
+			return "Session required"
+		}
+		return ""
+	}
+
+	now := time.Now()
+	var reason string
+	var endedAt time.Time
+	switch {
+	case r.URL.Path == PathJoin:
+		return "Session can't join"
+	case now.After(time.Unix(tok.GetExpireAt(), 0)):
+		reason, endedAt = "Session expired", time.Unix(tok.GetExpireAt(), 0)
+	case tok.GetSessionEpoch() != hs.sessionEpoch.Load():
+		reason, endedAt = "Session revoked", time.Unix(0, hs.sessionEpoch.Load())
+	default:
+		return ""
+	}
+	if r.URL.Path == PathSubmit && hs.inSubmitGrace(r, tok, endedAt, now) {
+		return ""
+	}
+	return reason
+}
+
+// inSubmitGrace reports whether the in-flight request of the session can still submit its result after the session
+// ended, until the deadline of the request, and no later than maxSessionSubmitGrace.
+func (hs *HubServer) inSubmitGrace(r *http.Request, tok *token.AgentToken, endedAt, now time.Time) bool {
+	if now.Sub(endedAt) > maxSessionSubmitGrace {
+		return false
+	}
+	connectionID, err := strconv.Atoi(r.Header.Get("slime-connection-id"))
+	if err != nil {
+		return false
+	}
+	conn := hs.connPool.GetConnection(connectionID)
+	if conn == nil || !conn.IsProcessing() || conn.TokenID() != tok.GetId() {
+		return false
+	}
+	if req := conn.Request(); req != nil {
+		if deadline, ok := req.Context().Deadline(); ok && now.After(deadline) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,164 @@
+/*
+Copyright © 2023 Harry C <hoveychen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package hub
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hoveychen/slime/pkg/pool"
+	"github.com/hoveychen/slime/pkg/token"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSession(t *testing.T) {
+	hs := NewHubServer("test-secret", WithSessionTTL(time.Minute))
+	tokenMgr := token.NewTokenManager([]byte("test-secret"))
+	longLived, _ := tokenMgr.Encrypt(&token.AgentToken{Id: 1, Name: "test-agent", Scopes: []string{"llm"}})
+
+	serve := func(path, agentToken, agentID string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", path, strings.NewReader("{}"))
+		req.Header.Set("slime-agent-token", agentToken)
+		req.Header.Set("slime-agent-id", agentID)
+		rr := httptest.NewRecorder()
+		hs.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// Test case 1: the long-lived token can only join
+	assert.Equal(t, http.StatusUnauthorized, serve(PathReport, longLived, "123").Code)
+
+	rr := serve(PathJoin, longLived, "123")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	session := rr.Header().Get("slime-session-token")
+	assert.NotEmpty(t, session)
+	expireAt, err := strconv.ParseInt(rr.Header().Get("slime-session-expire-at"), 10, 64)
+	assert.NoError(t, err)
+	assert.InDelta(t, time.Now().Add(time.Minute).Unix(), expireAt, 2)
+
+	tok, err := tokenMgr.Decrypt(session)
+	if assert.NoError(t, err) {
+		assert.True(t, tok.Session)
+		assert.Equal(t, []int64{123}, tok.AgentIds)
+		assert.Equal(t, []string{"llm"}, tok.Scopes)
+	}
+
+	// Test case 2: the session works for the other APIs, but only for the same agent ID
+	assert.Equal(t, http.StatusOK, serve(PathReport, session, "123").Code)
+	assert.Equal(t, http.StatusForbidden, serve(PathReport, session, "124").Code)
+
+	// Test case 3: the session can't join
+	assert.Equal(t, http.StatusUnauthorized, serve(PathJoin, session, "123").Code)
+
+	// Test case 4: revoked session
+	hs.RevokeSessions()
+	assert.Equal(t, http.StatusUnauthorized, serve(PathReport, session, "123").Code)
+
+	// Test case 5: expired session
+	tok.SessionEpoch = hs.sessionEpoch.Load()
+	tok.ExpireAt = time.Now().Add(-time.Second).Unix()
+	expired, _ := tokenMgr.Encrypt(tok)
+	assert.Equal(t, http.StatusUnauthorized, serve(PathReport, expired, "123").Code)
+}
+
+func TestIssueSessionCappedByTokenExpiry(t *testing.T) {
+	hs := NewHubServer("test-secret", WithSessionTTL(time.Hour))
+	tokenExpireAt := time.Now().Add(time.Minute).Unix()
+
+	_, expireAt, err := hs.issueSession(&token.AgentToken{Id: 1, ExpireAt: tokenExpireAt}, 123)
+	assert.NoError(t, err)
+	assert.Equal(t, tokenExpireAt, expireAt.Unix())
+}
+
+func TestCheckSessionSubmit(t *testing.T) {
+	hs := NewHubServer("test-secret", WithSessionTTL(time.Minute))
+	session := &token.AgentToken{Id: 1, Session: true, SessionEpoch: hs.sessionEpoch.Load(), ExpireAt: time.Now().Add(-time.Second).Unix()}
+
+	// The agent has accepted a request with a deadline.
+	conn := pool.NewConnection(123, &token.AgentToken{Id: 1})
+	hs.connPool.AddConnection(conn)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	go conn.Delegate(ctx, httptest.NewRecorder(), httptest.NewRequest("GET", "/v1/chat", nil).WithContext(ctx))
+	conn.Accept(ctx)
+	hs.connPool.MovePendingToProcessing(conn)
+
+	submit := func(connectionID int) *http.Request {
+		req := httptest.NewRequest("POST", PathSubmit, nil)
+		req.Header.Set("slime-connection-id", strconv.Itoa(connectionID))
+		return req
+	}
+
+	// The in-flight request can submit its result after the session expires.
+	assert.Empty(t, hs.checkSession(submit(conn.ID()), session))
+	req := httptest.NewRequest("POST", PathAccept, nil)
+	assert.Equal(t, "Session expired", hs.checkSession(req, session))
+
+	// But not for the unknown connections, or the connections of the other tokens.
+	assert.Equal(t, "Session expired", hs.checkSession(submit(conn.ID()+1), session))
+	other := &token.AgentToken{Id: 2, Session: true, SessionEpoch: session.SessionEpoch, ExpireAt: session.ExpireAt}
+	assert.Equal(t, "Session expired", hs.checkSession(submit(conn.ID()), other))
+
+	// The grace is bounded.
+	expiredLongAgo := &token.AgentToken{Id: 1, Session: true, SessionEpoch: session.SessionEpoch, ExpireAt: time.Now().Add(-maxSessionSubmitGrace - time.Minute).Unix()}
+	assert.Equal(t, "Session expired", hs.checkSession(submit(conn.ID()), expiredLongAgo))
+
+	// The revoked session can submit the in-flight request as well.
+	valid := &token.AgentToken{Id: 1, Session: true, SessionEpoch: session.SessionEpoch, ExpireAt: time.Now().Add(time.Minute).Unix()}
+	hs.RevokeSessions()
+	assert.Empty(t, hs.checkSession(submit(conn.ID()), valid))
+	assert.Equal(t, "Session revoked", hs.checkSession(req, valid))
+}
+
+func TestCheckSessionSubmitAfterDeadline(t *testing.T) {
+	hs := NewHubServer("test-secret", WithSessionTTL(time.Minute))
+	session := &token.AgentToken{Id: 1, Session: true, SessionEpoch: hs.sessionEpoch.Load(), ExpireAt: time.Now().Add(-time.Second).Unix()}
+
+	conn := pool.NewConnection(123, &token.AgentToken{Id: 1})
+	hs.connPool.AddConnection(conn)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	reqCtx, reqCancel := context.WithDeadline(ctx, time.Now().Add(-time.Second))
+	defer reqCancel()
+	go conn.Delegate(ctx, httptest.NewRecorder(), httptest.NewRequest("GET", "/v1/chat", nil).WithContext(reqCtx))
+	conn.Accept(ctx)
+
+	// The request is past its deadline, so its result is no longer awaited.
+	req := httptest.NewRequest("POST", PathSubmit, nil)
+	req.Header.Set("slime-connection-id", strconv.Itoa(conn.ID()))
+	assert.Equal(t, "Session expired", hs.checkSession(req, session))
+}
+
+func TestAdminRevokeSessions(t *testing.T) {
+	hs := NewHubServer("test-secret", WithSessionTTL(time.Minute), WithAdminPassword("admin"))
+	epoch := hs.sessionEpoch.Load()
+
+	req := httptest.NewRequest("POST", PathAdminRevoke, nil)
+	req.Header.Set("slime-admin-password", "admin")
+	rr := httptest.NewRecorder()
+	hs.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var revocation SessionRevocation
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &revocation))
+	assert.Equal(t, revocation.RevokedAt.UnixNano(), hs.sessionEpoch.Load())
+	assert.NotEqual(t, epoch, hs.sessionEpoch.Load())
+}
@@ -0,0 +1,241 @@
+/*
+Copyright © 2023 Harry C <hoveychen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package hub
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hoveychen/slime/pkg/hwinfo"
+)
+
+const (
+	// throughputWindow is the number of seconds the agent throughput is measured over.
+	throughputWindow = 60
+	// recentErrorsSize is the number of the recent failed requests kept.
+	recentErrorsSize = 50
+	// agentStatsTTL is how long the stats of a disconnected agent are kept after its last request.
+	agentStatsTTL = time.Hour
+)
+
+// DashboardStats is the snapshot of the hub shown in the dashboard.
+type DashboardStats struct {
+	Time              time.Time
+	Agents            []*AgentStats
+	Machines          int
+	GPUs              int
+	RequestsPerMinute int
+	// AdmissionQueueDepth is the number of requests waiting for a concurrent slot.
+	AdmissionQueueDepth int
+	// QueueDepth is the number of requests waiting for an agent by scope, "" for the unscoped ones.
+	QueueDepth   map[string]int
+	RecentErrors []*AccessLogEntry
+}
+
+// AgentStats is a connected agent with its throughput.
+type AgentStats struct {
+	*ConnectionInfo
+	RequestsPerMinute int
+	TotalRequests     int64
+	TotalErrors       int64
+}
+
+type agentCounter struct {
+	// counts is a ring of the requests per second, within the throughput window.
+	counts        [throughputWindow]int
+	lastSecond    int64
+	totalRequests int64
+	totalErrors   int64
+}
+
+func (c *agentCounter) add(now time.Time, failed bool) {
+	c.advance(now)
+	c.counts[c.lastSecond%throughputWindow]++
+	c.totalRequests++
+	if failed {
+		c.totalErrors++
+	}
+}
+
+// advance clears the seconds passed since the last request.
+func (c *agentCounter) advance(now time.Time) {
+	second := now.Unix()
+	for s := c.lastSecond + 1; s <= second && s <= c.lastSecond+throughputWindow; s++ {
+		c.counts[s%throughputWindow] = 0
+	}
+	if second > c.lastSecond {
+		c.lastSecond = second
+	}
+}
+
+func (c *agentCounter) perMinute(now time.Time) int {
+	c.advance(now)
+	total := 0
+	for _, count := range c.counts {
+		total += count
+	}
+	return total * 60 / throughputWindow
+}
+
+// requestStats collects the statistics of the application requests for the dashboard.
+type requestStats struct {
+	lock         sync.Mutex
+	agents       map[int]*agentCounter
+	queueDepth   map[string]int
+	recentErrors []*AccessLogEntry
+}
+
+func newRequestStats() *requestStats {
+	return &requestStats{
+		agents:     make(map[int]*agentCounter),
+		queueDepth: make(map[string]int),
+	}
+}
+
+// enqueue counts the request as waiting for an agent, until the returned function is called.
+func (s *requestStats) enqueue(scope string) func() {
+	if s == nil {
+		return func() {}
+	}
+	s.lock.Lock()
+	s.queueDepth[scope]++
+	s.lock.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			s.lock.Lock()
+			defer s.lock.Unlock()
+			if s.queueDepth[scope]--; s.queueDepth[scope] <= 0 {
+				delete(s.queueDepth, scope)
+			}
+		})
+	}
+}
+
+// record counts the finished request.
+func (s *requestStats) record(entry *AccessLogEntry) {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	failed := entry.Status >= http.StatusInternalServerError ||
+		(entry.Outcome != OutcomeOK && entry.Outcome != OutcomeUnauthorized && entry.Outcome != OutcomeRateLimited)
+	if entry.AgentID != 0 {
+		c, ok := s.agents[entry.AgentID]
+		if !ok {
+			c = &agentCounter{}
+			s.agents[entry.AgentID] = c
+		}
+		c.add(time.Now(), failed)
+	}
+	if failed {
+		s.recentErrors = append(s.recentErrors, entry)
+		if len(s.recentErrors) > recentErrorsSize {
+			s.recentErrors = s.recentErrors[len(s.recentErrors)-recentErrorsSize:]
+		}
+	}
+}
+
+// Stats returns the snapshot of the connected agents and the requests.
+func (hs *HubServer) Stats() *DashboardStats {
+	now := time.Now()
+	stats := &DashboardStats{
+		Time:                now,
+		AdmissionQueueDepth: hs.QueueDepth(),
+		QueueDepth:          make(map[string]int),
+	}
+
+	infos := hs.GetConnectionsInfos()
+	sort.Slice(infos, func(i, j int) bool {
+		if infos[i].AgentName != infos[j].AgentName {
+			return infos[i].AgentName < infos[j].AgentName
+		}
+		return infos[i].AgentID < infos[j].AgentID
+	})
+
+	s := hs.stats
+	if s == nil {
+		s = newRequestStats()
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	connected := make(map[int]bool)
+	machines := make(map[string]int)
+	for _, info := range infos {
+		agent := &AgentStats{ConnectionInfo: info}
+		if c, ok := s.agents[info.AgentID]; ok {
+			agent.RequestsPerMinute = c.perMinute(now)
+			agent.TotalRequests = c.totalRequests
+			agent.TotalErrors = c.totalErrors
+		}
+		stats.Agents = append(stats.Agents, agent)
+		stats.RequestsPerMinute += agent.RequestsPerMinute
+		connected[info.AgentID] = true
+
+		// The workers of the same machine join with the same hardware, so count the machine once.
+		// Without the fingerprint, e.g. by the coarse policy, the agent name stands for the machine.
+		if info.HardwareInfo != nil {
+			machine := info.HardwareInfo.Fingerprint
+			if machine == "" {
+				machine = "name:" + info.AgentName
+			}
+			machines[machine] = countGPUs(info.HardwareInfo)
+		}
+	}
+	stats.Machines = len(machines)
+	for _, gpus := range machines {
+		stats.GPUs += gpus
+	}
+
+	for agentID, c := range s.agents {
+		if !connected[agentID] && now.Unix()-c.lastSecond > int64(agentStatsTTL.Seconds()) {
+			delete(s.agents, agentID)
+		}
+	}
+	for scope, depth := range s.queueDepth {
+		stats.QueueDepth[scope] = depth
+	}
+	for i := len(s.recentErrors) - 1; i >= 0; i-- {
+		stats.RecentErrors = append(stats.RecentErrors, s.recentErrors[i])
+	}
+	return stats
+}
+
+// countGPUs counts the GPUs of the machine, from the live stats if reported, or the compressed names like "2x A100".
+func countGPUs(info *hwinfo.HWInfo) int {
+	if len(info.GPUStats) > 0 {
+		return len(info.GPUStats)
+	}
+	count := 0
+	for _, name := range info.GPUNames {
+		n := 1
+		if prefix, _, found := strings.Cut(name, "x "); found {
+			if parsed, err := strconv.Atoi(prefix); err == nil {
+				n = parsed
+			}
+		}
+		count += n
+	}
+	return count
+}
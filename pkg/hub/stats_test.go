@@ -0,0 +1,100 @@
+/*
+Copyright © 2023 Harry C <hoveychen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package hub
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/hoveychen/slime/pkg/hwinfo"
+	"github.com/hoveychen/slime/pkg/pool"
+	"github.com/hoveychen/slime/pkg/token"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAgentCounter(t *testing.T) {
+	c := &agentCounter{}
+	now := time.Unix(1000, 0)
+	c.add(now, false)
+	c.add(now, true)
+	c.add(now.Add(30*time.Second), false)
+	assert.Equal(t, 3, c.perMinute(now.Add(30*time.Second)))
+	assert.Equal(t, 1, c.perMinute(now.Add(time.Minute)))
+	assert.Equal(t, 0, c.perMinute(now.Add(time.Hour)))
+	assert.Equal(t, int64(3), c.totalRequests)
+	assert.Equal(t, int64(1), c.totalErrors)
+}
+
+func TestCountGPUs(t *testing.T) {
+	assert.Equal(t, 0, countGPUs(&hwinfo.HWInfo{}))
+	assert.Equal(t, 3, countGPUs(&hwinfo.HWInfo{GPUNames: []string{"2x NVIDIA A100", "NVIDIA T4"}}))
+	assert.Equal(t, 1, countGPUs(&hwinfo.HWInfo{
+		GPUNames: []string{"2x NVIDIA A100"},
+		GPUStats: []hwinfo.GPUStat{{Name: "NVIDIA A100"}},
+	}))
+}
+
+func TestStats(t *testing.T) {
+	catalog := NewMemoryCatalog()
+	hs := NewHubServer("test-secret", WithCatalog(catalog))
+
+	// Two workers of the same machine, and another machine.
+	gpuMachine := &hwinfo.HWInfo{GPUNames: []string{"2x NVIDIA A100"}, Fingerprint: "machine-1"}
+	for _, agentID := range []int{1, 2} {
+		hs.connPool.AddConnection(pool.NewConnection(agentID, &token.AgentToken{Name: "gpu"}))
+		catalog.SetHardwareInfo(agentID, gpuMachine)
+	}
+	hs.connPool.AddConnection(pool.NewConnection(3, &token.AgentToken{Name: "cpu"}))
+	catalog.SetHardwareInfo(3, &hwinfo.HWInfo{})
+
+	hs.stats.record(&AccessLogEntry{AgentID: 1, Status: 200, Outcome: OutcomeOK})
+	hs.stats.record(&AccessLogEntry{AgentID: 1, Status: 500, Outcome: OutcomeOK})
+	hs.stats.record(&AccessLogEntry{Status: 429, Outcome: OutcomeRateLimited})
+	hs.stats.record(&AccessLogEntry{RequestID: "no-agent", Status: 503, Outcome: OutcomeNoAgent})
+	dequeue := hs.stats.enqueue("llm")
+
+	stats := hs.Stats()
+	assert.Len(t, stats.Agents, 3)
+	assert.Equal(t, 2, stats.Machines)
+	assert.Equal(t, 2, stats.GPUs)
+	assert.Equal(t, 2, stats.RequestsPerMinute)
+	assert.Equal(t, map[string]int{"llm": 1}, stats.QueueDepth)
+	if assert.Len(t, stats.RecentErrors, 2) {
+		assert.Equal(t, "no-agent", stats.RecentErrors[0].RequestID)
+	}
+	for _, agent := range stats.Agents {
+		if agent.AgentID == 1 {
+			assert.Equal(t, int64(2), agent.TotalRequests)
+			assert.Equal(t, int64(1), agent.TotalErrors)
+		}
+	}
+
+	dequeue()
+	dequeue()
+	assert.Empty(t, hs.Stats().QueueDepth)
+}
+
+func TestStatsRecentErrors(t *testing.T) {
+	hs := NewHubServer("test-secret")
+	for i := 0; i < recentErrorsSize+10; i++ {
+		hs.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	}
+	stats := hs.Stats()
+	assert.Len(t, stats.RecentErrors, recentErrorsSize)
+	assert.Equal(t, OutcomeNoAgent, stats.RecentErrors[0].Outcome)
+	assert.Empty(t, stats.QueueDepth)
+}
@@ -0,0 +1,112 @@
+/*
+Copyright © 2023 Harry C <hoveychen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package hub
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// WithTimeout sets the default timeout of the application requests, from the arrival to the end of the response.
+// 0 for no timeout.
+func WithTimeout(timeout time.Duration) HubServerOption {
+	return func(hs *HubServer) {
+		hs.timeout = timeout
+	}
+}
+
+// WithScopeTimeouts sets the timeouts of the application requests by scope, in place of the default one.
+func WithScopeTimeouts(timeouts map[string]time.Duration) HubServerOption {
+	return func(hs *HubServer) {
+		hs.scopeTimeouts = timeouts
+	}
+}
+
+// WithMaxTimeout caps the timeout requested by the applications with the Slime-Timeout header.
+// When 0, the applications can only shorten the timeout of the scope.
+func WithMaxTimeout(timeout time.Duration) HubServerOption {
+	return func(hs *HubServer) {
+		hs.maxTimeout = timeout
+	}
+}
+
+// timeoutOf returns the timeout of the application request, 0 for no timeout. The application may request its own
+// timeout with the Slime-Timeout header, either a duration like "30s" or in seconds, capped by the policy.
+func (hs *HubServer) timeoutOf(r *http.Request) (time.Duration, error) {
+	timeout := hs.timeout
+	if scopeTimeout, ok := hs.scopeTimeouts[r.Header.Get("slime-scope")]; ok {
+		timeout = scopeTimeout
+	}
+	header := r.Header.Get("Slime-Timeout")
+	if header == "" {
+		return timeout, nil
+	}
+	requested, err := parseTimeout(header)
+	if err != nil {
+		return 0, err
+	}
+	limit := timeout
+	if hs.maxTimeout > 0 {
+		limit = hs.maxTimeout
+	}
+	if limit > 0 && requested > limit {
+		requested = limit
+	}
+	return requested, nil
+}
+
+func parseTimeout(s string) (time.Duration, error) {
+	timeout, err := time.ParseDuration(s)
+	if err != nil {
+		seconds, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return 0, errors.New("invalid timeout")
+		}
+		timeout = time.Duration(seconds * float64(time.Second))
+	}
+	if timeout <= 0 {
+		return 0, errors.New("invalid timeout")
+	}
+	return timeout, nil
+}
+
+// setUpstreamTimeout tells the agent the time left for the request, to stop the upstream request when it runs out.
+// The time left is sent rather than the deadline, as the clocks of the agents may be off from the hub's.
+func setUpstreamTimeout(r *http.Request) {
+	deadline, ok := r.Context().Deadline()
+	if !ok {
+		return
+	}
+	left := time.Until(deadline).Milliseconds()
+	if left < 1 {
+		left = 1
+	}
+	r.Header.Set("slime-timeout-ms", strconv.FormatInt(left, 10))
+}
+
+// replyTimeout replies 504 to the timed out application request, unless the response has started.
+func (hs *HubServer) replyTimeout(rec *responseRecorder, entry *AccessLogEntry, log *logrus.Entry) {
+	entry.Outcome = OutcomeTimeout
+	if rec.status != 0 {
+		log.Warn("Application request timed out in response")
+		return
+	}
+	hs.replyError(rec, log, http.StatusGatewayTimeout, ErrorTimeout, "Gateway Timeout", "Application request timed out")
+}
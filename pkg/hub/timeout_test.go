@@ -0,0 +1,208 @@
+/*
+Copyright © 2023 Harry C <hoveychen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package hub
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/hoveychen/slime/pkg/pool"
+	"github.com/hoveychen/slime/pkg/token"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTimeoutOf(t *testing.T) {
+	newRequest := func(scope, timeout string) *http.Request {
+		r := httptest.NewRequest("GET", "/", nil)
+		if scope != "" {
+			r.Header.Set("slime-scope", scope)
+		}
+		if timeout != "" {
+			r.Header.Set("Slime-Timeout", timeout)
+		}
+		return r
+	}
+	hs := NewHubServer("test-secret", WithTimeout(time.Minute), WithScopeTimeouts(map[string]time.Duration{"llm": 10 * time.Minute}))
+
+	tests := []struct {
+		scope   string
+		timeout string
+		want    time.Duration
+	}{
+		{"", "", time.Minute},
+		{"llm", "", 10 * time.Minute},
+		{"", "30s", 30 * time.Second},
+		{"", "1.5", 1500 * time.Millisecond},
+		// Capped by the timeout of the scope without the max timeout.
+		{"", "1h", time.Minute},
+		{"llm", "1h", 10 * time.Minute},
+	}
+	for _, tt := range tests {
+		got, err := hs.timeoutOf(newRequest(tt.scope, tt.timeout))
+		assert.NoError(t, err)
+		assert.Equal(t, tt.want, got, "%s %s", tt.scope, tt.timeout)
+	}
+
+	_, err := hs.timeoutOf(newRequest("", "-1s"))
+	assert.Error(t, err)
+	_, err = hs.timeoutOf(newRequest("", "soon"))
+	assert.Error(t, err)
+
+	// Test case: with the max timeout
+	hs = NewHubServer("test-secret", WithTimeout(time.Minute), WithMaxTimeout(time.Hour))
+	got, _ := hs.timeoutOf(newRequest("", "30m"))
+	assert.Equal(t, 30*time.Minute, got)
+	got, _ = hs.timeoutOf(newRequest("", "2h"))
+	assert.Equal(t, time.Hour, got)
+
+	// Test case: no timeout by default
+	got, _ = NewHubServer("test-secret").timeoutOf(newRequest("", ""))
+	assert.Zero(t, got)
+}
+
+func TestRequestTimeout(t *testing.T) {
+	var buf bytes.Buffer
+	hs := NewHubServer("test-secret", WithAccessLog(&buf, AccessLogJSON))
+	conn := pool.NewConnection(1, &token.AgentToken{Name: "hung-agent"})
+	hs.connPool.AddConnection(conn)
+
+	// The agent never submits the result.
+	forwarded := make(chan *http.Request, 1)
+	go func() {
+		forwarded <- conn.Accept(context.Background())
+	}()
+
+	req := httptest.NewRequest("GET", "/v1/chat", nil)
+	req.Header.Set("Slime-Timeout", "100ms")
+	rr := httptest.NewRecorder()
+	start := time.Now()
+	hs.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusGatewayTimeout, rr.Code)
+	assert.Less(t, time.Since(start), time.Second)
+	assert.Nil(t, hs.connPool.GetConnection(conn.ID()))
+
+	r := <-forwarded
+	assert.Empty(t, r.Header.Get("Slime-Timeout"))
+	left, err := strconv.ParseInt(r.Header.Get("slime-timeout-ms"), 10, 64)
+	assert.NoError(t, err)
+	assert.InDelta(t, 100, left, 50)
+
+	var entry AccessLogEntry
+	assert.NoError(t, json.Unmarshal(buf.Bytes(), &entry))
+	assert.Equal(t, OutcomeTimeout, entry.Outcome)
+	assert.Equal(t, http.StatusGatewayTimeout, entry.Status)
+
+	// Waiting for an agent.
+	req = httptest.NewRequest("GET", "/v1/chat", nil)
+	req.Header.Set("Slime-Timeout", "100ms")
+	req.Header.Set("slime-block", "1")
+	rr = httptest.NewRecorder()
+	hs.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusGatewayTimeout, rr.Code)
+
+	// Invalid timeout.
+	req = httptest.NewRequest("GET", "/v1/chat", nil)
+	req.Header.Set("Slime-Timeout", "soon")
+	rr = httptest.NewRecorder()
+	hs.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
+
+func TestTimeoutInResponse(t *testing.T) {
+	hs := NewHubServer("test-secret")
+	conn := pool.NewConnection(1, &token.AgentToken{Name: "test-agent"})
+	hs.connPool.AddConnection(conn)
+
+	// The agent starts the response, and fails in the middle of the body after the request timed out.
+	pr, pw := io.Pipe()
+	submitted := make(chan struct{})
+	go func() {
+		defer close(submitted)
+		conn.Accept(context.Background())
+		req := httptest.NewRequest("POST", PathSubmit, pr)
+		req.Header.Set("slime-connection-id", strconv.Itoa(conn.ID()))
+		req = req.WithContext(token.NewContext(req.Context(), &token.AgentToken{Name: "test-agent"}))
+		hs.handleAgentSubmit(httptest.NewRecorder(), req)
+	}()
+	go func() {
+		pw.Write([]byte("HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n"))
+		time.Sleep(200 * time.Millisecond)
+		pw.CloseWithError(errors.New("agent gone"))
+	}()
+
+	req := httptest.NewRequest("GET", "/v1/chat", nil)
+	req.Header.Set("Slime-Timeout", "100ms")
+	rr := httptest.NewRecorder()
+	hs.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	// The hub survives the failure of the agent after the timeout.
+	select {
+	case <-submitted:
+	case <-time.After(time.Second):
+		t.Fatal("submit not finished")
+	}
+	// Nothing is written after the application request has returned.
+	assert.Equal(t, "hello", rr.Body.String())
+}
+
+func TestTimeoutBeforeResponse(t *testing.T) {
+	hs := NewHubServer("test-secret")
+	conn := pool.NewConnection(1, &token.AgentToken{Name: "test-agent"})
+	hs.connPool.AddConnection(conn)
+
+	// The agent submits the response after the request timed out.
+	pr, pw := io.Pipe()
+	submitted := make(chan struct{})
+	go func() {
+		defer close(submitted)
+		conn.Accept(context.Background())
+		req := httptest.NewRequest("POST", PathSubmit, pr)
+		req.Header.Set("slime-connection-id", strconv.Itoa(conn.ID()))
+		req = req.WithContext(token.NewContext(req.Context(), &token.AgentToken{Name: "test-agent"}))
+		hs.handleAgentSubmit(httptest.NewRecorder(), req)
+	}()
+	go func() {
+		time.Sleep(150 * time.Millisecond)
+		pw.Write([]byte("HTTP/1.1 201 Created\r\nX-Late: 1\r\nContent-Length: 4\r\n\r\nlate"))
+		pw.Close()
+	}()
+
+	req := httptest.NewRequest("GET", "/v1/chat", nil)
+	req.Header.Set("Slime-Timeout", "100ms")
+	rr := httptest.NewRecorder()
+	hs.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusGatewayTimeout, rr.Code)
+
+	select {
+	case <-submitted:
+	case <-time.After(time.Second):
+		t.Fatal("submit not finished")
+	}
+	// The late response never reaches the application.
+	assert.Equal(t, http.StatusGatewayTimeout, rr.Code)
+	assert.Empty(t, rr.Header().Get("X-Late"))
+	assert.NotContains(t, rr.Body.String(), "late")
+}
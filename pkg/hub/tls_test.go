@@ -0,0 +1,114 @@
+/*
+Copyright © 2023 Harry C <hoveychen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package hub
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/hoveychen/slime/pkg/tlsutil"
+	"github.com/hoveychen/slime/pkg/token"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestClientCert(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "agent"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	leaf, _ := x509.ParseCertificate(der)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestWrapTokenValidatorClientCert(t *testing.T) {
+	tokenMgr := &mockTokenManager{}
+	hs := &HubServer{tokenMgr: tokenMgr}
+	mockHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	testServer := httptest.NewUnstartedServer(hs.wrapTokenValidator(mockHandler))
+	testServer.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	testServer.StartTLS()
+	defer testServer.Close()
+
+	certA := newTestClientCert(t)
+	certB := newTestClientCert(t)
+	tokenMgr.tok = &token.AgentToken{CertFingerprint: tlsutil.Fingerprint(certA.Leaf)}
+
+	do := func(certs ...tls.Certificate) int {
+		transport := testServer.Client().Transport.(*http.Transport).Clone()
+		transport.TLSClientConfig.Certificates = certs
+		req, _ := http.NewRequest("POST", testServer.URL, nil)
+		req.Header.Set("slime-agent-token", "encrypted-token")
+		req.Header.Set("slime-agent-id", "123")
+		resp, err := (&http.Client{Transport: transport}).Do(req)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// Test case 1: the bound certificate
+	assert.Equal(t, http.StatusOK, do(certA))
+
+	// Test case 2: another certificate
+	assert.Equal(t, http.StatusUnauthorized, do(certB))
+
+	// Test case 3: no certificate
+	assert.Equal(t, http.StatusUnauthorized, do())
+
+	// Test case 4: no TLS at all, e.g. behind a proxy terminating TLS
+	plainServer := httptest.NewServer(hs.wrapTokenValidator(mockHandler))
+	defer plainServer.Close()
+	req, _ := http.NewRequest("POST", plainServer.URL, nil)
+	req.Header.Set("slime-agent-token", "encrypted-token")
+	req.Header.Set("slime-agent-id", "123")
+	if resp, err := http.DefaultClient.Do(req); assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	}
+
+	// Test case 5: unbound token with any certificate
+	tokenMgr.tok = &token.AgentToken{}
+	assert.Equal(t, http.StatusOK, do(certB))
+	assert.Equal(t, http.StatusOK, do())
+
+	// Test case 6: a verified certificate is required, but the server never verifies it
+	hs.requireClientCert = true
+	assert.Equal(t, http.StatusUnauthorized, do(certB))
+}
@@ -0,0 +1,59 @@
+/*
+Copyright © 2023 Harry C <hoveychen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package hub
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+
+	"github.com/hoveychen/slime/pkg/tracing"
+)
+
+// WithTracer emits the spans of the application requests, from the queue to the dispatch to the agents.
+func WithTracer(t *tracing.Tracer) HubServerOption {
+	return func(hs *HubServer) {
+		hs.tracer = t
+	}
+}
+
+// requestIDOf returns the request ID given by the application, either the X-Request-Id or the trace ID of the
+// traceparent header. Otherwise, it generates a new one.
+func requestIDOf(r *http.Request) string {
+	if requestID := r.Header.Get("X-Request-Id"); requestID != "" {
+		return requestID
+	}
+	if sc, ok := tracing.ParseTraceparent(r.Header.Get("traceparent")); ok {
+		return sc.TraceID.String()
+	}
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// propagateRequestID passes the request ID through the agent to the upstream, and echoes it to the application.
+func propagateRequestID(w http.ResponseWriter, r *http.Request, requestID string) {
+	r.Header.Set("X-Request-Id", requestID)
+	w.Header().Set("X-Request-Id", requestID)
+}
+
+// propagateSpan passes the span to the agent as the parent of its spans, if tracing is enabled.
+// Otherwise, the traceparent header of the application is passed through as is.
+func propagateSpan(r *http.Request, span *tracing.Span) {
+	if sc := span.Context(); sc.IsValid() {
+		r.Header.Set("traceparent", sc.Traceparent())
+	}
+}
@@ -0,0 +1,71 @@
+/*
+Copyright © 2023 Harry C <hoveychen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package hub
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/hoveychen/slime/pkg/tracing"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestIDOf(t *testing.T) {
+	req := httptest.NewRequest("GET", "/", nil)
+	generated := requestIDOf(req)
+	assert.Len(t, generated, 16)
+	assert.NotEqual(t, generated, requestIDOf(req))
+
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", requestIDOf(req))
+
+	req.Header.Set("X-Request-Id", "req-1")
+	assert.Equal(t, "req-1", requestIDOf(req))
+}
+
+func TestHandleAppRequestEchoRequestID(t *testing.T) {
+	hs := NewHubServer("test-secret")
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Request-Id", "req-1")
+	rr := httptest.NewRecorder()
+	hs.ServeHTTP(rr, req)
+	assert.Equal(t, "req-1", rr.Header().Get("X-Request-Id"))
+
+	rr = httptest.NewRecorder()
+	hs.ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+	assert.NotEmpty(t, rr.Header().Get("X-Request-Id"))
+}
+
+func TestPropagateSpan(t *testing.T) {
+	const traceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+	// Test case 1: passed through without tracing
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("traceparent", traceparent)
+	var tracer *tracing.Tracer
+	propagateSpan(req, tracer.Start(tracing.SpanContext{}, "hub.dispatch", tracing.SpanKindInternal))
+	assert.Equal(t, traceparent, req.Header.Get("traceparent"))
+
+	// Test case 2: the span becomes the parent in the same trace
+	tracer = tracing.NewTracer("test", "http://localhost:4318")
+	parent, _ := tracing.ParseTraceparent(traceparent)
+	span := tracer.Start(parent, "hub.dispatch", tracing.SpanKindInternal)
+	propagateSpan(req, span)
+	propagated, ok := tracing.ParseTraceparent(req.Header.Get("traceparent"))
+	assert.True(t, ok)
+	assert.Equal(t, parent.TraceID, propagated.TraceID)
+	assert.Equal(t, span.Context().SpanID, propagated.SpanID)
+}
@@ -0,0 +1,196 @@
+/*
+Copyright © 2023 Harry C <hoveychen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package hwinfo
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// GPUStat is a live snapshot of a single GPU.
+type GPUStat struct {
+	Index              int
+	Name               string
+	UUID               string
+	MemoryTotalMB      float32
+	MemoryUsedMB       float32
+	UtilizationPercent float32
+	TemperatureC       float32
+}
+
+// GPUCollector collects the live GPU statistics of the machine.
+type GPUCollector interface {
+	CollectGPUStats(ctx context.Context) ([]GPUStat, error)
+}
+
+// NewGPUCollector returns the first collector available on the machine, or nil if there is none.
+func NewGPUCollector() GPUCollector {
+	if path, err := exec.LookPath("nvidia-smi"); err == nil {
+		return &NvidiaSMICollector{Path: path}
+	}
+	return NewSysfsCollector()
+}
+
+// NewSysfsCollector returns the sysfs collector if any GPU is exposed there, or nil if there is none.
+func NewSysfsCollector() GPUCollector {
+	sysfs := &SysfsCollector{Root: defaultSysfsRoot}
+	if matches, _ := filepath.Glob(filepath.Join(sysfs.Root, "card*", "device", "mem_info_vram_total")); len(matches) > 0 {
+		return sysfs
+	}
+	return nil
+}
+
+var nvidiaSMIQuery = []string{
+	"--query-gpu=index,uuid,name,memory.total,memory.used,utilization.gpu,temperature.gpu",
+	"--format=csv,noheader,nounits",
+}
+
+// NvidiaSMICollector collects GPU statistics from the nvidia-smi CSV output.
+type NvidiaSMICollector struct {
+	Path string
+}
+
+func (c *NvidiaSMICollector) CollectGPUStats(ctx context.Context) ([]GPUStat, error) {
+	path := c.Path
+	if path == "" {
+		path = "nvidia-smi"
+	}
+	out, err := exec.CommandContext(ctx, path, nvidiaSMIQuery...).Output()
+	if err != nil {
+		return nil, err
+	}
+	return parseNvidiaSMI(bytes.NewReader(out))
+}
+
+func parseNvidiaSMI(r io.Reader) ([]GPUStat, error) {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+	reader.FieldsPerRecord = 7
+
+	var stats []GPUStat
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		index, err := strconv.Atoi(record[0])
+		if err != nil {
+			return nil, err
+		}
+		stats = append(stats, GPUStat{
+			Index:              index,
+			UUID:               record[1],
+			Name:               record[2],
+			MemoryTotalMB:      parseNvidiaSMIValue(record[3]),
+			MemoryUsedMB:       parseNvidiaSMIValue(record[4]),
+			UtilizationPercent: parseNvidiaSMIValue(record[5]),
+			TemperatureC:       parseNvidiaSMIValue(record[6]),
+		})
+	}
+	return stats, nil
+}
+
+// parseNvidiaSMIValue parses a numeric field, treating "[N/A]" and "[Not Supported]" as zero.
+func parseNvidiaSMIValue(s string) float32 {
+	v, err := strconv.ParseFloat(strings.TrimSpace(s), 32)
+	if err != nil {
+		return 0
+	}
+	return float32(v)
+}
+
+const defaultSysfsRoot = "/sys/class/drm"
+
+// SysfsCollector collects GPU statistics from the DRM sysfs interface, as exposed by the amdgpu driver.
+type SysfsCollector struct {
+	Root string
+}
+
+func (c *SysfsCollector) CollectGPUStats(ctx context.Context) ([]GPUStat, error) {
+	root := c.Root
+	if root == "" {
+		root = defaultSysfsRoot
+	}
+	cards, err := filepath.Glob(filepath.Join(root, "card*"))
+	if err != nil {
+		return nil, err
+	}
+
+	var stats []GPUStat
+	for _, card := range cards {
+		index, err := strconv.Atoi(strings.TrimPrefix(filepath.Base(card), "card"))
+		if err != nil {
+			// Skip connectors like card0-HDMI-A-1.
+			continue
+		}
+		device := filepath.Join(card, "device")
+		total, err := readSysfsInt(filepath.Join(device, "mem_info_vram_total"))
+		if err != nil {
+			continue
+		}
+		stat := GPUStat{
+			Index:         index,
+			Name:          readSysfsString(filepath.Join(device, "product_name")),
+			UUID:          readSysfsString(filepath.Join(device, "unique_id")),
+			MemoryTotalMB: float32(total) / 1024 / 1024,
+		}
+		if stat.Name == "" {
+			stat.Name = "Unknown"
+		}
+		if used, err := readSysfsInt(filepath.Join(device, "mem_info_vram_used")); err == nil {
+			stat.MemoryUsedMB = float32(used) / 1024 / 1024
+		}
+		if busy, err := readSysfsInt(filepath.Join(device, "gpu_busy_percent")); err == nil {
+			stat.UtilizationPercent = float32(busy)
+		}
+		if temps, _ := filepath.Glob(filepath.Join(device, "hwmon", "hwmon*", "temp1_input")); len(temps) > 0 {
+			if temp, err := readSysfsInt(temps[0]); err == nil {
+				stat.TemperatureC = float32(temp) / 1000
+			}
+		}
+		stats = append(stats, stat)
+	}
+	// Sort by the card number, as the names sort card10 before card2.
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Index < stats[j].Index })
+	return stats, nil
+}
+
+func readSysfsString(path string) string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+func readSysfsInt(path string) (int64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+}
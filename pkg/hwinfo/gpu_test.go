@@ -0,0 +1,102 @@
+/*
+Copyright © 2023 Harry C <hoveychen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package hwinfo
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseNvidiaSMI(t *testing.T) {
+	f, err := os.Open("testdata/nvidia-smi.csv")
+	if err != nil {
+		t.Fatalf("Failed to open fixture: %v", err)
+	}
+	defer f.Close()
+
+	stats, err := parseNvidiaSMI(f)
+	assert.NoError(t, err)
+	assert.Equal(t, []GPUStat{
+		{
+			Index:              0,
+			UUID:               "GPU-5e4a1c6b-7d0f-4b6e-9a2e-0c1f3b2d4e5f",
+			Name:               "NVIDIA GeForce RTX 4090",
+			MemoryTotalMB:      24564,
+			MemoryUsedMB:       18321,
+			UtilizationPercent: 97,
+			TemperatureC:       71,
+		},
+		{
+			Index:         1,
+			UUID:          "GPU-0a9b8c7d-6e5f-4a3b-2c1d-0e9f8a7b6c5d",
+			Name:          "NVIDIA GeForce RTX 4090",
+			MemoryTotalMB: 24564,
+		},
+	}, stats)
+}
+
+func TestParseNvidiaSMIMalformed(t *testing.T) {
+	_, err := parseNvidiaSMI(strings.NewReader("0, GPU-1, Tesla T4\n"))
+	assert.Error(t, err)
+
+	_, err = parseNvidiaSMI(strings.NewReader("x, GPU-1, Tesla T4, 1, 2, 3, 4\n"))
+	assert.Error(t, err)
+}
+
+func TestSysfsCollector(t *testing.T) {
+	c := &SysfsCollector{Root: "testdata/sys"}
+	stats, err := c.CollectGPUStats(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, []GPUStat{
+		{
+			Index:              0,
+			Name:               "AMD Radeon RX 7800 XT",
+			MemoryTotalMB:      16368,
+			MemoryUsedMB:       4096,
+			UtilizationPercent: 42,
+			TemperatureC:       55,
+		},
+	}, stats)
+}
+
+func TestSysfsCollectorOrder(t *testing.T) {
+	root := t.TempDir()
+	for _, card := range []string{"card10", "card2", "card1"} {
+		device := filepath.Join(root, card, "device")
+		assert.NoError(t, os.MkdirAll(device, 0755))
+		assert.NoError(t, os.WriteFile(filepath.Join(device, "mem_info_vram_total"), []byte("1048576\n"), 0644))
+	}
+	c := &SysfsCollector{Root: root}
+	stats, err := c.CollectGPUStats(context.Background())
+	assert.NoError(t, err)
+	var indexes []int
+	for _, stat := range stats {
+		indexes = append(indexes, stat.Index)
+	}
+	assert.Equal(t, []int{1, 2, 10}, indexes)
+}
+
+func TestSysfsCollectorMissingRoot(t *testing.T) {
+	c := &SysfsCollector{Root: "testdata/missing"}
+	stats, err := c.CollectGPUStats(context.Background())
+	assert.NoError(t, err)
+	assert.Empty(t, stats)
+}
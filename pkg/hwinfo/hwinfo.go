@@ -29,7 +29,9 @@ type HWInfo struct {
 	MemoryUsableGB   float32
 	MemoryPhysicalGB float32
 	GPUNames         []string
+	GPUStats         []GPUStat
 	MacAddresses     []string
+	Fingerprint      string
 	PlatformArch     string
 	PlatformOS       string
 }
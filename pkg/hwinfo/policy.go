@@ -0,0 +1,131 @@
+/*
+Copyright © 2023 Harry C <hoveychen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package hwinfo
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ReportPolicy controls how much of the identifying hardware information leaves the agent.
+type ReportPolicy string
+
+const (
+	// ReportFull reports the raw identifiers, like MAC addresses and GPU UUIDs.
+	ReportFull ReportPolicy = "full"
+	// ReportHashed replaces the identifiers with keyed hashes, which are stable per machine.
+	ReportHashed ReportPolicy = "hashed"
+	// ReportCoarse drops the identifiers and the fingerprint, and rounds the memory sizes.
+	ReportCoarse ReportPolicy = "coarse"
+)
+
+func ParseReportPolicy(s string) (ReportPolicy, error) {
+	switch policy := ReportPolicy(strings.ToLower(s)); policy {
+	case ReportFull, ReportHashed, ReportCoarse:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("invalid hardware report policy: %q", s)
+	}
+}
+
+// Redact returns a copy of the info following the policy.
+// Unless the policy is coarse, the fingerprint is derived from the raw MAC addresses before they are redacted.
+func (info *HWInfo) Redact(policy ReportPolicy) *HWInfo {
+	redacted := *info
+	redacted.MacAddresses = nil
+	redacted.GPUStats = RedactGPUStats(info.GPUStats, policy)
+
+	switch policy {
+	case ReportFull:
+		redacted.MacAddresses = append(redacted.MacAddresses, info.MacAddresses...)
+		redacted.Fingerprint = fingerprint(info.MacAddresses)
+	case ReportHashed:
+		for _, mac := range info.MacAddresses {
+			redacted.MacAddresses = append(redacted.MacAddresses, hashIdentifier(mac))
+		}
+		redacted.Fingerprint = fingerprint(info.MacAddresses)
+	default:
+		redacted.Fingerprint = ""
+		redacted.MemoryUsableGB = roundGB(info.MemoryUsableGB)
+		redacted.MemoryPhysicalGB = roundGB(info.MemoryPhysicalGB)
+	}
+	return &redacted
+}
+
+// RedactGPUStats returns a copy of the stats with the GPU UUIDs redacted following the policy.
+func RedactGPUStats(stats []GPUStat, policy ReportPolicy) []GPUStat {
+	if stats == nil {
+		return nil
+	}
+	redacted := make([]GPUStat, len(stats))
+	for i, stat := range stats {
+		switch policy {
+		case ReportFull:
+		case ReportHashed:
+			if stat.UUID != "" {
+				stat.UUID = hashIdentifier(stat.UUID)
+			}
+		default:
+			stat.UUID = ""
+		}
+		redacted[i] = stat
+	}
+	return redacted
+}
+
+func roundGB(gb float32) float32 {
+	return float32(int(gb + 0.5))
+}
+
+// fingerprint returns a stable identifier of the machine, without revealing the MAC addresses.
+func fingerprint(macs []string) string {
+	if len(macs) == 0 {
+		return ""
+	}
+	sorted := append([]string(nil), macs...)
+	sort.Strings(sorted)
+	return hashIdentifier(strings.Join(sorted, ","))
+}
+
+var machineIDPaths = []string{"/etc/machine-id", "/var/lib/dbus/machine-id"}
+
+var (
+	machineKeyOnce sync.Once
+	machineKey     []byte
+)
+
+// hashIdentifier hashes the identifier with the machine ID as the key, so that the hub can't
+// brute force the small space of MAC addresses. Without a machine ID, it falls back to a plain hash.
+func hashIdentifier(id string) string {
+	machineKeyOnce.Do(func() {
+		for _, path := range machineIDPaths {
+			if data, err := os.ReadFile(path); err == nil && len(strings.TrimSpace(string(data))) > 0 {
+				machineKey = []byte(strings.TrimSpace(string(data)))
+				return
+			}
+		}
+	})
+
+	mac := hmac.New(sha256.New, machineKey)
+	mac.Write([]byte(strings.ToLower(id)))
+	return hex.EncodeToString(mac.Sum(nil))[:16]
+}
@@ -0,0 +1,109 @@
+/*
+Copyright © 2023 Harry C <hoveychen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package hwinfo
+
+import (
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func useMachineID(t *testing.T, paths ...string) {
+	originalPaths := machineIDPaths
+	t.Cleanup(func() {
+		machineIDPaths = originalPaths
+		machineKeyOnce = sync.Once{}
+		machineKey = nil
+	})
+	machineIDPaths = paths
+	machineKeyOnce = sync.Once{}
+	machineKey = nil
+}
+
+func newTestHWInfo() *HWInfo {
+	return &HWInfo{
+		CPUCores:         8,
+		MemoryUsableGB:   15.6,
+		MemoryPhysicalGB: 16.2,
+		GPUNames:         []string{"NVIDIA GeForce RTX 4090"},
+		GPUStats:         []GPUStat{{Index: 0, UUID: "GPU-5e4a1c6b", Name: "NVIDIA GeForce RTX 4090"}},
+		MacAddresses:     []string{"aa:bb:cc:dd:ee:ff", "00:11:22:33:44:55"},
+	}
+}
+
+func TestParseReportPolicy(t *testing.T) {
+	for _, s := range []string{"full", "hashed", "coarse", "HASHED"} {
+		policy, err := ParseReportPolicy(s)
+		assert.NoError(t, err)
+		assert.Equal(t, ReportPolicy(strings.ToLower(s)), policy)
+	}
+
+	_, err := ParseReportPolicy("none")
+	assert.Error(t, err)
+}
+
+func TestRedactFull(t *testing.T) {
+	useMachineID(t, "testdata/machine-id")
+	info := newTestHWInfo()
+
+	redacted := info.Redact(ReportFull)
+	assert.Equal(t, info.MacAddresses, redacted.MacAddresses)
+	assert.Equal(t, "GPU-5e4a1c6b", redacted.GPUStats[0].UUID)
+	assert.Len(t, redacted.Fingerprint, 16)
+	assert.Equal(t, float32(15.6), redacted.MemoryUsableGB)
+}
+
+func TestRedactHashed(t *testing.T) {
+	useMachineID(t, "testdata/machine-id")
+	info := newTestHWInfo()
+
+	redacted := info.Redact(ReportHashed)
+	assert.Len(t, redacted.MacAddresses, 2)
+	for i, mac := range redacted.MacAddresses {
+		assert.NotEqual(t, info.MacAddresses[i], mac)
+		assert.NotContains(t, mac, ":")
+	}
+	assert.NotEqual(t, "GPU-5e4a1c6b", redacted.GPUStats[0].UUID)
+	assert.NotEmpty(t, redacted.GPUStats[0].UUID)
+
+	// The fingerprint is the same as the full policy, and independent of the order of the NICs.
+	assert.Equal(t, info.Redact(ReportFull).Fingerprint, redacted.Fingerprint)
+	info.MacAddresses[0], info.MacAddresses[1] = info.MacAddresses[1], info.MacAddresses[0]
+	assert.Equal(t, redacted.Fingerprint, info.Redact(ReportHashed).Fingerprint)
+
+	// The original info is left untouched.
+	assert.Equal(t, "GPU-5e4a1c6b", info.GPUStats[0].UUID)
+
+	// The hashes are keyed by the machine ID.
+	useMachineID(t, "testdata/missing")
+	assert.NotEqual(t, redacted.Fingerprint, info.Redact(ReportHashed).Fingerprint)
+}
+
+func TestRedactCoarse(t *testing.T) {
+	useMachineID(t, "testdata/machine-id")
+	info := newTestHWInfo()
+
+	redacted := info.Redact(ReportCoarse)
+	assert.Empty(t, redacted.MacAddresses)
+	assert.Empty(t, redacted.Fingerprint)
+	assert.Empty(t, redacted.GPUStats[0].UUID)
+	assert.Equal(t, "NVIDIA GeForce RTX 4090", redacted.GPUStats[0].Name)
+	assert.Equal(t, float32(16), redacted.MemoryUsableGB)
+	assert.Equal(t, float32(16), redacted.MemoryPhysicalGB)
+	assert.Equal(t, 8, redacted.CPUCores)
+}
@@ -0,0 +1,88 @@
+/*
+Copyright © 2023 Harry C <hoveychen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package hwinfo
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Telemetry is the dynamic state of an agent, re-sent to the hub periodically.
+type Telemetry struct {
+	// Time is stamped by the hub when the telemetry is received.
+	Time          time.Time
+	LoadAverage1  float32
+	LoadAverage5  float32
+	LoadAverage15 float32
+	MemoryFreeGB  float32
+	GPUStats      []GPUStat
+	// InFlight counts the requests accepted by the worker and not yet submitted.
+	InFlight int
+	// QueueDepth counts the requests of the agent sent to the upstreams, still waiting for the response to start.
+	QueueDepth      int
+	UpstreamHealthy bool
+}
+
+var procRoot = "/proc"
+
+// CollectSystemStats fills the load average and the free memory of the machine.
+// It's a no-op on the platforms without procfs.
+func (t *Telemetry) CollectSystemStats() {
+	safeExec(func() {
+		data, err := os.ReadFile(filepath.Join(procRoot, "loadavg"))
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(string(data))
+		if len(fields) < 3 {
+			return
+		}
+		t.LoadAverage1 = parseFloat32(fields[0])
+		t.LoadAverage5 = parseFloat32(fields[1])
+		t.LoadAverage15 = parseFloat32(fields[2])
+	})
+
+	safeExec(func() {
+		f, err := os.Open(filepath.Join(procRoot, "meminfo"))
+		if err != nil {
+			return
+		}
+		defer f.Close()
+
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) < 2 || fields[0] != "MemAvailable:" {
+				continue
+			}
+			// The value is in kB.
+			t.MemoryFreeGB = parseFloat32(fields[1]) / 1024 / 1024
+			return
+		}
+	})
+}
+
+func parseFloat32(s string) float32 {
+	v, err := strconv.ParseFloat(s, 32)
+	if err != nil {
+		return 0
+	}
+	return float32(v)
+}
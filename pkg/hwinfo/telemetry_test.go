@@ -0,0 +1,41 @@
+/*
+Copyright © 2023 Harry C <hoveychen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package hwinfo
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTelemetryCollectSystemStats(t *testing.T) {
+	originalProcRoot := procRoot
+	defer func() { procRoot = originalProcRoot }()
+
+	procRoot = "testdata/proc"
+	var tel Telemetry
+	tel.CollectSystemStats()
+	assert.Equal(t, float32(1.5), tel.LoadAverage1)
+	assert.Equal(t, float32(0.75), tel.LoadAverage5)
+	assert.Equal(t, float32(0.25), tel.LoadAverage15)
+	assert.Equal(t, float32(8), tel.MemoryFreeGB)
+
+	// Missing procfs leaves the stats untouched.
+	procRoot = "testdata/missing"
+	tel = Telemetry{}
+	tel.CollectSystemStats()
+	assert.Equal(t, Telemetry{}, tel)
+}
@@ -40,6 +40,8 @@ type Connection struct {
 	processing atomic.Bool
 	err        atomic.Value
 	respWriter *WriteCloser
+	request    *http.Request
+	pathPrefix string
 }
 
 func NewConnection(agentID int, token *token.AgentToken) *Connection {
@@ -80,6 +82,21 @@ func (c *Connection) Scopes() []string {
 	return c.agentToken.GetScopes()
 }
 
+// SetPathPrefix limits the connection to the requests under the path prefix, advertised by the agent.
+// It must be set before the connection is added to the pool.
+func (c *Connection) SetPathPrefix(prefix string) {
+	c.pathPrefix = prefix
+}
+
+func (c *Connection) PathPrefix() string {
+	return c.pathPrefix
+}
+
+// Request returns the request delegated to the connection, nil if none.
+func (c *Connection) Request() *http.Request {
+	return c.request
+}
+
 func (c *Connection) IsProcessing() bool {
 	return c.processing.Load()
 }
@@ -97,14 +114,14 @@ func (c *Connection) NewSubmitter() (*WriteCloser, error) {
 	if !c.processing.Load() {
 		return nil, ErrNotProcessing
 	}
-	if c.err.Load() != nil {
-		return nil, c.err.Load().(error)
+	if err := c.loadErr(); err != nil {
+		return nil, err
 	}
 	return c.respWriter, nil
 }
 
 func (c *Connection) Close(err error) error {
-	c.err.Store(err)
+	c.storeErr(err)
 	if c.respWriter != nil {
 		c.respWriter.Close()
 	}
@@ -118,6 +135,9 @@ func (c *Connection) Delegate(ctx context.Context, w http.ResponseWriter, req *h
 	}
 
 	c.respWriter = NewWriteCloser(w)
+	c.request = req
+	// Once returned, the response writer belongs to the application request again, e.g. to reply the timeout.
+	defer c.respWriter.Revoke()
 	select {
 	case <-ctx.Done():
 		return ctx.Err()
@@ -128,12 +148,25 @@ func (c *Connection) Delegate(ctx context.Context, w http.ResponseWriter, req *h
 	select {
 	case <-ctx.Done():
 		// The request has been canceled.
-		c.err.Store(ctx.Err())
+		c.storeErr(ctx.Err())
 		return ctx.Err()
 	case <-c.respWriter.Done():
 	}
-	if c.err.Load() != nil {
-		return c.err.Load().(error)
+	return c.loadErr()
+}
+
+// connErr wraps the errors of the connection in a single type, as required by atomic.Value.
+type connErr struct {
+	error
+}
+
+func (c *Connection) storeErr(err error) {
+	c.err.Store(connErr{err})
+}
+
+func (c *Connection) loadErr() error {
+	if v := c.err.Load(); v != nil {
+		return v.(connErr).error
 	}
 	return nil
 }
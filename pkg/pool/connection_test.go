@@ -204,6 +204,15 @@ func TestConnection_ScopePaths(t *testing.T) {
 	}
 }
 
+func TestConnection_PathPrefix(t *testing.T) {
+	// Test that PathPrefix returns the value set.
+	conn := &Connection{}
+	conn.SetPathPrefix("/llm")
+	if prefix := conn.PathPrefix(); prefix != "/llm" {
+		t.Errorf("PathPrefix() = %v, want %v", prefix, "/llm")
+	}
+}
+
 func TestConnection_IsProcessing(t *testing.T) {
 	// Test that IsProcessing returns the correct value.
 	conn := &Connection{}
@@ -225,7 +234,7 @@ func TestConnection_Close_NoResponseWriter(t *testing.T) {
 	if closeErr := conn.Close(err); closeErr != nil {
 		t.Errorf("Close() error = %v, want nil", closeErr)
 	}
-	if conn.err.Load() != err {
+	if conn.loadErr() != err {
 		t.Errorf("Close() did not store the error")
 	}
 }
@@ -16,16 +16,26 @@ limitations under the License.
 package pool
 
 import (
+	"errors"
 	"io"
 	"net/http"
+	"sync"
 )
 
 var _ io.WriteCloser = (*WriteCloser)(nil)
 
+// ErrRevoked is returned by the writes after the response writer is taken back by the application request.
+var ErrRevoked = errors.New("response writer is revoked")
+
+// WriteCloser lends the response writer of the application request to the agent submitting the response.
+// The writes are serialized with Revoke, after which the application request owns the writer again.
 type WriteCloser struct {
 	http.ResponseWriter
-	closed   chan struct{}
-	isClosed bool
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	lock    sync.Mutex
+	revoked bool
 }
 
 func NewWriteCloser(w http.ResponseWriter) *WriteCloser {
@@ -36,16 +46,72 @@ func NewWriteCloser(w http.ResponseWriter) *WriteCloser {
 }
 
 func (wc *WriteCloser) Close() error {
-	if wc.isClosed {
-		return nil
+	wc.closeOnce.Do(func() {
+		close(wc.closed)
+	})
+	return nil
+}
+
+// Revoke takes the response writer back, once the writes in progress are done. The later writes fail with
+// ErrRevoked.
+func (wc *WriteCloser) Revoke() {
+	wc.lock.Lock()
+	defer wc.lock.Unlock()
+	wc.revoked = true
+}
+
+func (wc *WriteCloser) Write(p []byte) (int, error) {
+	wc.lock.Lock()
+	defer wc.lock.Unlock()
+	if wc.revoked {
+		return 0, ErrRevoked
+	}
+	return wc.ResponseWriter.Write(p)
+}
+
+func (wc *WriteCloser) WriteHeader(statusCode int) {
+	wc.lock.Lock()
+	defer wc.lock.Unlock()
+	if wc.revoked {
+		return
+	}
+	wc.ResponseWriter.WriteHeader(statusCode)
+}
+
+// UpdateHeader updates the header of the response, which is written with the status code if not zero.
+// The header must not be accessed otherwise, as the application request may take it back at any time.
+func (wc *WriteCloser) UpdateHeader(update func(h http.Header), statusCode int) error {
+	wc.lock.Lock()
+	defer wc.lock.Unlock()
+	if wc.revoked {
+		return ErrRevoked
+	}
+	update(wc.ResponseWriter.Header())
+	if statusCode != 0 {
+		wc.ResponseWriter.WriteHeader(statusCode)
 	}
-	wc.isClosed = true
-	close(wc.closed)
 	return nil
 }
 
+// Flush sends the buffered response to the application, to stream it.
+func (wc *WriteCloser) Flush() {
+	wc.lock.Lock()
+	defer wc.lock.Unlock()
+	if wc.revoked {
+		return
+	}
+	if flusher, ok := wc.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
 func (wc *WriteCloser) IsClosed() bool {
-	return wc.isClosed
+	select {
+	case <-wc.closed:
+		return true
+	default:
+		return false
+	}
 }
 
 func (wc *WriteCloser) Done() <-chan struct{} {
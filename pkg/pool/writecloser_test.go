@@ -30,13 +30,10 @@ func TestWriteCloser_Close(t *testing.T) {
 	// Create a new WriteCloser.
 	wc := NewWriteCloser(recorder)
 
-	// Test that Close sets isClosed to true and closes the closed channel.
+	// Test that Close closes the closed channel.
 	if err := wc.Close(); err != nil {
 		t.Errorf("Close() error = %v, want nil", err)
 	}
-	if !wc.isClosed {
-		t.Errorf("Close() wc.isClosed = false, want true")
-	}
 	select {
 	case <-wc.closed:
 	default:
@@ -138,3 +135,45 @@ func TestWriteCloser_WriteHeader(t *testing.T) {
 		t.Errorf("WriteHeader() status code = %d, want %d", resp.StatusCode, http.StatusTeapot)
 	}
 }
+
+func TestWriteCloser_Flush(t *testing.T) {
+	// Create a new response recorder.
+	recorder := httptest.NewRecorder()
+
+	// Create a new WriteCloser.
+	wc := NewWriteCloser(recorder)
+
+	// Test that Flush flushes the response recorder.
+	wc.Flush()
+	if !recorder.Flushed {
+		t.Errorf("Flush() recorder.Flushed = false, want true")
+	}
+}
+
+func TestWriteCloser_Revoke(t *testing.T) {
+	// Create a new response recorder.
+	recorder := httptest.NewRecorder()
+
+	// Create a new WriteCloser.
+	wc := NewWriteCloser(recorder)
+
+	// Test that the header is written with the status code.
+	if err := wc.UpdateHeader(func(h http.Header) { h.Set("X-Test", "1") }, http.StatusAccepted); err != nil {
+		t.Errorf("UpdateHeader() error = %v, want nil", err)
+	}
+	if recorder.Code != http.StatusAccepted || recorder.Header().Get("X-Test") != "1" {
+		t.Errorf("UpdateHeader() did not write the header")
+	}
+
+	// Test that the writes fail once revoked.
+	wc.Revoke()
+	if _, err := wc.Write([]byte("late")); err != ErrRevoked {
+		t.Errorf("Write() error = %v, want %v", err, ErrRevoked)
+	}
+	if err := wc.UpdateHeader(func(h http.Header) { h.Set("X-Late", "1") }, 0); err != ErrRevoked {
+		t.Errorf("UpdateHeader() error = %v, want %v", err, ErrRevoked)
+	}
+	if recorder.Body.Len() != 0 || recorder.Header().Get("X-Late") != "" {
+		t.Errorf("Revoke() did not stop the writes")
+	}
+}
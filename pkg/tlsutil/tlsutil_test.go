@@ -0,0 +1,93 @@
+/*
+Copyright © 2023 Harry C <hoveychen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package tlsutil
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeTestCert(t *testing.T, dir string) (string, *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IsCA:         true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+
+	file := filepath.Join(dir, "cert.pem")
+	// A leading key block must be skipped.
+	data := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: []byte("ignored")})
+	data = append(data, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	if err := os.WriteFile(file, data, 0600); err != nil {
+		t.Fatalf("Failed to write certificate: %v", err)
+	}
+	return file, cert
+}
+
+func TestLoadCertFingerprint(t *testing.T) {
+	dir := t.TempDir()
+	file, cert := writeTestCert(t, dir)
+
+	fingerprint, err := LoadCertFingerprint(file)
+	assert.NoError(t, err)
+	assert.Equal(t, Fingerprint(cert), fingerprint)
+	assert.Len(t, fingerprint, 64)
+
+	empty := filepath.Join(dir, "empty.pem")
+	os.WriteFile(empty, []byte("not a pem"), 0600)
+	_, err = LoadCertFingerprint(empty)
+	assert.True(t, errors.Is(err, ErrNoCertificate))
+
+	_, err = LoadCertFingerprint(filepath.Join(dir, "missing.pem"))
+	assert.Error(t, err)
+}
+
+func TestLoadCertPool(t *testing.T) {
+	dir := t.TempDir()
+	file, _ := writeTestCert(t, dir)
+
+	pool, err := LoadCertPool(file)
+	assert.NoError(t, err)
+	assert.NotNil(t, pool)
+
+	empty := filepath.Join(dir, "empty.pem")
+	os.WriteFile(empty, []byte("not a pem"), 0600)
+	_, err = LoadCertPool(file, empty)
+	assert.True(t, errors.Is(err, ErrNoCertificate))
+}
@@ -0,0 +1,126 @@
+/*
+Copyright © 2023 Harry C <hoveychen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package token
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"time"
+)
+
+// TokenInfo describes an agent token without its secrets, e.g. the signing key.
+type TokenInfo struct {
+	ID              int64
+	Name            string
+	ExpireAt        *time.Time `json:",omitempty"`
+	ScopePaths      []string   `json:",omitempty"`
+	Scopes          []string   `json:",omitempty"`
+	AgentIDs        []int64    `json:",omitempty"`
+	MaxAgentIDs     int32      `json:",omitempty"`
+	MaxConnections  int32      `json:",omitempty"`
+	Signed          bool       `json:",omitempty"`
+	CertFingerprint string     `json:",omitempty"`
+	Session         bool       `json:",omitempty"`
+	Enrollment      bool       `json:",omitempty"`
+	TokenAge        string     `json:",omitempty"`
+	RenewUntil      *time.Time `json:",omitempty"`
+	IssuedAt        *time.Time `json:",omitempty"`
+}
+
+// Describe returns the information of the token.
+func Describe(tok *AgentToken) *TokenInfo {
+	info := &TokenInfo{
+		ID:              tok.GetId(),
+		Name:            tok.GetName(),
+		ScopePaths:      tok.GetScopePaths(),
+		Scopes:          tok.GetScopes(),
+		AgentIDs:        tok.GetAgentIds(),
+		MaxAgentIDs:     tok.GetMaxAgentIds(),
+		MaxConnections:  tok.GetMaxConnections(),
+		Signed:          len(tok.GetSigningKey()) > 0,
+		CertFingerprint: tok.GetCertFingerprint(),
+		Session:         tok.GetSession(),
+		Enrollment:      tok.GetEnrollment(),
+	}
+	if tok.GetExpireAt() > 0 {
+		expireAt := time.Unix(tok.GetExpireAt(), 0)
+		info.ExpireAt = &expireAt
+	}
+	if tok.GetRenewUntil() > 0 {
+		renewUntil := time.Unix(tok.GetRenewUntil(), 0)
+		info.RenewUntil = &renewUntil
+	}
+	if tok.GetIssuedAt() > 0 {
+		issuedAt := time.Unix(tok.GetIssuedAt(), 0)
+		info.IssuedAt = &issuedAt
+	}
+	if tok.GetTokenAge() > 0 {
+		info.TokenAge = (time.Duration(tok.GetTokenAge()) * time.Second).String()
+	}
+	return info
+}
+
+// Expired reports whether the token has expired at the time.
+func (info *TokenInfo) Expired(now time.Time) bool {
+	return info.ExpireAt != nil && now.After(*info.ExpireAt)
+}
+
+// AppendLedger records the issued token in the ledger file, one JSON object per line.
+func AppendLedger(path string, tok *AgentToken) error {
+	info := Describe(tok)
+	if info.IssuedAt == nil {
+		issuedAt := time.Now()
+		info.IssuedAt = &issuedAt
+	}
+	data, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// ReadLedger returns the tokens recorded in the ledger file, in the order of issuance.
+func ReadLedger(path string) ([]*TokenInfo, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var infos []*TokenInfo
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var info TokenInfo
+		if err := json.Unmarshal(scanner.Bytes(), &info); err != nil {
+			return nil, err
+		}
+		infos = append(infos, &info)
+	}
+	return infos, scanner.Err()
+}
@@ -0,0 +1,72 @@
+/*
+Copyright © 2023 Harry C <hoveychen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package token
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDescribe(t *testing.T) {
+	expireAt := time.Now().Add(time.Hour).Unix()
+	info := Describe(&AgentToken{
+		Id:         1,
+		Name:       "test-agent",
+		ExpireAt:   expireAt,
+		Scopes:     []string{"llm"},
+		SigningKey: []byte("secret"),
+	})
+	assert.Equal(t, int64(1), info.ID)
+	assert.Equal(t, "test-agent", info.Name)
+	assert.Equal(t, expireAt, info.ExpireAt.Unix())
+	assert.Equal(t, []string{"llm"}, info.Scopes)
+	assert.True(t, info.Signed)
+	assert.False(t, info.Expired(time.Now()))
+	assert.True(t, info.Expired(time.Now().Add(2*time.Hour)))
+
+	assert.Nil(t, Describe(&AgentToken{Id: 2}).ExpireAt)
+	assert.False(t, Describe(&AgentToken{Id: 2}).Expired(time.Now()))
+}
+
+func TestLedger(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ledger.jsonl")
+
+	assert.NoError(t, AppendLedger(path, &AgentToken{Id: 1, Name: "first", SigningKey: []byte("secret")}))
+	assert.NoError(t, AppendLedger(path, &AgentToken{Id: 2, Name: "second", Scopes: []string{"llm"}}))
+
+	// The secrets never reach the ledger.
+	data, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.False(t, strings.Contains(string(data), "secret"))
+
+	infos, err := ReadLedger(path)
+	assert.NoError(t, err)
+	if assert.Len(t, infos, 2) {
+		assert.Equal(t, "first", infos[0].Name)
+		assert.True(t, infos[0].Signed)
+		assert.NotNil(t, infos[0].IssuedAt)
+		assert.Equal(t, "second", infos[1].Name)
+		assert.Equal(t, []string{"llm"}, infos[1].Scopes)
+	}
+
+	_, err = ReadLedger(filepath.Join(t.TempDir(), "missing.jsonl"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,74 @@
+/*
+Copyright © 2023 Harry C <hoveychen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package token
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/base64"
+	"io"
+	"strings"
+)
+
+const SigningKeySize = 32
+
+var keyEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// NewSigningKey generates a random key for signing the agent requests.
+func NewSigningKey() ([]byte, error) {
+	key := make([]byte, SigningKeySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// JoinCredential combines the encrypted token and the signing key into a single credential for the agent.
+// Only the token part is ever sent to the hub.
+func JoinCredential(encryptedToken string, signingKey []byte) string {
+	if len(signingKey) == 0 {
+		return encryptedToken
+	}
+	return encryptedToken + "." + keyEncoding.EncodeToString(signingKey)
+}
+
+// SplitCredential splits the credential into the encrypted token and the signing key, if any.
+func SplitCredential(credential string) (string, []byte, error) {
+	encryptedToken, encodedKey, found := strings.Cut(credential, ".")
+	if !found {
+		return credential, nil, nil
+	}
+	signingKey, err := keyEncoding.DecodeString(encodedKey)
+	if err != nil {
+		return "", nil, err
+	}
+	return encryptedToken, signingKey, nil
+}
+
+// Sign computes the signature of an agent request.
+func Sign(signingKey []byte, method, path, agentID, connectionID, timestamp, nonce string) string {
+	mac := hmac.New(sha256.New, signingKey)
+	io.WriteString(mac, strings.Join([]string{method, path, agentID, connectionID, timestamp, nonce}, "\n"))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// VerifySignature reports whether the signature of an agent request is valid.
+func VerifySignature(signingKey []byte, signature, method, path, agentID, connectionID, timestamp, nonce string) bool {
+	expected := Sign(signingKey, method, path, agentID, connectionID, timestamp, nonce)
+	return hmac.Equal([]byte(expected), []byte(signature))
+}
@@ -0,0 +1,58 @@
+/*
+Copyright © 2023 Harry C <hoveychen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package token
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCredential(t *testing.T) {
+	key, err := NewSigningKey()
+	assert.NoError(t, err)
+	assert.Len(t, key, SigningKeySize)
+
+	// Test case 1: token with a signing key
+	credential := JoinCredential("ENCRYPTEDTOKEN", key)
+	encryptedToken, signingKey, err := SplitCredential(credential)
+	assert.NoError(t, err)
+	assert.Equal(t, "ENCRYPTEDTOKEN", encryptedToken)
+	assert.Equal(t, key, signingKey)
+
+	// Test case 2: plain token
+	assert.Equal(t, "ENCRYPTEDTOKEN", JoinCredential("ENCRYPTEDTOKEN", nil))
+	encryptedToken, signingKey, err = SplitCredential("ENCRYPTEDTOKEN")
+	assert.NoError(t, err)
+	assert.Equal(t, "ENCRYPTEDTOKEN", encryptedToken)
+	assert.Nil(t, signingKey)
+
+	// Test case 3: malformed key
+	_, _, err = SplitCredential("ENCRYPTEDTOKEN.!!!")
+	assert.Error(t, err)
+}
+
+func TestSignature(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	signature := Sign(key, "POST", "/v1/agent/submit", "123", "456", "1700000000", "nonce")
+
+	assert.True(t, VerifySignature(key, signature, "POST", "/v1/agent/submit", "123", "456", "1700000000", "nonce"))
+	assert.False(t, VerifySignature(key, signature, "POST", "/v1/agent/submit", "123", "457", "1700000000", "nonce"))
+	assert.False(t, VerifySignature(key, signature, "POST", "/v1/agent/accept", "123", "456", "1700000000", "nonce"))
+	assert.False(t, VerifySignature(key, signature, "POST", "/v1/agent/submit", "124", "456", "1700000000", "nonce"))
+	assert.False(t, VerifySignature(key, signature, "POST", "/v1/agent/submit", "123", "456", "1700000001", "nonce"))
+	assert.False(t, VerifySignature([]byte("another key"), signature, "POST", "/v1/agent/submit", "123", "456", "1700000000", "nonce"))
+}
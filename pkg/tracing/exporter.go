@@ -0,0 +1,222 @@
+/*
+Copyright © 2023 Harry C <hoveychen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// maxQueuedSpans caps the spans waiting for export. The excess spans are dropped.
+	maxQueuedSpans = 4096
+	// defaultExportInterval is how often the queued spans are exported.
+	defaultExportInterval = 5 * time.Second
+)
+
+func (t *Tracer) enqueue(s *Span) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if len(t.spans) >= maxQueuedSpans {
+		return
+	}
+	t.spans = append(t.spans, s)
+}
+
+// Run exports the spans periodically, until the context is done. The remaining spans are exported on exit.
+func (t *Tracer) Run(ctx context.Context) {
+	ticker := time.NewTicker(defaultExportInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			flushCtx, cancel := context.WithTimeout(context.Background(), defaultExportInterval)
+			defer cancel()
+			t.Flush(flushCtx)
+			return
+		case <-ticker.C:
+			t.Flush(ctx)
+		}
+	}
+}
+
+// Flush exports all the ended spans.
+func (t *Tracer) Flush(ctx context.Context) {
+	t.lock.Lock()
+	spans := t.spans
+	t.spans = nil
+	t.lock.Unlock()
+	if len(spans) == 0 {
+		return
+	}
+	if err := t.exporter.Export(ctx, t.service, spans); err != nil {
+		logrus.WithError(err).WithField("spans", len(spans)).Warn("Failed to export spans")
+	}
+}
+
+// Exporter sends the spans to an OpenTelemetry collector with the OTLP/HTTP JSON encoding.
+type Exporter struct {
+	url    string
+	client *http.Client
+}
+
+func NewExporter(endpoint string) *Exporter {
+	url := strings.TrimSuffix(endpoint, "/")
+	if !strings.HasSuffix(url, "/v1/traces") {
+		url += "/v1/traces"
+	}
+	return &Exporter{
+		url:    url,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (e *Exporter) Export(ctx context.Context, service string, spans []*Span) error {
+	body, err := json.Marshal(newExportRequest(service, spans))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", e.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(resp.Status)
+	}
+	return nil
+}
+
+// The OTLP/HTTP JSON messages. See https://opentelemetry.io/docs/specs/otlp/#json-protobuf-encoding
+type (
+	exportRequest struct {
+		ResourceSpans []resourceSpans `json:"resourceSpans"`
+	}
+	resourceSpans struct {
+		Resource   resource     `json:"resource"`
+		ScopeSpans []scopeSpans `json:"scopeSpans"`
+	}
+	resource struct {
+		Attributes []keyValue `json:"attributes"`
+	}
+	scopeSpans struct {
+		Scope instrumentationScope `json:"scope"`
+		Spans []span               `json:"spans"`
+	}
+	instrumentationScope struct {
+		Name string `json:"name"`
+	}
+	span struct {
+		TraceID           string     `json:"traceId"`
+		SpanID            string     `json:"spanId"`
+		ParentSpanID      string     `json:"parentSpanId,omitempty"`
+		Name              string     `json:"name"`
+		Kind              SpanKind   `json:"kind"`
+		StartTimeUnixNano string     `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string     `json:"endTimeUnixNano"`
+		Attributes        []keyValue `json:"attributes,omitempty"`
+		Status            *status    `json:"status,omitempty"`
+	}
+	status struct {
+		Code    int    `json:"code"`
+		Message string `json:"message,omitempty"`
+	}
+	keyValue struct {
+		Key   string   `json:"key"`
+		Value anyValue `json:"value"`
+	}
+	anyValue struct {
+		StringValue *string  `json:"stringValue,omitempty"`
+		BoolValue   *bool    `json:"boolValue,omitempty"`
+		IntValue    *string  `json:"intValue,omitempty"`
+		DoubleValue *float64 `json:"doubleValue,omitempty"`
+	}
+)
+
+// statusCodeError is the OTLP status code of the failed spans.
+const statusCodeError = 2
+
+func newExportRequest(service string, spans []*Span) *exportRequest {
+	converted := make([]span, 0, len(spans))
+	for _, s := range spans {
+		s.lock.Lock()
+		sp := span{
+			TraceID:           s.context.TraceID.String(),
+			SpanID:            s.context.SpanID.String(),
+			Name:              s.name,
+			Kind:              s.kind,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+		}
+		if s.parentID != (SpanID{}) {
+			sp.ParentSpanID = s.parentID.String()
+		}
+		for k, v := range s.attributes {
+			sp.Attributes = append(sp.Attributes, newKeyValue(k, v))
+		}
+		if s.err != "" {
+			sp.Status = &status{Code: statusCodeError, Message: s.err}
+		}
+		s.lock.Unlock()
+		converted = append(converted, sp)
+	}
+
+	return &exportRequest{
+		ResourceSpans: []resourceSpans{{
+			Resource: resource{Attributes: []keyValue{newKeyValue("service.name", service)}},
+			ScopeSpans: []scopeSpans{{
+				Scope: instrumentationScope{Name: "github.com/hoveychen/slime"},
+				Spans: converted,
+			}},
+		}},
+	}
+}
+
+func newKeyValue(key string, value interface{}) keyValue {
+	kv := keyValue{Key: key}
+	switch v := value.(type) {
+	case string:
+		kv.Value.StringValue = &v
+	case bool:
+		kv.Value.BoolValue = &v
+	case int:
+		s := strconv.Itoa(v)
+		kv.Value.IntValue = &s
+	case int64:
+		s := strconv.FormatInt(v, 10)
+		kv.Value.IntValue = &s
+	case float64:
+		kv.Value.DoubleValue = &v
+	default:
+		s := fmt.Sprint(v)
+		kv.Value.StringValue = &s
+	}
+	return kv
+}
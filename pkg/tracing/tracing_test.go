@@ -0,0 +1,121 @@
+/*
+Copyright © 2023 Harry C <hoveychen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	const traceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	sc, ok := ParseTraceparent(traceparent)
+	assert.True(t, ok)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", sc.TraceID.String())
+	assert.Equal(t, "00f067aa0ba902b7", sc.SpanID.String())
+	assert.True(t, sc.Sampled)
+	assert.Equal(t, traceparent, sc.Traceparent())
+
+	for _, invalid := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473g-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+	} {
+		_, ok := ParseTraceparent(invalid)
+		assert.False(t, ok, invalid)
+	}
+}
+
+func TestTracerStart(t *testing.T) {
+	tracer := NewTracer("test", "http://localhost:4318")
+	root := tracer.Start(SpanContext{}, "root", SpanKindServer)
+	assert.True(t, root.Context().IsValid())
+
+	child := tracer.Start(root.Context(), "child", SpanKindInternal)
+	assert.Equal(t, root.Context().TraceID, child.Context().TraceID)
+	assert.NotEqual(t, root.Context().SpanID, child.Context().SpanID)
+	assert.Equal(t, root.Context().SpanID, child.parentID)
+
+	child.End()
+	child.End()
+	assert.Len(t, tracer.spans, 1)
+
+	// The sampling decision of the parent is inherited, and the unsampled spans are not exported.
+	parent, ok := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	assert.True(t, ok)
+	unsampled := tracer.Start(parent, "unsampled", SpanKindServer)
+	assert.False(t, unsampled.Context().Sampled)
+	assert.True(t, strings.HasSuffix(unsampled.Context().Traceparent(), "-00"))
+	unsampled.End()
+	assert.Len(t, tracer.spans, 1)
+
+	parent.Sampled = true
+	assert.True(t, tracer.Start(parent, "sampled", SpanKindServer).Context().Sampled)
+}
+
+func TestNilTracer(t *testing.T) {
+	var tracer *Tracer
+	span := tracer.Start(SpanContext{}, "root", SpanKindServer)
+	assert.Nil(t, span)
+	span.SetAttribute("key", "value")
+	span.SetError(errors.New("failed"))
+	span.End()
+	assert.False(t, span.Context().IsValid())
+}
+
+func TestExport(t *testing.T) {
+	var got exportRequest
+	var path string
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		json.NewDecoder(r.Body).Decode(&got)
+	}))
+	defer collector.Close()
+
+	tracer := NewTracer("slime-test", collector.URL)
+	span := tracer.Start(SpanContext{}, "upstream", SpanKindClient)
+	span.SetAttribute("http.status_code", 502)
+	span.SetAttribute("slime.agent_name", "gpu-1")
+	span.SetError(errors.New("bad gateway"))
+	span.End()
+	tracer.Flush(context.Background())
+
+	assert.Equal(t, "/v1/traces", path)
+	if assert.Len(t, got.ResourceSpans, 1) && assert.Len(t, got.ResourceSpans[0].ScopeSpans, 1) {
+		assert.Equal(t, "slime-test", *got.ResourceSpans[0].Resource.Attributes[0].Value.StringValue)
+		spans := got.ResourceSpans[0].ScopeSpans[0].Spans
+		if assert.Len(t, spans, 1) {
+			assert.Equal(t, span.Context().TraceID.String(), spans[0].TraceID)
+			assert.Equal(t, "upstream", spans[0].Name)
+			assert.Equal(t, SpanKindClient, spans[0].Kind)
+			assert.Empty(t, spans[0].ParentSpanID)
+			assert.Len(t, spans[0].Attributes, 2)
+			assert.Equal(t, statusCodeError, spans[0].Status.Code)
+		}
+	}
+	assert.Empty(t, tracer.spans)
+}